@@ -0,0 +1,300 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kamaln7/klein/auth"
+)
+
+// Provider authenticates requests with API keys passed as bearer tokens.
+// Keys are kept in a file that is reread when it changes, so keys created
+// or revoked with klein keys take effect without a restart.
+type Provider struct {
+	Config *Config
+
+	mutex   sync.Mutex
+	keys    map[string]*Key
+	file    os.FileInfo
+	checked time.Time
+}
+
+// Config contains the configuration for the API key auth provider
+type Config struct {
+	// Path is the JSON file that holds the keys
+	Path string
+	// CheckInterval is how often to check the file for changes, defaults to 1s
+	CheckInterval time.Duration
+}
+
+// Key is an API key. Only a hash of its secret is kept.
+type Key struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Hash      string       `json:"hash"`
+	Scopes    []auth.Scope `json:"scopes"`
+	CreatedAt time.Time    `json:"created_at"`
+	// ExpiresAt is when the key stops working, if ever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the key has expired at t
+func (k *Key) Expired(t time.Time) bool {
+	return k.ExpiresAt != nil && !t.Before(*k.ExpiresAt)
+}
+
+type keyFile struct {
+	Keys []*Key `json:"keys"`
+}
+
+// tokenPrefix starts every key, so that leaked keys are easy to search for
+const tokenPrefix = "klein_"
+
+// Errors returned when managing keys
+var (
+	ErrNotFound  = errors.New("apikeys: key not found")
+	ErrNameTaken = errors.New("apikeys: a key with that name already exists")
+	ErrNoScopes  = errors.New("apikeys: a key needs at least one scope")
+)
+
+// ensure that the auth.Identifier interface is implemented
+var _ auth.Identifier = new(Provider)
+
+// New loads the keys file and returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	if c.CheckInterval == 0 {
+		c.CheckInterval = time.Second
+	}
+
+	p := &Provider{
+		Config: c,
+	}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Authenticate makes sure a valid key is passed
+func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
+	principal, err := p.Identify(w, r)
+	return principal != nil, err
+}
+
+// Identify returns the principal of the key passed in the Authorization
+// header, or nil if there is no valid key
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	token := r.Header.Get("Authorization")
+	if len(token) < 7 || !strings.EqualFold(token[:7], "Bearer ") {
+		return nil, nil
+	}
+
+	id, secret, ok := parseToken(strings.TrimSpace(token[7:]))
+	if !ok {
+		return nil, nil
+	}
+
+	key, err := p.key(id)
+	if key == nil || err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(key.Hash)) != 1 || key.Expired(time.Now()) {
+		return nil, nil
+	}
+
+	return &auth.Principal{
+		Name:   key.Name,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+// key looks up a key by its ID, rereading the file first if it has changed
+func (p *Provider) key(id string) (*Key, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if time.Since(p.checked) >= p.Config.CheckInterval {
+		if err := p.reloadLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.keys[id], nil
+}
+
+func (p *Provider) reload() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.reloadLocked()
+}
+
+func (p *Provider) reloadLocked() error {
+	p.checked = time.Now()
+
+	fi, err := os.Stat(p.Config.Path)
+	if err != nil {
+		return fmt.Errorf("apikeys: could not read keys, create one with klein keys create: %v", err)
+	}
+	if !auth.FileChanged(p.file, fi) {
+		return nil
+	}
+
+	keys, err := List(p.Config.Path)
+	if err != nil {
+		return err
+	}
+
+	p.keys = make(map[string]*Key, len(keys))
+	for _, k := range keys {
+		p.keys[k.ID] = k
+	}
+	p.file = fi
+
+	return nil
+}
+
+// List reads every key from the file at path. A missing file holds no keys.
+func List(path string) ([]*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("apikeys: could not parse %s: %v", path, err)
+	}
+
+	return f.Keys, nil
+}
+
+// Create adds a key to the file at path, creating the file if needed, and
+// returns the key along with its token. The token is not stored anywhere,
+// so it can't be shown again.
+func Create(path, name string, scopes []auth.Scope, expiresAt *time.Time) (*Key, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", ErrNoScopes
+	}
+
+	keys, err := List(path)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			return nil, "", ErrNameTaken
+		}
+	}
+
+	id, err := random(8, hex.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := random(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &Key{
+		ID:        id,
+		Name:      name,
+		Hash:      hash(secret),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	if err := save(path, append(keys, key)); err != nil {
+		return nil, "", err
+	}
+
+	return key, tokenPrefix + id + "_" + secret, nil
+}
+
+// Revoke removes the key with the given ID or name from the file at path
+func Revoke(path, idOrName string) (*Key, error) {
+	keys, err := List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range keys {
+		if k.ID == idOrName || k.Name == idOrName {
+			return k, save(path, append(keys[:i], keys[i+1:]...))
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// save replaces the file at path, so that a running server never reads a partial file
+func save(path string, keys []*Key) error {
+	if keys == nil {
+		keys = []*Key{}
+	}
+	data, err := json.MarshalIndent(&keyFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func parseToken(token string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(token, tokenPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func random(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return encode(b), nil
+}
@@ -0,0 +1,186 @@
+package apikeys
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/auth"
+)
+
+func identify(t *testing.T, p *Provider, header string) *auth.Principal {
+	r := httptest.NewRequest("POST", "/", nil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+
+	principal, err := p.Identify(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return principal
+}
+
+func TestIdentify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	key, token, err := Create(path, "ci", []auth.Scope{auth.ScopeCreate, auth.ScopeStats}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	_, expired, err := Create(path, "old", auth.Scopes, &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal := identify(t, p, "Bearer "+token)
+	if principal == nil || principal.Name != "ci" {
+		t.Fatalf("expected the key to be accepted, got %+v", principal)
+	}
+	if !principal.Can(auth.ScopeCreate) || !principal.Can(auth.ScopeStats) || principal.Can(auth.ScopeDelete) || principal.Can(auth.ScopeAdmin) {
+		t.Errorf("got unexpected scopes %v", principal.Scopes)
+	}
+	if identify(t, p, "bearer "+token) == nil {
+		t.Error("expected the auth scheme to be case insensitive")
+	}
+
+	for _, header := range []string{
+		"",
+		token,
+		"Basic " + token,
+		"Bearer " + token[:len(token)-1],
+		"Bearer " + token + "x",
+		"Bearer " + strings.Replace(token, key.ID, "0000000000000000", 1),
+		"Bearer klein_" + key.ID,
+		"Bearer klein__",
+		"Bearer " + key.Hash,
+		"Bearer " + expired,
+	} {
+		if principal := identify(t, p, header); principal != nil {
+			t.Errorf("expected %q to be rejected, got %+v", header, principal)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), strings.TrimPrefix(token, tokenPrefix+key.ID+"_")) {
+		t.Error("expected the secret not to be stored")
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the keys file to only be readable by its owner, got %v", fi.Mode())
+	}
+}
+
+func TestNullScopes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	_, token, err := Create(path, "edited", []auth.Scope{auth.ScopeCreate}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a key whose scopes were removed by hand
+	data, _ := ioutil.ReadFile(path)
+	data = regexp.MustCompile(`"scopes":\s*\[[^\]]*\]`).ReplaceAll(data, []byte(`"scopes": null`))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal := identify(t, p, "Bearer "+token)
+	if principal == nil {
+		t.Fatal("expected the key to be accepted")
+	}
+	for _, scope := range auth.Scopes {
+		if principal.Can(scope) {
+			t.Errorf("expected a key without scopes not to be granted %s", scope)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if _, err := New(&Config{Path: path}); err == nil {
+		t.Error("expected an error without a keys file")
+	}
+
+	_, token, err := Create(path, "ci", auth.Scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(&Config{Path: path, CheckInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, other, err := Create(path, "other", auth.Scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identify(t, p, "Bearer "+other) == nil {
+		t.Error("expected a new key to be picked up")
+	}
+
+	if _, err := Revoke(path, "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if identify(t, p, "Bearer "+token) != nil {
+		t.Error("expected a revoked key to be rejected")
+	}
+	if identify(t, p, "Bearer "+other) == nil {
+		t.Error("expected the other key to keep working")
+	}
+}
+
+func TestManage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	if keys, err := List(path); err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys without a file, got %v, %v", keys, err)
+	}
+	if _, _, err := Create(path, "ci", nil, nil); err != ErrNoScopes {
+		t.Errorf("expected ErrNoScopes, got %v", err)
+	}
+
+	key, _, err := Create(path, "ci", auth.Scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Create(path, "ci", auth.Scopes, nil); err != ErrNameTaken {
+		t.Errorf("expected ErrNameTaken, got %v", err)
+	}
+	other, _, err := Create(path, "other", auth.Scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := List(path)
+	if err != nil || len(keys) != 2 || keys[0].ID != key.ID || keys[1].ID != other.ID {
+		t.Errorf("expected both keys to be listed, got %v, %v", keys, err)
+	}
+
+	if revoked, err := Revoke(path, key.ID); err != nil || revoked.Name != "ci" {
+		t.Errorf("expected to revoke ci by its ID, got %v, %v", revoked, err)
+	}
+	if _, err := Revoke(path, "ci"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if revoked, err := Revoke(path, "other"); err != nil || revoked.ID != other.ID {
+		t.Errorf("expected to revoke other by its name, got %v, %v", revoked, err)
+	}
+	if keys, err := List(path); err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys left, got %v, %v", keys, err)
+	}
+}
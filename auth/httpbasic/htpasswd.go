@@ -0,0 +1,121 @@
+package httpbasic
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hash is a hashed password from an htpasswd file
+type hash interface {
+	verify(password string) bool
+}
+
+// parse reads an htpasswd file. Every line holds a username and a bcrypt
+// hash, as written by htpasswd -B, or an argon2 hash in the PHC string
+// format, as written by the argon2 command line tool. Empty lines and lines
+// starting with # are skipped.
+func parse(r io.Reader) (map[string]hash, error) {
+	users := make(map[string]hash)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("httpbasic: line %d: expected username:hash", n)
+		}
+		username, encoded := line[:i], line[i+1:]
+		if _, ok := users[username]; ok {
+			return nil, fmt.Errorf("httpbasic: line %d: %s is listed more than once", n, username)
+		}
+
+		h, err := parseHash(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("httpbasic: line %d: %v", n, err)
+		}
+		users[username] = h
+	}
+
+	return users, scanner.Err()
+}
+
+func parseHash(encoded string) (hash, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return nil, err
+		}
+		return bcryptHash(encoded), nil
+	case strings.HasPrefix(encoded, "$argon2id$"), strings.HasPrefix(encoded, "$argon2i$"):
+		return parseArgon2(encoded)
+	default:
+		return nil, fmt.Errorf("unsupported hash, only bcrypt and argon2 hashes are accepted")
+	}
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+type argon2Hash struct {
+	id      bool
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 parses $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func parseArgon2(encoded string) (hash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("malformed argon2 hash")
+	}
+
+	h := &argon2Hash{id: parts[1] == "argon2id"}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2 parameters %q", parts[3])
+	}
+	if h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("malformed argon2 parameters %q", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("malformed argon2 salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("malformed argon2 hash: %v", err)
+	}
+
+	return h, nil
+}
+
+func (h *argon2Hash) verify(password string) bool {
+	derive := argon2.Key
+	if h.id {
+		derive = argon2.IDKey
+	}
+
+	key := derive([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
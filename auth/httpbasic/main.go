@@ -1,47 +1,175 @@
 package httpbasic
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/kamaln7/klein/auth"
 )
 
-// Provider implements an alias generator
+// Provider authenticates requests with HTTP basic auth, either as a single
+// user from the config or as any user in an htpasswd file
 type Provider struct {
 	Config *Config
+
+	mutex   sync.Mutex
+	users   map[string]hash
+	dummy   hash
+	file    os.FileInfo
+	checked time.Time
 }
 
 // Config contains the config
 type Config struct {
 	Username, Password string
+
+	// File is an htpasswd file with bcrypt or argon2 hashed passwords. If
+	// it is set, Username and Password are ignored.
+	File string
+	// CheckInterval is how often to check File for changes, defaults to 1s
+	CheckInterval time.Duration
+	// Scopes are granted to every user, defaults to create
+	Scopes []auth.Scope
 }
 
-// ensure that the auth.Provider interface is implemented
-var _ auth.Provider = new(Provider)
+// ensure that the auth.Identifier interface is implemented
+var _ auth.Identifier = new(Provider)
 
 // New initializes the auth provider and returns a new instance
-func New(c *Config) *Provider {
-	return &Provider{
+func New(c *Config) (*Provider, error) {
+	if c.CheckInterval == 0 {
+		c.CheckInterval = time.Second
+	}
+	if c.Scopes == nil {
+		c.Scopes = []auth.Scope{auth.ScopeCreate}
+	}
+
+	p := &Provider{
 		Config: c,
 	}
+	if c.File != "" {
+		if err := p.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
 }
 
 // Authenticate makes sure the right credentials are passed
 func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
-	if p.Config.Username == "" || p.Config.Password == "" {
-		return false, nil
+	principal, err := p.Identify(w, r)
+	return principal != nil, err
+}
+
+// Identify returns the user whose credentials are passed, or nil if they are
+// missing or wrong
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	if p.Config.File == "" && (p.Config.Username == "" || p.Config.Password == "") {
+		return nil, nil
 	}
 
 	w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 
 	username, password, authOK := r.BasicAuth()
 	if authOK == false {
-		return false, nil
+		return nil, nil
+	}
+
+	ok, err := p.check(username, password)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	return &auth.Principal{
+		Name:   username,
+		Scopes: append([]auth.Scope{}, p.Config.Scopes...),
+	}, nil
+}
+
+func (p *Provider) check(username, password string) (bool, error) {
+	if p.Config.File == "" {
+		// comparing hashes keeps the lengths of the credentials from leaking
+		userOK := equal(username, p.Config.Username)
+		passwordOK := equal(password, p.Config.Password)
+		return userOK && passwordOK, nil
 	}
 
-	if username != p.Config.Username || password != p.Config.Password {
+	h, dummy, err := p.user(username)
+	if err != nil {
+		return false, err
+	}
+	if h == nil {
+		// take as long as checking a real password would, so that the
+		// response time doesn't tell which users exist
+		if dummy != nil {
+			dummy.verify(password)
+		}
 		return false, nil
 	}
 
-	return true, nil
+	return h.verify(password), nil
+}
+
+// user looks up a user's password hash, rereading the file first if it has
+// changed. It also returns another user's hash to check unknown users against.
+func (p *Provider) user(username string) (hash, hash, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if time.Since(p.checked) >= p.Config.CheckInterval {
+		if err := p.reloadLocked(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return p.users[username], p.dummy, nil
+}
+
+func (p *Provider) reload() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.reloadLocked()
+}
+
+func (p *Provider) reloadLocked() error {
+	p.checked = time.Now()
+
+	fi, err := os.Stat(p.Config.File)
+	if err != nil {
+		return err
+	}
+	if !auth.FileChanged(p.file, fi) {
+		return nil
+	}
+
+	f, err := os.Open(p.Config.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users, err := parse(f)
+	if err != nil {
+		return err
+	}
+
+	p.users = users
+	p.dummy = nil
+	for _, h := range users {
+		p.dummy = h
+		break
+	}
+	p.file = fi
+	return nil
+}
+
+func equal(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
 }
@@ -0,0 +1,183 @@
+package httpbasic
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/auth"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func identify(t *testing.T, p *Provider, username, password string) string {
+	r := httptest.NewRequest("POST", "/", nil)
+	if username != "" || password != "" {
+		r.SetBasicAuth(username, password)
+	}
+
+	principal, err := p.Identify(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal == nil {
+		return ""
+	}
+
+	return principal.Name
+}
+
+func bcryptLine(username, password string) string {
+	h, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	return username + ":" + string(h)
+}
+
+func argon2Line(username, password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("%s:$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", username, argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeFile(t *testing.T, path string, lines ...string) {
+	// write next to the file and rename, so that the change is noticed however coarse mtimes are
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSingleUser(t *testing.T) {
+	p, err := New(&Config{Username: "klein", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := identify(t, p, "klein", "secret"); name != "klein" {
+		t.Errorf("expected to be identified as klein, got %q", name)
+	}
+	for _, c := range [][2]string{{"", ""}, {"klein", ""}, {"klein", "secre"}, {"klein", "secrets"}, {"other", "secret"}} {
+		if name := identify(t, p, c[0], c[1]); name != "" {
+			t.Errorf("expected %v to be rejected, got %q", c, name)
+		}
+	}
+
+	// without credentials configured, nobody gets in
+	p, _ = New(&Config{})
+	if name := identify(t, p, "", ""); name != "" {
+		t.Errorf("expected to be rejected, got %q", name)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.SetBasicAuth("klein", "secret")
+
+	for _, tc := range []struct {
+		scopes, want []auth.Scope
+	}{
+		{nil, []auth.Scope{auth.ScopeCreate}},
+		{[]auth.Scope{}, []auth.Scope{}},
+		{auth.Scopes, auth.Scopes},
+	} {
+		p, err := New(&Config{Username: "klein", Password: "secret", Scopes: tc.scopes})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		principal, err := p.Identify(httptest.NewRecorder(), r)
+		if err != nil || principal == nil {
+			t.Fatalf("expected to be identified, got %v", err)
+		}
+		for _, scope := range auth.Scopes {
+			want := false
+			for _, s := range tc.want {
+				want = want || s == scope
+			}
+			if principal.Can(scope) != want {
+				t.Errorf("configured with %v, expected %s to be %v", tc.scopes, scope, want)
+			}
+		}
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, path,
+		"# admins",
+		bcryptLine("alice", "alice's secret"),
+		"",
+		argon2Line("bob", "bob's secret"),
+	)
+
+	p, err := New(&Config{File: path, Username: "klein", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := identify(t, p, "alice", "alice's secret"); name != "alice" {
+		t.Errorf("expected to be identified as alice, got %q", name)
+	}
+	if name := identify(t, p, "bob", "bob's secret"); name != "bob" {
+		t.Errorf("expected to be identified as bob, got %q", name)
+	}
+	for _, c := range [][2]string{{"alice", "bob's secret"}, {"bob", "alice's secret"}, {"bob", ""}, {"carol", "alice's secret"}, {"klein", "secret"}} {
+		if name := identify(t, p, c[0], c[1]); name != "" {
+			t.Errorf("expected %v to be rejected, got %q", c, name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, path, bcryptLine("alice", "secret"))
+
+	p, err := New(&Config{File: path, CheckInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := identify(t, p, "alice", "secret"); name != "alice" {
+		t.Fatalf("expected to be identified as alice, got %q", name)
+	}
+
+	writeFile(t, path, bcryptLine("bob", "secret"))
+	if name := identify(t, p, "alice", "secret"); name != "" {
+		t.Errorf("expected a removed user to be rejected, got %q", name)
+	}
+	if name := identify(t, p, "bob", "secret"); name != "bob" {
+		t.Errorf("expected an added user to be identified, got %q", name)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if _, err := New(&Config{File: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	for name, lines := range map[string][]string{
+		"no hash":   {"alice"},
+		"no user":   {":$2y$05$abcdefghijklmnopqrstuu"},
+		"plaintext": {"alice:secret"},
+		"md5":       {"alice:$apr1$salt$hash"},
+		"sha1":      {"alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+		"bcrypt":    {"alice:$2y$05$tooshort"},
+		"argon2":    {"alice:$argon2id$v=19$m=1024,t=1,p=1$c2FsdA"},
+		"duplicate": {bcryptLine("alice", "a"), bcryptLine("alice", "b")},
+	} {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		writeFile(t, path, lines...)
+
+		if _, err := New(&Config{File: path}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/kamaln7/klein/auth"
+)
+
+// Provider authenticates requests with JWTs passed as bearer tokens, signed
+// either with a shared secret or with a key from a JSON Web Key Set
+type Provider struct {
+	Config *Config
+
+	mutex   sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+// Config contains the configuration for the JWT auth provider
+type Config struct {
+	// Secret verifies HS256 signed tokens
+	Secret string
+	// JWKS is the path or http(s) URL of a JSON Web Key Set to verify RS256
+	// and ES256 signed tokens with
+	JWKS string
+	// JWKSRefresh is how often to reload the key set, defaults to 1h. Tokens
+	// signed with an unknown key also cause a reload, at most once a minute.
+	JWKSRefresh time.Duration
+	// HTTPClient fetches JWKS URLs, defaults to a client with a 10s timeout
+	HTTPClient *http.Client
+
+	// Issuer has to match the iss claim, if set
+	Issuer string
+	// Audience has to be one of the values of the aud claim, if set
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf, defaults to 1m.
+	// Set it below 0 for no leeway.
+	Leeway time.Duration
+
+	// NameClaim holds the principal's name, defaults to sub
+	NameClaim string
+	// ScopesClaim holds the principal's scopes, either as a space separated
+	// string or as a list. Defaults to scope. Unknown scopes are ignored.
+	ScopesClaim string
+	// ScopePrefix is stripped from scopes, eg klein: to map klein:create to
+	// create. Scopes without the prefix are ignored.
+	ScopePrefix string
+}
+
+// minRefresh limits reloads of the key set caused by unknown keys
+const minRefresh = time.Minute
+
+// ErrNoKeys is returned by New if neither a secret nor a key set is configured
+var ErrNoKeys = errors.New("jwt: a secret or a JWKS is required")
+
+// ensure that the auth.Identifier interface is implemented
+var _ auth.Identifier = new(Provider)
+
+// New loads the key set, if any, and returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	if c.Secret == "" && c.JWKS == "" {
+		return nil, ErrNoKeys
+	}
+	if c.JWKSRefresh == 0 {
+		c.JWKSRefresh = time.Hour
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if c.Leeway == 0 {
+		c.Leeway = time.Minute
+	} else if c.Leeway < 0 {
+		c.Leeway = 0
+	}
+	if c.NameClaim == "" {
+		c.NameClaim = "sub"
+	}
+	if c.ScopesClaim == "" {
+		c.ScopesClaim = "scope"
+	}
+
+	p := &Provider{
+		Config: c,
+	}
+	if c.JWKS != "" {
+		p.mutex.Lock()
+		err := p.refresh()
+		p.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Authenticate makes sure a valid token is passed
+func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
+	principal, err := p.Identify(w, r)
+	return principal != nil, err
+}
+
+// Identify returns the principal described by the token in the
+// Authorization header, or nil if there is no valid token
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return nil, nil
+	}
+
+	claims, err := p.Verify(strings.TrimSpace(header[7:]))
+	if err != nil {
+		return nil, nil
+	}
+
+	return p.principal(claims), nil
+}
+
+// Verify checks a token's signature and its exp, nbf, iss and aud claims,
+// and returns all of its claims
+func (p *Provider) Verify(token string) (map[string]interface{}, error) {
+	var algs []jose.SignatureAlgorithm
+	if p.Config.Secret != "" {
+		algs = append(algs, jose.HS256)
+	}
+	if p.Config.JWKS != "" {
+		algs = append(algs, jose.RS256, jose.ES256)
+	}
+
+	tok, err := josejwt.ParseSigned(token, algs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		std    josejwt.Claims
+		claims map[string]interface{}
+	)
+	if alg := tok.Headers[0].Algorithm; alg == string(jose.HS256) {
+		err = tok.Claims([]byte(p.Config.Secret), &std, &claims)
+	} else {
+		err = p.verifyWithKeySet(tok, &std, &claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if std.Expiry == nil {
+		return nil, errors.New("jwt: token does not expire")
+	}
+	expected := josejwt.Expected{
+		Issuer: p.Config.Issuer,
+	}
+	if p.Config.Audience != "" {
+		expected.AnyAudience = josejwt.Audience{p.Config.Audience}
+	}
+	if err := std.ValidateWithLeeway(expected, p.Config.Leeway); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verifyWithKeySet tries the key named by the token, reloading the key set
+// once if it doesn't have it. Tokens without a key ID are tried against
+// every key.
+func (p *Provider) verifyWithKeySet(tok *josejwt.JSONWebToken, dest ...interface{}) error {
+	kid := tok.Headers[0].KeyID
+
+	keys, err := p.lookup(kid, false)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && kid != "" {
+		if keys, err = p.lookup(kid, true); err != nil {
+			return err
+		}
+	}
+
+	err = errors.New("jwt: no key to verify the token with")
+	for _, key := range keys {
+		if err = tok.Claims(key, dest...); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (p *Provider) lookup(kid string, unknown bool) ([]jose.JSONWebKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	since := time.Since(p.fetched)
+	if since >= p.Config.JWKSRefresh || unknown && since >= minRefresh {
+		if err := p.refresh(); err != nil && p.keys == nil {
+			return nil, err
+		}
+	}
+
+	if kid == "" {
+		return p.keys.Keys, nil
+	}
+	return p.keys.Key(kid), nil
+}
+
+// refresh reloads the key set. If that fails, the previous keys are kept.
+func (p *Provider) refresh() error {
+	p.fetched = time.Now()
+
+	data, err := p.readJWKS()
+	if err != nil {
+		return fmt.Errorf("jwt: could not load JWKS %s: %v", p.Config.JWKS, err)
+	}
+
+	keys := new(jose.JSONWebKeySet)
+	if err := json.Unmarshal(data, keys); err != nil {
+		return fmt.Errorf("jwt: could not parse JWKS %s: %v", p.Config.JWKS, err)
+	}
+	for _, k := range keys.Keys {
+		if !k.IsPublic() {
+			return fmt.Errorf("jwt: JWKS %s holds a private or symmetric key %q", p.Config.JWKS, k.KeyID)
+		}
+	}
+
+	p.keys = keys
+	return nil
+}
+
+func (p *Provider) readJWKS() ([]byte, error) {
+	if !strings.HasPrefix(p.Config.JWKS, "http://") && !strings.HasPrefix(p.Config.JWKS, "https://") {
+		return ioutil.ReadFile(p.Config.JWKS)
+	}
+
+	res, err := p.Config.HTTPClient.Get(p.Config.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// principal maps a token's claims to a principal
+func (p *Provider) principal(claims map[string]interface{}) *auth.Principal {
+	name, _ := claims[p.Config.NameClaim].(string)
+
+	var values []string
+	switch v := claims[p.Config.ScopesClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	scopes := []auth.Scope{}
+	for _, v := range values {
+		if !strings.HasPrefix(v, p.Config.ScopePrefix) {
+			continue
+		}
+		if scope, err := auth.ParseScope(strings.TrimPrefix(v, p.Config.ScopePrefix)); err == nil {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return &auth.Principal{
+		Name:   name,
+		Scopes: scopes,
+	}
+}
@@ -0,0 +1,311 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/kamaln7/klein/auth"
+)
+
+const secret = "a shared secret that is long enough for HS256"
+
+// signer holds a generated key and signs tokens with it
+type signer struct {
+	alg jose.SignatureAlgorithm
+	kid string
+	key interface{}
+}
+
+func newRSA(t *testing.T, kid string) *signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{jose.RS256, kid, key}
+}
+
+func newECDSA(t *testing.T, kid string) *signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{jose.ES256, kid, key}
+}
+
+func (s *signer) public() jose.JSONWebKey {
+	var pub interface{}
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		pub = key.Public()
+	case *ecdsa.PrivateKey:
+		pub = key.Public()
+	}
+
+	return jose.JSONWebKey{Key: pub, KeyID: s.kid, Algorithm: string(s.alg), Use: "sig"}
+}
+
+func (s *signer) sign(t *testing.T, claims map[string]interface{}) string {
+	opts := new(jose.SignerOptions).WithType("JWT")
+	if s.kid != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), s.kid)
+	}
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: s.alg, Key: s.key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := josejwt.Signed(sig).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func writeJWKS(t *testing.T, path string, signers ...*signer) {
+	set := jose.JSONWebKeySet{}
+	for _, s := range signers {
+		set.Keys = append(set.Keys, s.public())
+	}
+
+	data, _ := json.Marshal(set)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// claims returns valid claims for the test config, with overrides
+func claims(overrides map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss":   "https://id.example.com",
+		"aud":   []string{"other", "klein"},
+		"sub":   "alice",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"scope": "openid klein:create klein:stats",
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+
+	return c
+}
+
+func identify(t *testing.T, p *Provider, token string) *auth.Principal {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	principal, err := p.Identify(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return principal
+}
+
+func newProvider(t *testing.T, c *Config) *Provider {
+	c.Issuer = "https://id.example.com"
+	c.Audience = "klein"
+	c.ScopePrefix = "klein:"
+
+	p, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestAlgorithms(t *testing.T) {
+	rs, es := newRSA(t, "rs"), newECDSA(t, "es")
+	hs := &signer{jose.HS256, "", []byte(secret)}
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, rs, es)
+
+	p := newProvider(t, &Config{Secret: secret, JWKS: jwks})
+	for _, s := range []*signer{rs, es, hs} {
+		principal := identify(t, p, s.sign(t, claims(nil)))
+		if principal == nil || principal.Name != "alice" {
+			t.Errorf("%s: expected the token to be accepted, got %+v", s.alg, principal)
+			continue
+		}
+		if !principal.Can(auth.ScopeCreate) || !principal.Can(auth.ScopeStats) || principal.Can(auth.ScopeDelete) || principal.Can(auth.ScopeAdmin) {
+			t.Errorf("%s: got unexpected scopes %v", s.alg, principal.Scopes)
+		}
+	}
+
+	// only the configured kinds of keys are accepted
+	secretOnly := newProvider(t, &Config{Secret: secret})
+	if identify(t, secretOnly, rs.sign(t, claims(nil))) != nil {
+		t.Error("expected RS256 to be rejected without a JWKS")
+	}
+	jwksOnly := newProvider(t, &Config{JWKS: jwks})
+	if identify(t, jwksOnly, hs.sign(t, claims(nil))) != nil {
+		t.Error("expected HS256 to be rejected without a secret")
+	}
+
+	// an HS256 token signed with the public key must not pass as RS256
+	pub, _ := json.Marshal(rs.public())
+	confused := &signer{jose.HS256, "rs", pub}
+	if identify(t, p, confused.sign(t, claims(nil))) != nil {
+		t.Error("expected a token signed with the public key to be rejected")
+	}
+
+	// tokens signed by a key that isn't in the set
+	if identify(t, p, newRSA(t, "rs").sign(t, claims(nil))) != nil {
+		t.Error("expected a token signed by an unknown key to be rejected")
+	}
+	if identify(t, p, (&signer{jose.HS256, "", []byte("a different secret that is long enough")}).sign(t, claims(nil))) != nil {
+		t.Error("expected a token signed with the wrong secret to be rejected")
+	}
+}
+
+func TestClaims(t *testing.T) {
+	s := newECDSA(t, "es")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, s)
+	p := newProvider(t, &Config{JWKS: jwks, Leeway: -1})
+
+	for name, overrides := range map[string]map[string]interface{}{
+		"wrong issuer":   {"iss": "https://evil.example.com"},
+		"no issuer":      {"iss": nil},
+		"wrong audience": {"aud": "other"},
+		"no audience":    {"aud": nil},
+		"expired":        {"exp": time.Now().Add(-time.Second).Unix()},
+		"no expiry":      {"exp": nil},
+		"not yet valid":  {"nbf": time.Now().Add(time.Hour).Unix()},
+		"issued later":   {"iat": time.Now().Add(time.Hour).Unix()},
+	} {
+		if principal := identify(t, p, s.sign(t, claims(overrides))); principal != nil {
+			t.Errorf("%s: expected the token to be rejected, got %+v", name, principal)
+		}
+	}
+
+	if identify(t, p, s.sign(t, claims(map[string]interface{}{"aud": "klein"}))) == nil {
+		t.Error("expected a single audience to be accepted")
+	}
+
+	// a token without any scopes can't do anything
+	principal := identify(t, p, s.sign(t, claims(map[string]interface{}{"scope": nil})))
+	if principal == nil || principal.Scopes == nil || len(principal.Scopes) != 0 {
+		t.Errorf("expected a principal without scopes, got %+v", principal)
+	}
+}
+
+func TestLeeway(t *testing.T) {
+	s := newECDSA(t, "es")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, s)
+
+	token := s.sign(t, claims(map[string]interface{}{"exp": time.Now().Add(-10 * time.Second).Unix()}))
+	if identify(t, newProvider(t, &Config{JWKS: jwks}), token) == nil {
+		t.Error("expected a token that just expired to be accepted with the default leeway")
+	}
+	if identify(t, newProvider(t, &Config{JWKS: jwks, Leeway: -1}), token) != nil {
+		t.Error("expected a token that just expired to be rejected without leeway")
+	}
+}
+
+func TestMapping(t *testing.T) {
+	hs := &signer{jose.HS256, "", []byte(secret)}
+	p, err := New(&Config{
+		Secret:      secret,
+		NameClaim:   "email",
+		ScopesClaim: "permissions",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal := identify(t, p, hs.sign(t, claims(map[string]interface{}{
+		"email":       "alice@example.com",
+		"permissions": []string{"create", "delete", "admin", "unknown"},
+	})))
+	if principal == nil || principal.Name != "alice@example.com" {
+		t.Fatalf("expected to be identified by email, got %+v", principal)
+	}
+	if len(principal.Scopes) != 3 || !principal.Can(auth.ScopeDelete) || principal.Can(auth.ScopeStats) {
+		t.Errorf("got unexpected scopes %v", principal.Scopes)
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+	old, rotated := newRSA(t, "2024"), newECDSA(t, "2025")
+
+	var (
+		set      atomic.Value
+		requests int32
+	)
+	set.Store([]*signer{old})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		keys := jose.JSONWebKeySet{}
+		for _, s := range set.Load().([]*signer) {
+			keys.Keys = append(keys.Keys, s.public())
+		}
+		json.NewEncoder(w).Encode(keys)
+	}))
+	defer ts.Close()
+
+	p := newProvider(t, &Config{JWKS: ts.URL})
+	if identify(t, p, old.sign(t, claims(nil))) == nil {
+		t.Error("expected a token signed by the served key to be accepted")
+	}
+
+	// the identity provider rotates its key
+	set.Store([]*signer{old, rotated})
+	p.fetched = time.Now().Add(-minRefresh)
+	if identify(t, p, rotated.sign(t, claims(nil))) == nil {
+		t.Error("expected the key set to be reloaded for an unknown key")
+	}
+
+	// unknown keys don't make every request reload the key set
+	n := atomic.LoadInt32(&requests)
+	for i := 0; i < 5; i++ {
+		identify(t, p, newECDSA(t, "forged").sign(t, claims(nil)))
+	}
+	if atomic.LoadInt32(&requests) != n {
+		t.Errorf("expected the key set not to be reloaded again, got %d more requests", atomic.LoadInt32(&requests)-n)
+	}
+
+	// the key set is down, the previous keys are kept
+	ts.Config.Handler = http.NotFoundHandler()
+	p.fetched = time.Now().Add(-time.Hour)
+	if identify(t, p, rotated.sign(t, claims(nil))) == nil {
+		t.Error("expected the previous keys to be kept")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(&Config{}); err != ErrNoKeys {
+		t.Errorf("expected ErrNoKeys, got %v", err)
+	}
+	if _, err := New(&Config{JWKS: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("expected an error for a missing JWKS")
+	}
+
+	// private keys don't belong in a JWKS
+	s := newRSA(t, "private")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: s.key, KeyID: "private"}}})
+	ioutil.WriteFile(jwks, data, 0600)
+	if _, err := New(&Config{JWKS: jwks}); err == nil {
+		t.Error("expected an error for a private key in the JWKS")
+	}
+}
@@ -1,10 +1,83 @@
 package auth
 
 import (
+	"fmt"
 	"net/http"
+	"os"
 )
 
 // A Provider implements all the necessary functions for an authentication system
 type Provider interface {
 	Authenticate(w http.ResponseWriter, r *http.Request) (bool, error)
 }
+
+// An Identifier is a Provider that knows who made a request and what they
+// are allowed to do. Identify returns nil if the request isn't authenticated.
+type Identifier interface {
+	Provider
+	Identify(w http.ResponseWriter, r *http.Request) (*Principal, error)
+}
+
+// A Handler is a Provider with endpoints of its own, such as a login page.
+// The server passes it every request under /_auth/.
+type Handler interface {
+	Provider
+	http.Handler
+}
+
+// A Scope allows using one part of klein's API
+type Scope string
+
+// Scopes that can be granted
+const (
+	// ScopeCreate allows shortening links
+	ScopeCreate Scope = "create"
+	// ScopeDelete allows deleting links
+	ScopeDelete Scope = "delete"
+	// ScopeAdmin allows exporting, importing and backing up every link
+	ScopeAdmin Scope = "admin"
+	// ScopeStats allows reading usage stats
+	ScopeStats Scope = "stats"
+)
+
+// Scopes lists every scope
+var Scopes = []Scope{ScopeCreate, ScopeDelete, ScopeAdmin, ScopeStats}
+
+// ParseScope checks that s is a known scope
+func ParseScope(s string) (Scope, error) {
+	for _, scope := range Scopes {
+		if string(scope) == s {
+			return scope, nil
+		}
+	}
+
+	return "", fmt.Errorf("auth: unknown scope %q", s)
+}
+
+// A Principal is who a request was authenticated as
+type Principal struct {
+	Name string
+	// Scopes are what the principal is allowed to do. A principal without
+	// scopes can't do anything.
+	Scopes []Scope
+}
+
+// Can reports whether the principal has been granted scope
+func (p *Principal) Can(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FileChanged reports whether fi describes a different version of a file
+// than last, which is nil if the file hasn't been read yet. A file replaced
+// by renaming another over it counts as changed even if its modification
+// time is the same, as modification times can be too coarse to tell two
+// quick writes apart.
+func FileChanged(last, fi os.FileInfo) bool {
+	return last == nil || !os.SameFile(last, fi) || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size()
+}
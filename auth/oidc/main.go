@@ -0,0 +1,333 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/kamaln7/klein/auth"
+	"golang.org/x/oauth2"
+)
+
+// Provider lets browser users log in with an OpenID Connect provider, and
+// authenticates their requests with a session cookie afterwards
+type Provider struct {
+	Config *Config
+
+	oauth    *oauth2.Config
+	verifier *gooidc.IDTokenVerifier
+	key      []byte
+	origin   string
+	secure   bool
+}
+
+// Config contains the configuration for the OpenID Connect auth provider
+type Config struct {
+	// Issuer is the OpenID provider's URL, eg https://accounts.google.com
+	Issuer                 string
+	ClientID, ClientSecret string
+	// RedirectURL is klein's callback, eg https://klein.example.com/_auth/callback
+	RedirectURL string
+	// HTTPClient talks to the OpenID provider, defaults to a client with a
+	// 10s timeout
+	HTTPClient *http.Client
+
+	// SessionSecret signs the session cookies. Every klein instance behind
+	// the same URL needs the same secret.
+	SessionSecret string
+	// SessionTTL is how long a login lasts, defaults to 12h
+	SessionTTL time.Duration
+
+	// Domains, if set, only lets in users with a verified email address at
+	// one of these domains
+	Domains []string
+	// Groups, if set, only lets in members of at least one of these groups
+	Groups []string
+	// GroupsClaim is the ID token claim listing the user's groups, defaults
+	// to groups
+	GroupsClaim string
+	// ExtraScopes are requested on top of openid, email and profile, eg
+	// groups for providers that only add the groups claim when asked to
+	ExtraScopes []string
+
+	// Scopes are granted to everyone who logs in, defaults to create
+	Scopes []auth.Scope
+}
+
+// Errors returned by New for incomplete configs
+var (
+	ErrNoClient        = errors.New("oidc: an issuer, client ID and redirect URL are required")
+	ErrNoSessionSecret = errors.New("oidc: a session secret is required")
+	ErrRedirectURL     = errors.New("oidc: the redirect URL has to end in /_auth/callback")
+)
+
+// ensure that the auth.Identifier and auth.Handler interfaces are implemented
+var (
+	_ auth.Identifier = new(Provider)
+	_ auth.Handler    = new(Provider)
+)
+
+// New discovers the OpenID provider's endpoints and keys and returns a new
+// Provider instance
+func New(c *Config) (*Provider, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, ErrNoClient
+	}
+	if c.SessionSecret == "" {
+		return nil, ErrNoSessionSecret
+	}
+	redirect, err := url.Parse(c.RedirectURL)
+	if err != nil || redirect.Host == "" || !strings.HasSuffix(redirect.Path, "/_auth/callback") {
+		return nil, ErrRedirectURL
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if c.SessionTTL == 0 {
+		c.SessionTTL = 12 * time.Hour
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	if c.Scopes == nil {
+		c.Scopes = []auth.Scope{auth.ScopeCreate}
+	}
+
+	provider, err := gooidc.NewProvider(gooidc.ClientContext(context.Background(), c.HTTPClient), c.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: could not discover %s: %v", c.Issuer, err)
+	}
+
+	scopes := append([]string{gooidc.ScopeOpenID, "email", "profile"}, c.ExtraScopes...)
+
+	key := sha256.Sum256([]byte(c.SessionSecret))
+	return &Provider{
+		Config: c,
+		oauth: &oauth2.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  c.RedirectURL,
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&gooidc.Config{ClientID: c.ClientID}),
+		key:      key[:],
+		origin:   redirect.Scheme + "://" + redirect.Host,
+		secure:   redirect.Scheme == "https",
+	}, nil
+}
+
+// Authenticate makes sure the request comes with a valid session
+func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
+	principal, err := p.Identify(w, r)
+	return principal != nil, err
+}
+
+// Identify returns the user who is logged in, or nil if there is no valid
+// session. Requests that change something have to come from klein's own
+// pages, so that other sites can't make them on a user's behalf.
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+
+	var s session
+	if err := p.open(sessionCookie, cookie.Value, &s); err != nil || time.Now().Unix() >= s.Expires {
+		return nil, nil
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		if origin := r.Header.Get("Origin"); origin != "" && origin != p.origin {
+			return nil, nil
+		}
+	}
+
+	return &auth.Principal{
+		Name:   s.Name,
+		Scopes: append([]auth.Scope{}, p.Config.Scopes...),
+	}, nil
+}
+
+// ServeHTTP handles /_auth/login, /_auth/callback and /_auth/logout
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/_auth/") {
+	case "login":
+		p.login(w, r)
+	case "callback":
+		p.callback(w, r)
+	case "logout":
+		p.clearCookie(w, sessionCookie)
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// login sends the user to the OpenID provider. The state, nonce and PKCE
+// verifier are kept in a signed cookie to check the callback against.
+func (p *Provider) login(w http.ResponseWriter, r *http.Request) {
+	f := flow{
+		State:    random(),
+		Nonce:    random(),
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     localPath(r.FormValue("next")),
+		Expires:  time.Now().Add(flowTTL).Unix(),
+	}
+
+	value, err := p.seal(flowCookie, f)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	p.setCookie(w, flowCookie, value, time.Unix(f.Expires, 0))
+
+	http.Redirect(w, r, p.oauth.AuthCodeURL(f.State, gooidc.Nonce(f.Nonce), oauth2.S256ChallengeOption(f.Verifier)), http.StatusFound)
+}
+
+// callback finishes logging in once the OpenID provider sends the user back
+func (p *Provider) callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(flowCookie)
+	if err != nil {
+		http.Error(w, "login expired, please try again", http.StatusForbidden)
+		return
+	}
+	p.clearCookie(w, flowCookie)
+
+	var f flow
+	if err := p.open(flowCookie, cookie.Value, &f); err != nil || time.Now().Unix() >= f.Expires {
+		http.Error(w, "login expired, please try again", http.StatusForbidden)
+		return
+	}
+	if state := r.FormValue("state"); subtle.ConstantTimeCompare([]byte(state), []byte(f.State)) != 1 {
+		http.Error(w, "invalid login state", http.StatusForbidden)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	ctx := gooidc.ClientContext(r.Context(), p.Config.HTTPClient)
+	token, err := p.oauth.Exchange(ctx, r.FormValue("code"), oauth2.VerifierOption(f.Verifier))
+	if err != nil {
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "login failed: no ID token", http.StatusForbidden)
+		return
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(f.Nonce)) != 1 {
+		http.Error(w, "login failed: invalid ID token", http.StatusForbidden)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "login failed: invalid ID token", http.StatusForbidden)
+		return
+	}
+	name, err := p.allow(idToken.Subject, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	expires := time.Now().Add(p.Config.SessionTTL)
+	value, err := p.seal(sessionCookie, session{Name: name, Expires: expires.Unix()})
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	p.setCookie(w, sessionCookie, value, expires)
+
+	http.Redirect(w, r, f.Next, http.StatusFound)
+}
+
+// allow checks a user's claims against the allowed domains and groups, and
+// returns the name to know them by: their email address if they have one
+func (p *Provider) allow(subject string, claims map[string]interface{}) (string, error) {
+	email, _ := claims["email"].(string)
+
+	if len(p.Config.Domains) > 0 {
+		verified, _ := claims["email_verified"].(bool)
+		if s, ok := claims["email_verified"].(string); ok {
+			verified = s == "true"
+		}
+		if email == "" || !verified {
+			return "", errors.New("a verified email address is required")
+		}
+
+		domain := strings.ToLower(email[strings.LastIndexByte(email, '@')+1:])
+		if !contains(p.Config.Domains, domain) {
+			return "", fmt.Errorf("%s is not allowed", email)
+		}
+	}
+
+	if len(p.Config.Groups) > 0 {
+		var groups []string
+		switch v := claims[p.Config.GroupsClaim].(type) {
+		case string:
+			groups = []string{v}
+		case []interface{}:
+			for _, g := range v {
+				if g, ok := g.(string); ok {
+					groups = append(groups, g)
+				}
+			}
+		}
+
+		member := false
+		for _, g := range groups {
+			if contains(p.Config.Groups, g) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return "", errors.New("you are not in any of the allowed groups")
+		}
+	}
+
+	if email != "" {
+		return email, nil
+	}
+	return subject, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// localPath only lets users be sent back to a page on klein after logging in
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+
+	return next
+}
+
+func random() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,412 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/kamaln7/klein/auth"
+)
+
+const redirectURL = "https://klein.example.com/_auth/callback"
+
+// mockProvider is a minimal OpenID provider
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mutex sync.Mutex
+	codes map[string]grant
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{key: key, codes: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "mock", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+// authorize plays the part of the user logging in at the provider, and
+// returns the code that the provider would redirect back with
+func (m *mockProvider) authorize(t *testing.T, authURL string, claims map[string]interface{}) (code, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, m.URL+"/authorize") {
+		t.Fatalf("expected a redirect to the provider, got %q", authURL)
+	}
+	q := u.Query()
+	if q.Get("redirect_uri") != redirectURL || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	c := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   q.Get("client_id"),
+		"sub":   "1234",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+
+	code = "code-" + q.Get("state")
+	m.mutex.Lock()
+	m.codes[code] = grant{q.Get("code_challenge"), c}
+	m.mutex.Unlock()
+
+	return code, q.Get("state")
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	g, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mutex.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	sig, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: m.key}, new(jose.SignerOptions).WithHeader("kid", "mock"))
+	idToken, _ := josejwt.Signed(sig).Claims(g.claims).Serialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func newProvider(t *testing.T, m *mockProvider, c *Config) *Provider {
+	c.Issuer = m.URL
+	c.ClientID = "klein"
+	c.ClientSecret = "client secret"
+	c.RedirectURL = redirectURL
+	c.SessionSecret = "session secret"
+
+	p, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// request makes a request to the provider's endpoints with cookies
+func request(p *Provider, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func cookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// startLogin visits the login page and returns the flow cookie and where the
+// user is sent
+func startLogin(t *testing.T, p *Provider, next string) (*http.Cookie, string) {
+	w := request(p, "/_auth/login?next="+url.QueryEscape(next))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", w.Code)
+	}
+
+	return cookie(w, flowCookie), w.Header().Get("Location")
+}
+
+// login goes through the whole login flow and returns the session cookie
+func login(t *testing.T, p *Provider, m *mockProvider, claims map[string]interface{}) (*http.Cookie, *httptest.ResponseRecorder) {
+	flow, authURL := startLogin(t, p, "/")
+	code, state := m.authorize(t, authURL, claims)
+	w := request(p, "/_auth/callback?code="+code+"&state="+state, flow)
+
+	return cookie(w, sessionCookie), w
+}
+
+func identify(t *testing.T, p *Provider, method, origin string, cookies ...*http.Cookie) *auth.Principal {
+	r := httptest.NewRequest(method, "/", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	principal, err := p.Identify(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return principal
+}
+
+func TestLogin(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m, &Config{})
+
+	if identify(t, p, "POST", "") != nil {
+		t.Error("expected a request without a session to be rejected")
+	}
+
+	flow, authURL := startLogin(t, p, "/_admin/stats?x=1")
+	if flow == nil || !flow.HttpOnly || !flow.Secure || flow.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected a secure login cookie, got %+v", flow)
+	}
+	if u, _ := url.Parse(authURL); u.Query().Get("scope") != "openid email profile" {
+		t.Errorf("expected only the standard scopes to be requested, got %q", u.Query().Get("scope"))
+	}
+	code, state := m.authorize(t, authURL, map[string]interface{}{"email": "alice@example.com"})
+
+	w := request(p, "/_auth/callback?code="+code+"&state="+state, flow)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/_admin/stats?x=1" {
+		t.Fatalf("expected to be sent back, got %d %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	session := cookie(w, sessionCookie)
+	if session == nil || !session.HttpOnly || !session.Secure {
+		t.Fatalf("expected a secure session cookie, got %+v", session)
+	}
+
+	principal := identify(t, p, "POST", "https://klein.example.com", session)
+	if principal == nil || principal.Name != "alice@example.com" {
+		t.Fatalf("expected to be identified as alice, got %+v", principal)
+	}
+	if !principal.Can(auth.ScopeCreate) || principal.Can(auth.ScopeDelete) {
+		t.Errorf("expected only the create scope, got %v", principal.Scopes)
+	}
+	if identify(t, p, "POST", "https://evil.example.com", session) != nil {
+		t.Error("expected a request from another site to be rejected")
+	}
+	if identify(t, p, "GET", "https://evil.example.com", session) == nil {
+		t.Error("expected a GET request from another site to be identified")
+	}
+
+	// users without an email address are known by their subject
+	session, _ = login(t, p, m, nil)
+	if principal := identify(t, p, "POST", "", session); principal == nil || principal.Name != "1234" {
+		t.Errorf("expected to be identified by the subject, got %+v", principal)
+	}
+
+	w = request(p, "/_auth/logout", session)
+	if c := w.Result().Cookies(); w.Code != http.StatusFound || len(c) != 1 || c[0].Name != sessionCookie || c[0].MaxAge >= 0 {
+		t.Errorf("expected the session cookie to be cleared, got %d %v", w.Code, c)
+	}
+}
+
+func TestCallback(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m, &Config{})
+	claims := map[string]interface{}{"email": "alice@example.com"}
+
+	for name, test := range map[string]func() *httptest.ResponseRecorder{
+		"no login cookie": func() *httptest.ResponseRecorder {
+			_, authURL := startLogin(t, p, "/")
+			code, state := m.authorize(t, authURL, claims)
+			return request(p, "/_auth/callback?code="+code+"&state="+state)
+		},
+		"wrong state": func() *httptest.ResponseRecorder {
+			flow, authURL := startLogin(t, p, "/")
+			code, _ := m.authorize(t, authURL, claims)
+			return request(p, "/_auth/callback?code="+code+"&state=forged", flow)
+		},
+		"tampered login cookie": func() *httptest.ResponseRecorder {
+			flow, authURL := startLogin(t, p, "/")
+			code, state := m.authorize(t, authURL, claims)
+			flow.Value = "x" + flow.Value
+			return request(p, "/_auth/callback?code="+code+"&state="+state, flow)
+		},
+		"another login's code": func() *httptest.ResponseRecorder {
+			first, _ := startLogin(t, p, "/")
+			_, authURL := startLogin(t, p, "/")
+			code, _ := m.authorize(t, authURL, claims)
+			var f flow
+			p.open(flowCookie, first.Value, &f)
+			return request(p, "/_auth/callback?code="+code+"&state="+f.State, first)
+		},
+		"wrong nonce": func() *httptest.ResponseRecorder {
+			flow, authURL := startLogin(t, p, "/")
+			code, state := m.authorize(t, authURL, map[string]interface{}{"nonce": "replayed"})
+			return request(p, "/_auth/callback?code="+code+"&state="+state, flow)
+		},
+		"wrong audience": func() *httptest.ResponseRecorder {
+			flow, authURL := startLogin(t, p, "/")
+			code, state := m.authorize(t, authURL, map[string]interface{}{"aud": "other"})
+			return request(p, "/_auth/callback?code="+code+"&state="+state, flow)
+		},
+		"denied": func() *httptest.ResponseRecorder {
+			flow, authURL := startLogin(t, p, "/")
+			_, state := m.authorize(t, authURL, claims)
+			return request(p, "/_auth/callback?error=access_denied&state="+state, flow)
+		},
+	} {
+		w := test()
+		if w.Code != http.StatusForbidden || cookie(w, sessionCookie) != nil {
+			t.Errorf("%s: expected the login to fail, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m, &Config{
+		Domains: []string{"example.com"},
+		Groups:  []string{"marketing", "engineering"},
+		Scopes:  []auth.Scope{auth.ScopeCreate, auth.ScopeDelete},
+
+		ExtraScopes: []string{"groups"},
+	})
+
+	if _, authURL := startLogin(t, p, "/"); !strings.Contains(authURL, "scope=openid+email+profile+groups") {
+		t.Errorf("expected the groups scope to be requested, got %s", authURL)
+	}
+
+	for name, test := range map[string]struct {
+		claims  map[string]interface{}
+		allowed bool
+	}{
+		"allowed":       {map[string]interface{}{"email": "alice@Example.com", "email_verified": true, "groups": []string{"sales", "marketing"}}, true},
+		"other domain":  {map[string]interface{}{"email": "alice@example.org", "email_verified": true, "groups": []string{"marketing"}}, false},
+		"subdomain":     {map[string]interface{}{"email": "alice@evil.example.com", "email_verified": true, "groups": []string{"marketing"}}, false},
+		"unverified":    {map[string]interface{}{"email": "alice@example.com", "email_verified": false, "groups": []string{"marketing"}}, false},
+		"no email":      {map[string]interface{}{"groups": []string{"marketing"}}, false},
+		"no groups":     {map[string]interface{}{"email": "alice@example.com", "email_verified": true}, false},
+		"other groups":  {map[string]interface{}{"email": "alice@example.com", "email_verified": true, "groups": []string{"sales"}}, false},
+		"string groups": {map[string]interface{}{"email": "alice@example.com", "email_verified": "true", "groups": "engineering"}, true},
+	} {
+		session, w := login(t, p, m, test.claims)
+		if !test.allowed {
+			if session != nil || w.Code != http.StatusForbidden {
+				t.Errorf("%s: expected to be turned away, got %d: %s", name, w.Code, w.Body)
+			}
+			continue
+		}
+
+		principal := identify(t, p, "DELETE", "", session)
+		if principal == nil || !principal.Can(auth.ScopeDelete) {
+			t.Errorf("%s: expected to be let in, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m, &Config{})
+	valid, _ := login(t, p, m, nil)
+
+	tampered := *valid
+	tampered.Value = strings.Replace(valid.Value, ".", "x.", 1)
+	if identify(t, p, "POST", "", &tampered) != nil {
+		t.Error("expected a tampered session to be rejected")
+	}
+
+	// a login cookie isn't a session
+	flow, _ := startLogin(t, p, "/")
+	if identify(t, p, "POST", "", &http.Cookie{Name: sessionCookie, Value: flow.Value}) != nil {
+		t.Error("expected a login cookie to be rejected as a session")
+	}
+
+	// sessions signed with another secret
+	other := newProvider(t, m, &Config{})
+	other.key = []byte("another key")
+	if identify(t, other, "POST", "", valid) != nil {
+		t.Error("expected a session signed with another secret to be rejected")
+	}
+
+	value, _ := p.seal(sessionCookie, session{Name: "alice", Expires: time.Now().Add(-time.Second).Unix()})
+	if identify(t, p, "POST", "", &http.Cookie{Name: sessionCookie, Value: value}) != nil {
+		t.Error("expected an expired session to be rejected")
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for next, expected := range map[string]string{
+		"":                    "/",
+		"/":                   "/",
+		"/_admin/stats":       "/_admin/stats",
+		"https://evil.com":    "/",
+		"//evil.com":          "/",
+		"/\\evil.com":         "/",
+		"javascript:alert(1)": "/",
+	} {
+		if got := localPath(next); got != expected {
+			t.Errorf("localPath(%q) = %q, expected %q", next, got, expected)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	m := newMockProvider(t)
+
+	for name, test := range map[string]struct {
+		c   Config
+		err error
+	}{
+		"no issuer":         {Config{ClientID: "klein", RedirectURL: redirectURL, SessionSecret: "s"}, ErrNoClient},
+		"no session secret": {Config{Issuer: m.URL, ClientID: "klein", RedirectURL: redirectURL}, ErrNoSessionSecret},
+		"wrong callback":    {Config{Issuer: m.URL, ClientID: "klein", RedirectURL: "https://klein.example.com/callback", SessionSecret: "s"}, ErrRedirectURL},
+	} {
+		if _, err := New(&test.c); err != test.err {
+			t.Errorf("%s: expected %v, got %v", name, test.err, err)
+		}
+	}
+
+	if _, err := New(&Config{Issuer: m.URL + "/missing", ClientID: "klein", RedirectURL: redirectURL, SessionSecret: "s"}); err == nil {
+		t.Error("expected an error for an issuer without discovery")
+	}
+}
@@ -0,0 +1,103 @@
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// session is kept in a cookie once a user has logged in
+type session struct {
+	Name    string `json:"n"`
+	Expires int64  `json:"x"`
+}
+
+// flow is kept in a cookie between redirecting to the OpenID provider and
+// the user coming back to the callback
+type flow struct {
+	State    string `json:"s"`
+	Nonce    string `json:"o"`
+	Verifier string `json:"v"`
+	Next     string `json:"n"`
+	Expires  int64  `json:"x"`
+}
+
+const (
+	sessionCookie = "klein_session"
+	flowCookie    = "klein_login"
+
+	// flowTTL is how long a user has to log in with the OpenID provider
+	flowTTL = 10 * time.Minute
+)
+
+var errInvalidCookie = errors.New("oidc: invalid cookie")
+
+// seal encodes v and signs it, along with what it is for so that one kind of
+// cookie can't be passed off as another
+func (p *Provider) seal(purpose string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.sign(purpose, payload)), nil
+}
+
+// open checks a value made by seal and decodes it into v
+func (p *Provider) open(purpose, value string, v interface{}) error {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return errInvalidCookie
+	}
+
+	payload := value[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, p.sign(purpose, payload)) {
+		return errInvalidCookie
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidCookie
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (p *Provider) sign(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(purpose + "." + payload))
+	return mac.Sum(nil)
+}
+
+// setCookie sets a cookie that scripts can't read and other sites can't
+// send along with their requests, except for links to klein
+func (p *Provider) setCookie(w http.ResponseWriter, name, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   p.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *Provider) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   p.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
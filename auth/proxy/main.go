@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kamaln7/klein/auth"
+)
+
+// Provider trusts the identity that a reverse proxy such as oauth2-proxy
+// passes in request headers, as long as the request comes from the proxy
+type Provider struct {
+	Config *Config
+
+	networks []*net.IPNet
+}
+
+// Config contains the configuration for the reverse proxy auth provider
+type Config struct {
+	// Proxies are the addresses or CIDR ranges that requests from the proxy
+	// come from. The headers of requests from anywhere else are ignored.
+	Proxies []string
+	// Secret, if set, has to be passed by the proxy in SecretHeader
+	Secret       string
+	SecretHeader string
+
+	// UserHeader and EmailHeader hold who the proxy authenticated, default
+	// to X-Forwarded-User and X-Forwarded-Email. The email address is used as
+	// the principal's name if there is one.
+	UserHeader, EmailHeader string
+
+	// Scopes are granted to every user, defaults to create
+	Scopes []auth.Scope
+}
+
+// ErrNoProxies is returned by New if no proxy addresses are configured
+var ErrNoProxies = errors.New("proxy: the addresses of the trusted proxies are required")
+
+// ensure that the auth.Identifier interface is implemented
+var _ auth.Identifier = new(Provider)
+
+// New parses the trusted proxy addresses and returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	if len(c.Proxies) == 0 {
+		return nil, ErrNoProxies
+	}
+	if c.SecretHeader == "" {
+		c.SecretHeader = "X-Klein-Proxy-Secret"
+	}
+	if c.UserHeader == "" {
+		c.UserHeader = "X-Forwarded-User"
+	}
+	if c.EmailHeader == "" {
+		c.EmailHeader = "X-Forwarded-Email"
+	}
+	if c.Scopes == nil {
+		c.Scopes = []auth.Scope{auth.ScopeCreate}
+	}
+
+	p := &Provider{
+		Config: c,
+	}
+	for _, proxy := range c.Proxies {
+		network, err := parseNetwork(strings.TrimSpace(proxy))
+		if err != nil {
+			return nil, err
+		}
+		p.networks = append(p.networks, network)
+	}
+
+	return p, nil
+}
+
+// parseNetwork parses a CIDR range, or a single address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: invalid CIDR range %q", s)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("proxy: invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Authenticate makes sure the proxy passed an identity
+func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
+	principal, err := p.Identify(w, r)
+	return principal != nil, err
+}
+
+// Identify returns the user named in the request's headers, or nil if the
+// request doesn't come from a trusted proxy or doesn't name anyone
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	if !p.trusted(r) {
+		return nil, nil
+	}
+
+	name := strings.TrimSpace(r.Header.Get(p.Config.EmailHeader))
+	if name == "" {
+		name = strings.TrimSpace(r.Header.Get(p.Config.UserHeader))
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	return &auth.Principal{
+		Name:   name,
+		Scopes: append([]auth.Scope{}, p.Config.Scopes...),
+	}, nil
+}
+
+// trusted checks that the request was made by a proxy, and that the proxy
+// passed the secret if one is set. Only the address of the connection
+// counts, not X-Forwarded-For, which anyone could set.
+func (p *Provider) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	found := false
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	if p.Config.Secret == "" {
+		return true
+	}
+	// comparing hashes keeps the length of the secret from leaking
+	got, expected := sha256.Sum256([]byte(r.Header.Get(p.Config.SecretHeader))), sha256.Sum256([]byte(p.Config.Secret))
+	return subtle.ConstantTimeCompare(got[:], expected[:]) == 1
+}
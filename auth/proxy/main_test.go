@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kamaln7/klein/auth"
+)
+
+func identify(t *testing.T, p *Provider, remoteAddr string, headers map[string]string) *auth.Principal {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	principal, err := p.Identify(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return principal
+}
+
+func TestIdentify(t *testing.T) {
+	p, err := New(&Config{Proxies: []string{"10.0.0.0/8", " 192.168.1.10", "fd00::/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	both := map[string]string{"X-Forwarded-User": "1234", "X-Forwarded-Email": "alice@example.com"}
+	for _, addr := range []string{"10.1.2.3:4567", "192.168.1.10:80", "[fd00::1]:443"} {
+		principal := identify(t, p, addr, both)
+		if principal == nil || principal.Name != "alice@example.com" {
+			t.Errorf("%s: expected to be identified as alice, got %+v", addr, principal)
+			continue
+		}
+		if !principal.Can(auth.ScopeCreate) || principal.Can(auth.ScopeAdmin) {
+			t.Errorf("%s: expected only the create scope, got %v", addr, principal.Scopes)
+		}
+	}
+
+	if principal := identify(t, p, "10.1.2.3:4567", map[string]string{"X-Forwarded-User": "bob"}); principal == nil || principal.Name != "bob" {
+		t.Errorf("expected to be identified by the user header, got %+v", principal)
+	}
+
+	for name, addr := range map[string]string{
+		"untrusted":        "192.168.1.11:80",
+		"untrusted IPv6":   "[fe80::1]:443",
+		"invalid":          "proxy:80",
+		"forwarded for":    "203.0.113.1:80",
+		"mapped untrusted": "[::ffff:172.16.0.1]:80",
+	} {
+		headers := map[string]string{"X-Forwarded-For": "10.1.2.3", "X-Forwarded-Email": "alice@example.com"}
+		if principal := identify(t, p, addr, headers); principal != nil {
+			t.Errorf("%s: expected the headers to be ignored, got %+v", name, principal)
+		}
+	}
+
+	if identify(t, p, "10.1.2.3", both) == nil {
+		t.Error("expected an address without a port to be trusted")
+	}
+	if principal := identify(t, p, "10.1.2.3:4567", map[string]string{"X-Forwarded-User": "  "}); principal != nil {
+		t.Errorf("expected a request without a user to be rejected, got %+v", principal)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	p, err := New(&Config{
+		Proxies:    []string{"127.0.0.1"},
+		Secret:     "proxy secret",
+		UserHeader: "Remote-User",
+		Scopes:     []auth.Scope{auth.ScopeCreate, auth.ScopeDelete},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for secret, ok := range map[string]bool{"proxy secret": true, "": false, "proxy secre": false, "proxy secrets": false} {
+		principal := identify(t, p, "127.0.0.1:80", map[string]string{"Remote-User": "alice", "X-Klein-Proxy-Secret": secret})
+		if ok && (principal == nil || !principal.Can(auth.ScopeDelete)) {
+			t.Errorf("%q: expected to be identified, got %+v", secret, principal)
+		}
+		if !ok && principal != nil {
+			t.Errorf("%q: expected to be rejected, got %+v", secret, principal)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(&Config{}); err != ErrNoProxies {
+		t.Errorf("expected ErrNoProxies, got %v", err)
+	}
+	for _, proxy := range []string{"10.0.0.0/33", "10.0.0", "proxy.example.com"} {
+		if _, err := New(&Config{Proxies: []string{proxy}}); err == nil {
+			t.Errorf("%s: expected an error", proxy)
+		}
+	}
+}
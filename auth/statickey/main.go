@@ -14,13 +14,20 @@ type Provider struct {
 // Config contains the config
 type Config struct {
 	Key string
+
+	// Scopes are granted to requests with the key, defaults to create
+	Scopes []auth.Scope
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ auth.Provider = new(Provider)
+// ensure that the auth.Identifier interface is implemented
+var _ auth.Identifier = new(Provider)
 
 // New initializes the alias generator and returns a new instance
 func New(c *Config) *Provider {
+	if c.Scopes == nil {
+		c.Scopes = []auth.Scope{auth.ScopeCreate}
+	}
+
 	return &Provider{
 		Config: c,
 	}
@@ -36,3 +43,15 @@ func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, e
 
 	return true, nil
 }
+
+// Identify returns an anonymous principal with the configured scopes if the
+// right key is passed
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	if ok, err := p.Authenticate(w, r); !ok || err != nil {
+		return nil, err
+	}
+
+	return &auth.Principal{
+		Scopes: append([]auth.Scope{}, p.Config.Scopes...),
+	}, nil
+}
@@ -7,17 +7,38 @@ import (
 )
 
 // Provider implements an alias generator
-type Provider struct{}
+type Provider struct {
+	Config *Config
+}
+
+// Config contains the config
+type Config struct {
+	// Scopes are granted to everyone, defaults to create
+	Scopes []auth.Scope
+}
 
-// ensure that the storage.Provider interface is implemented
-var _ auth.Provider = new(Provider)
+// ensure that the auth.Identifier interface is implemented
+var _ auth.Identifier = new(Provider)
 
 // New initializes the alias generator and returns a new instance
-func New() *Provider {
-	return &Provider{}
+func New(c *Config) *Provider {
+	if c.Scopes == nil {
+		c.Scopes = []auth.Scope{auth.ScopeCreate}
+	}
+
+	return &Provider{
+		Config: c,
+	}
 }
 
 // Authenticate lets everyone go through
 func (p *Provider) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
 	return true, nil
 }
+
+// Identify returns an anonymous principal with the configured scopes
+func (p *Provider) Identify(w http.ResponseWriter, r *http.Request) (*auth.Principal, error) {
+	return &auth.Principal{
+		Scopes: append([]auth.Scope{}, p.Config.Scopes...),
+	}, nil
+}
@@ -0,0 +1,254 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kamaln7/klein/client"
+)
+
+// Config describes the load to put on a klein server
+type Config struct {
+	Client *client.Client
+
+	// Concurrency is the number of requests in flight at once, defaults to 16
+	Concurrency int
+	// Requests is the number of requests to make. If it is 0, requests are
+	// made until Duration has passed.
+	Requests int
+	// Duration caps how long to make requests for. 0 means no limit.
+	Duration time.Duration
+	// Links is the number of links to create before measuring, which the
+	// redirects are then spread over. Defaults to 100.
+	Links int
+	// Creates is the fraction of requests, between 0 and 1, that create a
+	// new link instead of following a redirect
+	Creates float64
+	// URL is the long URL of every created link, defaults to http://example.com/
+	URL string
+}
+
+// Result holds the measurements of a run
+type Result struct {
+	Elapsed   time.Duration `json:"elapsed"`
+	Redirects *Summary      `json:"redirects"`
+	Creates   *Summary      `json:"creates"`
+	// Errors holds up to 10 distinct errors, with how often they occurred
+	Errors map[string]int `json:"errors,omitempty"`
+}
+
+// Summary describes the response times of one kind of request
+type Summary struct {
+	Requests int           `json:"requests"`
+	Errors   int           `json:"errors"`
+	Mean     time.Duration `json:"mean"`
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+}
+
+// Requests returns the total number of requests made
+func (r *Result) Requests() int {
+	return r.Redirects.Requests + r.Creates.Requests
+}
+
+// Throughput returns the number of requests made per second
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Requests()) / r.Elapsed.Seconds()
+}
+
+// ErrNoLimit is returned by Run when neither Requests nor Duration is set
+var ErrNoLimit = errors.New("bench: either a number of requests or a duration is required")
+
+const maxErrors = 10
+
+// sample is a single timed request
+type sample struct {
+	took time.Duration
+	err  error
+}
+
+// Run creates the configured links and then makes requests from
+// Config.Concurrency goroutines until either Config.Requests have been made,
+// Config.Duration has passed or ctx is done. Failed requests are counted in
+// the result rather than stopping the run. Every link it creates is left in
+// place, so run it against a server whose data can be thrown away.
+func Run(ctx context.Context, c *Config) (*Result, error) {
+	if c.Requests <= 0 && c.Duration <= 0 {
+		return nil, ErrNoLimit
+	}
+	if c.Creates < 0 || c.Creates > 1 {
+		return nil, fmt.Errorf("bench: the fraction of creates has to be between 0 and 1, got %v", c.Creates)
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 16
+	}
+	if c.Links <= 0 {
+		c.Links = 100
+	}
+	if c.URL == "" {
+		c.URL = "http://example.com/"
+	}
+
+	aliases, err := seed(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+
+	var (
+		next      int64 = -1
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		redirects []sample
+		creates   []sample
+	)
+
+	start := time.Now()
+	for w := 0; w < c.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// every goroutine keeps its own samples, so that they don't contend on a lock
+			var r, cr []sample
+			for ctx.Err() == nil {
+				i := int(atomic.AddInt64(&next, 1))
+				if c.Requests > 0 && i >= c.Requests {
+					break
+				}
+
+				var (
+					began  = time.Now()
+					create = isCreate(i, c.Creates)
+					err    error
+				)
+				if create {
+					_, err = c.Client.Create(ctx, c.URL, "")
+				} else {
+					_, err = c.Client.Resolve(ctx, aliases[i%len(aliases)])
+				}
+				if err != nil && ctx.Err() != nil {
+					// cut off at the end of the run
+					break
+				}
+
+				if create {
+					cr = append(cr, sample{time.Since(began), err})
+				} else {
+					r = append(r, sample{time.Since(began), err})
+				}
+			}
+
+			mutex.Lock()
+			redirects = append(redirects, r...)
+			creates = append(creates, cr...)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	res := &Result{
+		Elapsed:   time.Since(start),
+		Redirects: summarize(redirects),
+		Creates:   summarize(creates),
+		Errors:    make(map[string]int),
+	}
+	for _, s := range append(redirects, creates...) {
+		if s.err == nil {
+			continue
+		}
+		if _, ok := res.Errors[s.err.Error()]; ok || len(res.Errors) < maxErrors {
+			res.Errors[s.err.Error()]++
+		}
+	}
+
+	return res, nil
+}
+
+// seed creates the links that redirects are made to
+func seed(ctx context.Context, c *Config) ([]string, error) {
+	aliases := make([]string, c.Links)
+
+	var (
+		next  int64 = -1
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	for w := 0; w < c.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(aliases) {
+					return
+				}
+
+				link, err := c.Client.Create(ctx, c.URL, "")
+				if err != nil {
+					once.Do(func() { first = fmt.Errorf("bench: couldn't create links to redirect to: %w", err) })
+					atomic.StoreInt64(&next, int64(len(aliases)))
+					return
+				}
+				aliases[i] = link.Alias
+			}
+		}()
+	}
+	wg.Wait()
+
+	return aliases, first
+}
+
+// isCreate spreads creations evenly over the requests, so that the
+// configured fraction holds for any number of requests
+func isCreate(i int, creates float64) bool {
+	return int(float64(i+1)*creates) > int(float64(i)*creates)
+}
+
+func summarize(samples []sample) *Summary {
+	s := &Summary{Requests: len(samples)}
+	if len(samples) == 0 {
+		return s
+	}
+
+	took := make([]time.Duration, len(samples))
+	var total time.Duration
+	for i, sample := range samples {
+		if sample.err != nil {
+			s.Errors++
+		}
+		took[i] = sample.took
+		total += sample.took
+	}
+	sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+
+	percentile := func(p float64) time.Duration {
+		return took[int(p*float64(len(took)-1))]
+	}
+
+	s.Mean = total / time.Duration(len(took))
+	s.P50 = percentile(0.5)
+	s.P90 = percentile(0.9)
+	s.P99 = percentile(0.99)
+	s.Max = took[len(took)-1]
+
+	return s
+}
@@ -0,0 +1,132 @@
+package bench
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/alias/alphanumeric"
+	"github.com/kamaln7/klein/auth"
+	"github.com/kamaln7/klein/auth/unauthenticated"
+	"github.com/kamaln7/klein/client"
+	"github.com/kamaln7/klein/server"
+	"github.com/kamaln7/klein/storage/memory"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	aliasProvider, err := alphanumeric.New(&alphanumeric.Config{
+		Length: 10,
+		Alpha:  true,
+		Num:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config.Handler = server.New(&server.Config{
+		Alias:        aliasProvider,
+		Auth:         unauthenticated.New(&unauthenticated.Config{Scopes: []auth.Scope{auth.ScopeCreate, auth.ScopeStats}}),
+		Storage:      memory.New(&memory.Config{}),
+		Log:          log.New(ioutil.Discard, "", 0),
+		NotFoundHTML: []byte("404 not found"),
+		PublicURL:    "http://" + ts.Listener.Addr().String(),
+	})
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestRun(t *testing.T) {
+	ts := newServer(t)
+
+	res, err := Run(context.Background(), &Config{
+		Client:      client.New(&client.Config{URL: ts.URL}),
+		Concurrency: 4,
+		Requests:    200,
+		Links:       10,
+		Creates:     0.25,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Requests() != 200 || res.Creates.Requests != 50 || res.Redirects.Requests != 150 {
+		t.Errorf("expected 50 creates and 150 redirects, got %d and %d", res.Creates.Requests, res.Redirects.Requests)
+	}
+	if res.Redirects.Errors != 0 || res.Creates.Errors != 0 || len(res.Errors) != 0 {
+		t.Errorf("expected no errors, got %v", res.Errors)
+	}
+	if s := res.Redirects; s.P50 <= 0 || s.P50 > s.P90 || s.P90 > s.P99 || s.P99 > s.Max {
+		t.Errorf("expected ordered percentiles, got %+v", s)
+	}
+	if res.Throughput() <= 0 {
+		t.Errorf("expected a throughput, got %v", res.Throughput())
+	}
+
+	stats, err := client.New(&client.Config{URL: ts.URL}).Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 60 || stats.Redirects != 150 {
+		t.Errorf("expected the server to see 60 creates and 150 redirects, got %d and %d", stats.Created, stats.Redirects)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	ts := newServer(t)
+
+	start := time.Now()
+	res, err := Run(context.Background(), &Config{
+		Client:   client.New(&client.Config{URL: ts.URL}),
+		Duration: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expected the run to stop after its duration, took %s", took)
+	}
+	if res.Requests() == 0 || res.Creates.Requests != 0 {
+		t.Errorf("expected only redirects, got %d creates out of %d requests", res.Creates.Requests, res.Requests())
+	}
+	if len(res.Errors) != 0 {
+		t.Errorf("expected no errors, got %v", res.Errors)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := newServer(t)
+
+	if _, err := Run(context.Background(), &Config{Client: client.New(&client.Config{URL: ts.URL})}); err != ErrNoLimit {
+		t.Errorf("expected ErrNoLimit, got %v", err)
+	}
+	if _, err := Run(context.Background(), &Config{Client: client.New(&client.Config{URL: ts.URL}), Requests: 1, Creates: 2}); err == nil {
+		t.Error("expected an error for an invalid fraction of creates")
+	}
+
+	// nothing is listening anymore
+	ts.Close()
+	if _, err := Run(context.Background(), &Config{Client: client.New(&client.Config{URL: ts.URL}), Requests: 1}); err == nil {
+		t.Error("expected an error when links can't be created")
+	}
+}
+
+func TestIsCreate(t *testing.T) {
+	for _, creates := range []float64{0, 0.1, 1.0 / 3, 0.5, 1} {
+		n := 0
+		for i := 0; i < 300; i++ {
+			if isCreate(i, creates) {
+				n++
+			}
+		}
+		if expected := int(300 * creates); n != expected {
+			t.Errorf("expected %d creates for %v, got %d", expected, creates, n)
+		}
+	}
+}
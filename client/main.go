@@ -0,0 +1,378 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/transfer"
+)
+
+// Client talks to a remote klein server over HTTP
+type Client struct {
+	Config *Config
+	http   *http.Client
+}
+
+// Config contains the configuration for the client
+type Config struct {
+	// URL is the base URL of the klein server, eg https://example.com/
+	URL string
+	// Auth adds credentials to requests. Leave nil for servers without auth.
+	Auth Auth
+	// HTTPClient is used to make requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Retries is how many times a request is retried after a 5xx response
+	// or a network error. Links are only created once, unless the server
+	// couldn't be reached at all.
+	Retries int
+	// Backoff is how long to wait before the first retry. It doubles after
+	// every attempt. Defaults to 100ms.
+	Backoff time.Duration
+}
+
+// An Auth adds credentials to a request
+type Auth interface {
+	Apply(r *http.Request)
+}
+
+// KeyAuth authenticates using the server's static key auth driver
+type KeyAuth struct {
+	Key string
+}
+
+// Apply passes the key as a request parameter
+func (a *KeyAuth) Apply(r *http.Request) {
+	q := r.URL.Query()
+	q.Set("key", a.Key)
+	r.URL.RawQuery = q.Encode()
+}
+
+// BearerAuth authenticates using an API key from the server's keys auth driver
+type BearerAuth struct {
+	Token string
+}
+
+// Apply sets the request's Authorization header
+func (a *BearerAuth) Apply(r *http.Request) {
+	r.Header.Set("Authorization", "Bearer "+a.Token)
+}
+
+// BasicAuth authenticates using the server's HTTP basic auth driver
+type BasicAuth struct {
+	Username, Password string
+}
+
+// Apply sets the request's basic auth header
+func (a *BasicAuth) Apply(r *http.Request) {
+	r.SetBasicAuth(a.Username, a.Password)
+}
+
+// Link is a short URL
+type Link struct {
+	Alias string `json:"alias"`
+	URL   string `json:"url"`
+	// ShortURL is the public URL of the alias, only set by Create
+	ShortURL string `json:"short_url,omitempty"`
+}
+
+// Stats contains a server's usage counters since it started
+type Stats struct {
+	// Links is the number of stored links, or nil if the server's storage
+	// driver cannot count them
+	Links     *int      `json:"links,omitempty"`
+	Redirects uint64    `json:"redirects"`
+	NotFound  uint64    `json:"not_found"`
+	Created   uint64    `json:"created"`
+	Deleted   uint64    `json:"deleted"`
+	Since     time.Time `json:"since"`
+	// Storage holds the server's storage driver counters, if it keeps any
+	Storage map[string]uint64 `json:"storage,omitempty"`
+}
+
+// Errors mirror the storage errors so that they can be compared to either
+var (
+	ErrNotFound      = storage.ErrNotFound
+	ErrAlreadyExists = storage.ErrAlreadyExists
+)
+
+// Error is returned when the server responds with an unexpected status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("klein: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Unauthenticated reports whether the server rejected the credentials
+func (e *Error) Unauthenticated() bool {
+	return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusUnauthorized
+}
+
+// New returns a new Client instance
+func New(c *Config) *Client {
+	c.URL = strings.TrimRight(c.URL, "/") + "/"
+	if c.Backoff == 0 {
+		c.Backoff = 100 * time.Millisecond
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	// never follow redirects so that Resolve can read the target instead of fetching it
+	noRedirects := *hc
+	noRedirects.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &Client{
+		Config: c,
+		http:   &noRedirects,
+	}
+}
+
+// Create shortens url and returns the new link. If alias is empty, the
+// server generates one.
+func (c *Client) Create(ctx context.Context, url, alias string) (*Link, error) {
+	form := neturl.Values{}
+	form.Set("url", url)
+	if alias != "" {
+		form.Set("alias", alias)
+	}
+
+	res, body, err := c.do(ctx, "POST", "", []byte(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		shortURL := string(body)
+		if alias == "" {
+			alias = shortURL[strings.LastIndex(shortURL, "/")+1:]
+		}
+
+		return &Link{
+			Alias:    alias,
+			URL:      url,
+			ShortURL: shortURL,
+		}, nil
+	case http.StatusBadRequest:
+		if string(body) == "code already exists" {
+			return nil, ErrAlreadyExists
+		}
+	}
+
+	return nil, responseError(res, body)
+}
+
+// Resolve looks up the link an alias redirects to
+func (c *Client) Resolve(ctx context.Context, alias string) (*Link, error) {
+	res, body, err := c.do(ctx, "GET", neturl.PathEscape(alias), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusFound, http.StatusMovedPermanently:
+		return &Link{
+			Alias: alias,
+			URL:   res.Header.Get("Location"),
+		}, nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+
+	return nil, responseError(res, body)
+}
+
+// Delete removes a short URL
+func (c *Client) Delete(ctx context.Context, alias string) error {
+	res, body, err := c.do(ctx, "DELETE", neturl.PathEscape(alias), nil)
+	if err != nil {
+		return err
+	}
+
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+
+	return responseError(res, body)
+}
+
+// Invalidate drops an alias from the storage driver's cache on the instance
+// that handles the request. It needs the admin scope.
+func (c *Client) Invalidate(ctx context.Context, alias string) error {
+	res, body, err := c.do(ctx, "POST", "_admin/invalidate?alias="+neturl.QueryEscape(alias), nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusNoContent {
+		return responseError(res, body)
+	}
+
+	return nil
+}
+
+// Stats returns the server's usage counters
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	res, body, err := c.do(ctx, "GET", "_admin/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, body)
+	}
+
+	stats := &Stats{}
+	if err := json.Unmarshal(body, stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// List calls fn for every link on the server, streaming them as they
+// arrive. Listing uses the export endpoint, so it needs the admin scope, and
+// is not retried once the server starts responding.
+func (c *Client) List(ctx context.Context, fn func(l *Link) error) error {
+	res, err := c.send(ctx, "GET", "_admin/export?format=jsonl", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return responseError(res, body)
+	}
+
+	r, err := transfer.NewReader("jsonl", res.Body)
+	if err != nil {
+		return err
+	}
+	for {
+		l, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(&Link{Alias: l.Alias, URL: l.URL}); err != nil {
+			return err
+		}
+	}
+}
+
+// Backup streams a copy of the server's storage to w and returns the
+// number of bytes written. A backup that is cut short by the server or the
+// network returns an error, so w should be discarded.
+func (c *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	res, err := c.send(ctx, "GET", "_admin/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return 0, responseError(res, body)
+	}
+
+	return io.Copy(w, res.Body)
+}
+
+// do sends a request and reads the whole response body
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, []byte, error) {
+	res, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res, bytes.TrimSpace(resBody), nil
+}
+
+// idempotent lists the methods that can safely be sent again. A POST that
+// failed may still have created a link, so it is only retried if it never
+// reached the server.
+var idempotent = map[string]bool{"GET": true, "DELETE": true}
+
+// send sends a request, retrying with exponential backoff on 5xx responses
+// and network errors. The caller must close the response body.
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	backoff := c.Config.Backoff
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, c.Config.URL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if c.Config.Auth != nil {
+			c.Config.Auth.Apply(req)
+		}
+
+		res, err := c.http.Do(req)
+		if err == nil && res.StatusCode < 500 {
+			return res, nil
+		}
+		if attempt >= c.Config.Retries || ctx.Err() != nil || !(idempotent[method] || notSent(err)) {
+			return res, err
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// notSent reports whether err means that a request never left the client
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func responseError(res *http.Response, body []byte) error {
+	msg := string(body)
+	if msg == "" {
+		msg = http.StatusText(res.StatusCode)
+	}
+
+	return &Error{
+		StatusCode: res.StatusCode,
+		Message:    msg,
+	}
+}
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/alias/alphanumeric"
+	"github.com/kamaln7/klein/auth"
+	"github.com/kamaln7/klein/auth/apikeys"
+	"github.com/kamaln7/klein/auth/httpbasic"
+	"github.com/kamaln7/klein/auth/statickey"
+	"github.com/kamaln7/klein/server"
+	"github.com/kamaln7/klein/storage/memory"
+)
+
+func newServer(t *testing.T, a auth.Provider) *httptest.Server {
+	aliasProvider, err := alphanumeric.New(&alphanumeric.Config{
+		Length: 5,
+		Alpha:  true,
+		Num:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config.Handler = server.New(&server.Config{
+		Alias:        aliasProvider,
+		Auth:         a,
+		Storage:      memory.New(&memory.Config{}),
+		Log:          log.New(ioutil.Discard, "", 0),
+		NotFoundHTML: []byte("404 not found"),
+		PublicURL:    "http://" + ts.Listener.Addr().String(),
+	})
+	ts.Start()
+
+	return ts
+}
+
+func TestClient(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "keys.json")
+	_, token, err := apikeys.Create(keysPath, "test", auth.Scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikeys.New(&apikeys.Config{Path: keysPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic, err := httpbasic.New(&httpbasic.Config{Username: "klein", Password: "secret", Scopes: auth.Scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		server auth.Provider
+		client Auth
+	}{
+		"key": {
+			server: statickey.New(&statickey.Config{Key: "secret", Scopes: auth.Scopes}),
+			client: &KeyAuth{Key: "secret"},
+		},
+		"basic": {
+			server: basic,
+			client: &BasicAuth{Username: "klein", Password: "secret"},
+		},
+		"bearer": {
+			server: keys,
+			client: &BearerAuth{Token: token},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := newServer(t, tc.server)
+			defer ts.Close()
+
+			ctx := context.Background()
+			c := New(&Config{
+				URL:  ts.URL,
+				Auth: tc.client,
+			})
+
+			link, err := c.Create(ctx, "http://example.com", "example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.ShortURL != ts.URL+"/example" {
+				t.Errorf("got unexpected short url %q", link.ShortURL)
+			}
+
+			generated, err := c.Create(ctx, "http://example.com/generated", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(generated.Alias) != 5 {
+				t.Errorf("expected a generated 5 character alias, got %q", generated.Alias)
+			}
+
+			if _, err := c.Create(ctx, "http://example.com", "example"); err != ErrAlreadyExists {
+				t.Errorf("expected ErrAlreadyExists, got %v", err)
+			}
+
+			resolved, err := c.Resolve(ctx, "example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved.URL != "http://example.com" {
+				t.Errorf("resolved to the wrong url %q", resolved.URL)
+			}
+
+			links := make(map[string]string)
+			err = c.List(ctx, func(l *Link) error {
+				links[l.Alias] = l.URL
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(links) != 2 || links[generated.Alias] != generated.URL {
+				t.Errorf("listed the wrong links: %v", links)
+			}
+
+			if err := c.Delete(ctx, "example"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Delete(ctx, "example"); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+			}
+			if _, err := c.Resolve(ctx, "example"); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound resolving a deleted alias, got %v", err)
+			}
+
+			stats, err := c.Stats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Links == nil || *stats.Links != 1 || stats.Created != 2 || stats.Deleted != 1 || stats.Redirects != 1 || stats.NotFound != 1 {
+				t.Errorf("got unexpected stats %+v", stats)
+			}
+
+			// the memory driver can't be backed up
+			_, err = c.Backup(ctx, ioutil.Discard)
+			if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusNotImplemented {
+				t.Errorf("expected backups to be unsupported, got %v", err)
+			}
+
+			unauthed := New(&Config{URL: ts.URL})
+			_, err = unauthed.Create(ctx, "http://example.com", "")
+			if e, ok := err.(*Error); !ok || !e.Unauthenticated() {
+				t.Errorf("expected an unauthenticated error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, "http://example.com", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	c := New(&Config{
+		URL:     ts.URL,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+	link, err := c.Resolve(context.Background(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.URL != "http://example.com" || attempts != 3 {
+		t.Errorf("expected to resolve after 3 attempts, got %q after %d", link.URL, attempts)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	c.Config.Retries = 1
+	_, err = c.Resolve(context.Background(), "example")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 error after running out of retries, got %v", err)
+	}
+
+	// links are only created once
+	atomic.StoreInt32(&attempts, 0)
+	c.Config.Retries = 2
+	_, err = c.Create(context.Background(), "http://example.com", "example")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable || attempts != 1 {
+		t.Errorf("expected creating a link not to be retried, got %v after %d attempts", err, attempts)
+	}
+
+	// unless the server couldn't be reached
+	ts.Close()
+	atomic.StoreInt32(&attempts, 0)
+	start := time.Now()
+	c.Config.Backoff = 20 * time.Millisecond
+	if _, err := c.Create(context.Background(), "http://example.com", "example"); err == nil {
+		t.Error("expected an error creating a link on a server that is down")
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected creating a link to be retried when the server is down, took %v", elapsed)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	c := New(&Config{
+		URL:     ts.URL,
+		Retries: 100,
+		Backoff: time.Second,
+	})
+	start := time.Now()
+	if _, err := c.Resolve(ctx, "example"); err != context.DeadlineExceeded {
+		t.Errorf("expected the context deadline to cut retries short, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("retries did not stop when the context expired")
+	}
+}
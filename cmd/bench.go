@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/kamaln7/klein/bench"
+	"github.com/kamaln7/klein/client"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	benchCmd.Flags().Int("concurrency", 16, "number of requests to make at once")
+	benchCmd.Flags().Int("requests", 0, "number of requests to make, 0 to keep going until --duration has passed")
+	benchCmd.Flags().Duration("duration", 0, "how long to make requests for, 0 for no limit (default 10s if --requests isn't set either)")
+	benchCmd.Flags().Int("links", 100, "number of links to create up front and redirect to")
+	benchCmd.Flags().Float64("creates", 0, "fraction of requests, between 0 and 1, that create a link instead of following a redirect")
+	benchCmd.Flags().Duration("timeout", 10*time.Second, "how long to wait for a response before counting the request as failed, 0 for no limit")
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "measure how fast a remote klein server redirects and creates links",
+	Long: `measure how fast a remote klein server redirects and creates links.
+
+The links that are redirected to are created first, and every link that is
+created is left on the server, so point this at an instance whose data can be
+thrown away. Requests are not retried, regardless of --client.retries. Press
+ctrl-c to stop early and still get the results.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		requests, _ := cmd.Flags().GetInt("requests")
+		duration, _ := cmd.Flags().GetDuration("duration")
+		links, _ := cmd.Flags().GetInt("links")
+		creates, _ := cmd.Flags().GetFloat64("creates")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		if requests == 0 && duration == 0 {
+			duration = 10 * time.Second
+		}
+
+		// retries would hide errors and skew the response times
+		c := clientConfig()
+		c.Retries = 0
+		c.HTTPClient = &http.Client{
+			// a server that stops responding would otherwise stall the run
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: concurrency,
+			},
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		res, err := bench.Run(ctx, &bench.Config{
+			Client:      client.New(c),
+			Concurrency: concurrency,
+			Requests:    requests,
+			Duration:    duration,
+			Links:       links,
+			Creates:     creates,
+		})
+		if err != nil {
+			clientFatal(err)
+		}
+
+		var plain strings.Builder
+		fmt.Fprintf(&plain, "requests\t%d in %s, %.1f/s\n", res.Requests(), res.Elapsed.Round(time.Millisecond), res.Throughput())
+		for _, s := range []struct {
+			name    string
+			summary *bench.Summary
+		}{{"redirects", res.Redirects}, {"creates", res.Creates}} {
+			if s.summary.Requests == 0 {
+				continue
+			}
+			fmt.Fprintf(&plain, "%s\t%d, %d failed, mean %s, p50 %s, p90 %s, p99 %s, max %s\n",
+				s.name, s.summary.Requests, s.summary.Errors, s.summary.Mean, s.summary.P50, s.summary.P90, s.summary.P99, s.summary.Max)
+		}
+		for msg, n := range res.Errors {
+			fmt.Fprintf(&plain, "error\t%dx %s\n", n, msg)
+		}
+
+		clientOutput(strings.TrimSuffix(plain.String(), "\n"), res)
+	},
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/kamaln7/klein/storage/bolt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	boltCompactCmd.Flags().String("out", "", "write the compacted database here instead of replacing the original")
+
+	boltCmd.AddCommand(boltCompactCmd)
+	rootCmd.AddCommand(boltCmd)
+}
+
+var boltCmd = &cobra.Command{
+	Use:   "bolt",
+	Short: "manage the boltdb storage driver's database file",
+}
+
+var boltCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "shrink a bolt database file by rewriting it",
+	Long: `shrink a bolt database file by rewriting it.
+
+bolt never gives the space of deleted links back to the filesystem. This
+copies every bucket of the file set by --storage.boltdb.path into a new file
+and replaces the original with it, unless --out is set. Stop klein first, the
+file can't be compacted while it is open. To take a backup of a running
+instance instead, use klein backup.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stdout, "[klein] ", log.Ldate|log.Ltime)
+		path := viper.GetString("storage.boltdb.path")
+		out, _ := cmd.Flags().GetString("out")
+		replace := out == ""
+		if replace {
+			out = path + ".compact"
+		}
+
+		before, err := os.Stat(path)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if err := bolt.Compact(out, path, viper.GetDuration("storage.boltdb.timeout")); err != nil {
+			logger.Fatalf("could not compact %s: %s\n", path, err.Error())
+		}
+		after, err := os.Stat(out)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		if replace {
+			if err := os.Rename(out, path); err != nil {
+				logger.Fatal(err)
+			}
+			out = path
+		}
+
+		logger.Printf("compacted %s from %d to %d bytes into %s\n", path, before.Size(), after.Size(), out)
+	},
+}
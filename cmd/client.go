@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kamaln7/klein/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// clientFlags are shared by every command that talks to a remote klein server
+var clientFlags = pflag.NewFlagSet("client", pflag.ExitOnError)
+
+func init() {
+	clientFlags.String("client.url", "http://127.0.0.1:5556/", "url of the klein server")
+	clientFlags.String("client.auth", "none", "how to authenticate with the server (basic, bearer, key, none)")
+	clientFlags.String("client.key", "", "API key for key and bearer auth")
+	clientFlags.String("client.username", "", "username for HTTP basic auth")
+	clientFlags.String("client.password", "", "password for HTTP basic auth")
+	clientFlags.String("client.output", "plain", "output format (plain, json)")
+	clientFlags.Int("client.retries", 2, "how many times to retry requests that fail with a server error")
+	viper.BindPFlags(clientFlags)
+
+	shortenCmd.Flags().String("alias", "", "custom alias to use instead of a generated one")
+
+	for _, c := range []*cobra.Command{shortenCmd, resolveCmd, deleteCmd, listCmd, statsCmd, backupCmd, benchCmd} {
+		c.Flags().AddFlagSet(clientFlags)
+		rootCmd.AddCommand(c)
+	}
+}
+
+var shortenCmd = &cobra.Command{
+	Use:   "shorten <url>",
+	Short: "shorten a URL on a remote klein server",
+	Long:  "shorten a URL on a remote klein server",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		alias, _ := cmd.Flags().GetString("alias")
+
+		link, err := newClient().Create(context.Background(), args[0], alias)
+		if err != nil {
+			clientFatal(err)
+		}
+
+		clientOutput(link.ShortURL, link)
+	},
+}
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve <alias>",
+	Short: "look up the URL an alias redirects to on a remote klein server",
+	Long:  "look up the URL an alias redirects to on a remote klein server",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		link, err := newClient().Resolve(context.Background(), args[0])
+		if err != nil {
+			clientFatal(err)
+		}
+
+		clientOutput(link.URL, link)
+	},
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete <alias>",
+	Short: "delete a short URL from a remote klein server",
+	Long:  "delete a short URL from a remote klein server",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := newClient().Delete(context.Background(), args[0]); err != nil {
+			clientFatal(err)
+		}
+
+		clientOutput(fmt.Sprintf("deleted %s", args[0]), map[string]interface{}{
+			"alias":   args[0],
+			"deleted": true,
+		})
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list every short URL on a remote klein server",
+	Long:  "list every short URL on a remote klein server, using a key with the admin scope",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := newClient().List(context.Background(), func(l *client.Link) error {
+			clientOutput(fmt.Sprintf("%s\t%s", l.Alias, l.URL), l)
+			return nil
+		})
+		if err != nil {
+			clientFatal(err)
+		}
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show usage stats of a remote klein server",
+	Long:  "show usage stats of a remote klein server",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		stats, err := newClient().Stats(context.Background())
+		if err != nil {
+			clientFatal(err)
+		}
+
+		links := "unknown"
+		if stats.Links != nil {
+			links = fmt.Sprint(*stats.Links)
+		}
+		clientOutput(fmt.Sprintf("links\t%s\nredirects\t%d\nnot found\t%d\ncreated\t%d\ndeleted\t%d\nsince\t%s",
+			links, stats.Redirects, stats.NotFound, stats.Created, stats.Deleted, stats.Since.Format(time.RFC3339)), stats)
+	},
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup <file>",
+	Short: "download a backup of a remote klein server's storage",
+	Long: `download a backup of a remote klein server's storage.
+
+The backup is written in the storage driver's own format, eg a bolt database
+file for the boltdb driver, while the server keeps running. Use - to write it
+to stdout.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if args[0] == "-" {
+			if _, err := newClient().Backup(context.Background(), os.Stdout); err != nil {
+				clientFatal(err)
+			}
+			return
+		}
+
+		// download next to the destination, so that it is only replaced by a complete backup
+		f, err := ioutil.TempFile(filepath.Dir(args[0]), filepath.Base(args[0])+".tmp-")
+		if err != nil {
+			clientFatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		n, err := newClient().Backup(context.Background(), f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), args[0])
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			clientFatal(err)
+		}
+
+		clientOutput(fmt.Sprintf("wrote %d bytes to %s", n, args[0]), map[string]interface{}{
+			"path":  args[0],
+			"bytes": n,
+		})
+	},
+}
+
+func newClient() *client.Client {
+	return client.New(clientConfig())
+}
+
+// clientConfig returns the client configuration set by the client.* flags
+func clientConfig() *client.Config {
+	var auth client.Auth
+	switch viper.GetString("client.auth") {
+	case "none":
+	case "key":
+		auth = &client.KeyAuth{
+			Key: viper.GetString("client.key"),
+		}
+	case "bearer":
+		auth = &client.BearerAuth{
+			Token: viper.GetString("client.key"),
+		}
+	case "basic":
+		auth = &client.BasicAuth{
+			Username: viper.GetString("client.username"),
+			Password: viper.GetString("client.password"),
+		}
+	default:
+		clientFatal(fmt.Errorf("invalid client auth %q", viper.GetString("client.auth")))
+	}
+
+	return &client.Config{
+		URL:     viper.GetString("client.url"),
+		Auth:    auth,
+		Retries: viper.GetInt("client.retries"),
+	}
+}
+
+// clientOutput prints either the plain text or the JSON representation of a
+// result, depending on the configured output format
+func clientOutput(plain string, v interface{}) {
+	if viper.GetString("client.output") == "json" {
+		json.NewEncoder(os.Stdout).Encode(v)
+		return
+	}
+
+	fmt.Println(plain)
+}
+
+func clientFatal(err error) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+	os.Exit(1)
+}
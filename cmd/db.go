@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/kamaln7/klein/storage/postgresql"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	dbMigrateCmd.Flags().Bool("dry-run", false, "list pending migrations without applying them")
+
+	dbCmd.AddCommand(dbMigrateCmd)
+	rootCmd.AddCommand(dbCmd)
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "manage the postgresql storage driver's database",
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "apply pending schema migrations to the postgresql database",
+	Long: `apply pending schema migrations to the postgresql database.
+
+The database is configured using the usual storage.sql.pg options. Migrations
+are applied in order, each in its own transaction, and instances migrating at
+the same time wait for each other.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stdout, "[klein] ", log.Ldate|log.Ltime)
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		p, err := postgresql.Connect(postgresqlConfig())
+		if err != nil {
+			logger.Fatalf("could not connect to postgresql: %s\n", err.Error())
+		}
+		defer p.Close()
+
+		version, err := p.Version()
+		if err != nil {
+			logger.Fatalf("could not read the schema version: %s\n", err.Error())
+		}
+		pending, err := p.Pending()
+		if err != nil {
+			logger.Fatalf("could not read the schema version: %s\n", err.Error())
+		}
+
+		if len(pending) == 0 {
+			logger.Printf("schema is up to date at version %d\n", version)
+			return
+		}
+		if dryRun {
+			logger.Printf("schema is at version %d, pending migrations: %v\n", version, pending)
+			return
+		}
+
+		applied, err := p.Migrate()
+		for _, v := range applied {
+			logger.Printf("applied migration %d\n", v)
+		}
+		if err != nil {
+			p.Close()
+			logger.Fatal(err)
+		}
+	},
+}
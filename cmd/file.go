@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/kamaln7/klein/storage/file"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	fileCmd.AddCommand(fileConvertCmd)
+	rootCmd.AddCommand(fileCmd)
+}
+
+var fileCmd = &cobra.Command{
+	Use:   "file",
+	Short: "manage the file storage driver's directory",
+}
+
+var fileConvertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "convert a flat file storage directory to the sharded layout",
+	Long: `convert a flat file storage directory to the sharded layout.
+
+The directory set by --storage.file.path is converted in place, so stop klein
+before converting and start it with --storage.file.layout sharded afterwards.
+An interrupted conversion can be resumed by running the same command again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stdout, "[klein] ", log.Ldate|log.Ltime)
+		path := viper.GetString("storage.file.path")
+
+		n, err := file.Convert(path)
+		if err != nil {
+			logger.Fatalf("conversion interrupted after %d links, run the same command again to resume: %s\n", n, err.Error())
+		}
+
+		logger.Printf("converted %d links in %s, start klein with --storage.file.layout sharded to use them\n", n, path)
+	},
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kamaln7/klein/auth"
+	"github.com/kamaln7/klein/auth/apikeys"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	keysCreateCmd.Flags().StringSlice("scopes", []string{string(auth.ScopeCreate)}, "what the key may do (create, delete, admin, stats)")
+	keysCreateCmd.Flags().Duration("expires", 0, "how long until the key stops working. 0 to never expire")
+
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+	rootCmd.AddCommand(keysCmd)
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "manage the API keys of the keys auth driver",
+	Long: `manage the API keys of the keys auth driver.
+
+Keys are kept in the file set by --auth.keys.path, which a running server
+rereads when it changes, so new and revoked keys take effect within a second.
+Only a hash of each key is stored.`,
+}
+
+var keysCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "create an API key and print it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stderr, "[klein] ", log.Ldate|log.Ltime)
+		names, _ := cmd.Flags().GetStringSlice("scopes")
+		expires, _ := cmd.Flags().GetDuration("expires")
+
+		var scopes []auth.Scope
+		for _, name := range names {
+			scope, err := auth.ParseScope(strings.TrimSpace(name))
+			if err != nil {
+				logger.Fatal(err)
+			}
+			scopes = append(scopes, scope)
+		}
+
+		var expiresAt *time.Time
+		if expires > 0 {
+			t := time.Now().Add(expires).UTC()
+			expiresAt = &t
+		}
+
+		key, token, err := apikeys.Create(viper.GetString("auth.keys.path"), args[0], scopes, expiresAt)
+		if err != nil {
+			logger.Fatalf("could not create key: %s\n", err.Error())
+		}
+
+		logger.Printf("created key %s (%s) with scopes %s, it won't be shown again\n", key.ID, key.Name, joinScopes(key.Scopes))
+		fmt.Println(token)
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list API keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		keys, err := apikeys.List(viper.GetString("auth.keys.path"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tEXPIRES")
+		for _, k := range keys {
+			expires := "never"
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+				if k.Expired(time.Now()) {
+					expires += " (expired)"
+				}
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, joinScopes(k.Scopes), k.CreatedAt.Format(time.RFC3339), expires)
+		}
+		w.Flush()
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:   "revoke <id|name>",
+	Short: "revoke an API key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stdout, "[klein] ", log.Ldate|log.Ltime)
+
+		key, err := apikeys.Revoke(viper.GetString("auth.keys.path"), args[0])
+		if err != nil {
+			logger.Fatalf("could not revoke %s: %s\n", args[0], err.Error())
+		}
+
+		logger.Printf("revoked key %s (%s)\n", key.ID, key.Name)
+	},
+}
+
+func joinScopes(scopes []auth.Scope) string {
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+
+	return strings.Join(names, ",")
+}
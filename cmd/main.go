@@ -1,30 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/kamaln7/klein/alias"
-	"github.com/kamaln7/klein/alias/alphanumeric"
-	"github.com/kamaln7/klein/alias/emoji"
-	"github.com/kamaln7/klein/alias/memorable"
 	"github.com/kamaln7/klein/auth"
-	"github.com/kamaln7/klein/auth/httpbasic"
-	"github.com/kamaln7/klein/auth/statickey"
-	"github.com/kamaln7/klein/auth/unauthenticated"
 	"github.com/kamaln7/klein/server"
-	"github.com/kamaln7/klein/storage"
-	"github.com/kamaln7/klein/storage/bolt"
-	"github.com/kamaln7/klein/storage/file"
-	"github.com/kamaln7/klein/storage/memory"
-	"github.com/kamaln7/klein/storage/postgresql"
-	"github.com/kamaln7/klein/storage/redis"
-	"github.com/kamaln7/klein/storage/spaces"
-	"github.com/kamaln7/klein/storage/spacesstateless"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -37,168 +24,31 @@ var rootCmd = &cobra.Command{
 		logger := log.New(os.Stdout, "[klein] ", log.Ldate|log.Ltime)
 
 		// 404
-		notFoundHTML := []byte("404 not found")
-		notFoundPath := viper.GetString("error-template")
-		if notFoundPath != "" {
-			var err error
-			notFoundHTML, err = ioutil.ReadFile(notFoundPath)
-			if err != nil {
-				logger.Fatal(err)
-				return
-			}
+		notFoundHTML, err := newNotFoundHTML()
+		if err != nil {
+			logger.Fatal(err)
 		}
 
 		// auth
-		var authProvider auth.Provider
-		switch viper.GetString("auth.driver") {
-		case "none":
-			authProvider = unauthenticated.New()
-		case "basic":
-			username := viper.GetString("auth.basic.username")
-			password := viper.GetString("auth.basic.password")
-			if username == "" || password == "" {
-				logger.Fatalf("You need to provide a username and password in order to use basic auth")
-			}
-
-			authProvider = httpbasic.New(&httpbasic.Config{
-				Username: username,
-				Password: password,
-			})
-		case "key":
-			key := viper.GetString("auth.key")
-			if key == "" {
-				logger.Fatalf("You need to provide an auth key in order to use key auth")
-			}
-			authProvider = statickey.New(&statickey.Config{
-				Key: key,
-			})
-		default:
-			logger.Fatal("invalid auth driver")
+		authProvider, err := newAuthProvider()
+		if err != nil {
+			logger.Fatal(err)
 		}
 
 		// storage
-		var storageProvider storage.Provider
-		switch viper.GetString("storage.driver") {
-		case "file":
-			storageProvider = file.New(&file.Config{
-				Path: viper.GetString("storage.file.path"),
-			})
-		case "boltdb":
-			var err error
-			storageProvider, err = bolt.New(&bolt.Config{
-				Path: viper.GetString("storage.boltdb.path"),
-			})
-
-			if err != nil {
-				logger.Fatalf("could not open bolt database: %s\n", err.Error())
-			}
-		case "redis":
-			var err error
-			storageProvider, err = redis.New(&redis.Config{
-				Address: viper.GetString("storage.redis.address"),
-				Auth:    viper.GetString("storage.redis.auth"),
-				DB:      viper.GetInt("storage.redis.db"),
-			})
-
-			if err != nil {
-				logger.Fatalf("could not open redis database: %s\n", err.Error())
-			}
-		case "spaces.stateful":
-			accessKey := viper.GetString("storage.spaces.access_key")
-			secretKey := viper.GetString("storage.spaces.secret_key")
-			region := viper.GetString("storage.spaces.region")
-			space := viper.GetString("storage.spaces.space")
-
-			if accessKey == "" || secretKey == "" || region == "" || space == "" {
-				logger.Fatalf("You need to provide an access key, secret key, region and space to use the spaces storage backend")
-			}
-
-			var err error
-			storageProvider, err = spaces.New(&spaces.Config{
-				AccessKey: accessKey,
-				SecretKey: secretKey,
-				Region:    region,
-				Space:     space,
-				Path:      viper.GetString("storage.spaces.stateful.path"),
-			})
-
-			if err != nil {
-				logger.Fatalf("could not connect to spaces: %s\n", err.Error())
-			}
-		case "spaces.stateless":
-			accessKey := viper.GetString("storage.spaces.access_key")
-			secretKey := viper.GetString("storage.spaces.secret_key")
-			region := viper.GetString("storage.spaces.region")
-			space := viper.GetString("storage.spaces.space")
-
-			if accessKey == "" || secretKey == "" || region == "" || space == "" {
-				logger.Fatalf("You need to provide an access key, secret key, region and space to use the spaces stateless storage backend")
-			}
-
-			var err error
-			storageProvider, err = spacesstateless.New(&spacesstateless.Config{
-				AccessKey:     accessKey,
-				SecretKey:     secretKey,
-				Region:        region,
-				Space:         space,
-				Path:          viper.GetString("storage.spaces.stateless.path"),
-				CacheDuration: viper.GetDuration("storage.spaces.stateless.cache-duration"),
-			})
-
-			if err != nil {
-				logger.Fatalf("could not connect to spaces: %s\n", err.Error())
-			}
-		case "sql.pg":
-			var err error
-			storageProvider, err = postgresql.New(&postgresql.Config{
-				Host:     viper.GetString("storage.sql.pg.host"),
-				Port:     viper.GetInt32("storage.sql.pg.port"),
-				User:     viper.GetString("storage.sql.pg.user"),
-				Password: viper.GetString("storage.sql.pg.password"),
-				Database: viper.GetString("storage.sql.pg.database"),
-				Table:    viper.GetString("storage.sql.pg.table"),
-				SSLMode:  viper.GetString("storage.sql.pg.sslmode"),
-			})
-
-			if err != nil {
-				logger.Fatalf("could not connect to postgresql: %s\n", err.Error())
-			}
-		case "memory":
-			storageProvider = memory.New(&memory.Config{})
-		default:
-			logger.Fatal("invalid storage driver")
+		storageProvider, err := newStorageProvider(viper.GetString("storage.driver"))
+		if err != nil {
+			logger.Fatal(err)
 		}
-
-		// alias
-		var aliasProvider alias.Provider
-		switch viper.GetString("alias.driver") {
-		case "alphanumeric":
-			var err error
-			aliasProvider, err = alphanumeric.New(&alphanumeric.Config{
-				Length: viper.GetInt("alias.alphanumeric.length"),
-				Alpha:  viper.GetBool("alias.alphanumeric.alpha"),
-				Num:    viper.GetBool("alias.alphanumeric.num"),
-			})
-
-			if err != nil {
-				logger.Fatalf("could not select alphanumeric alias: %s\n", err.Error())
-			}
-		case "emoji":
-			aliasProvider = emoji.New(&emoji.Config{
-				Length: viper.GetInt("alias.emoji.length"),
-			})
-		case "memorable":
-			aliasProvider = memorable.New(&memorable.Config{
-				Length: viper.GetInt("alias.memorable.length"),
-			})
-		default:
-			logger.Fatal("invalid alias driver")
+		storageProvider, err = withStorageCache(storageProvider, logger)
+		if err != nil {
+			logger.Fatal(err)
 		}
 
-		// url
-		publicURL := viper.GetString("url")
-		if publicURL == "" {
-			publicURL = fmt.Sprintf("http://%s/", viper.GetString("listen"))
+		// alias
+		aliasProvider, err := newAliasProvider()
+		if err != nil {
+			logger.Fatal(err)
 		}
 
 		// klein
@@ -210,18 +60,43 @@ var rootCmd = &cobra.Command{
 
 			ListenAddr:   viper.GetString("listen"),
 			RootURL:      viper.GetString("root"),
-			PublicURL:    publicURL,
+			PublicURL:    publicURL(),
 			NotFoundHTML: notFoundHTML,
 		})
 
+		newReloader(k, logger).Watch()
+
+		go func() {
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+			sig := <-stop
+
+			logger.Printf("received %s, shutting down\n", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := k.Shutdown(ctx); err != nil {
+				logger.Printf("could not shut down cleanly: %s\n", err.Error())
+			}
+		}()
+
 		k.Serve()
+
+		// stops background work such as refreshes, and flushes anything the
+		// driver buffers
+		if err := closeStorage(k.Config().Storage); err != nil {
+			logger.Fatalf("could not close storage: %s\n", err.Error())
+		}
 	},
 }
 
+// shutdownTimeout is how long requests in flight have to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
 	// General options
+	rootCmd.PersistentFlags().String("config", "", "path to config file, reloaded on change or SIGHUP")
 	rootCmd.PersistentFlags().String("error-template", "", "path to error template")
 	rootCmd.PersistentFlags().String("url", "", "path to public facing url")
 	rootCmd.PersistentFlags().String("listen", "127.0.0.1:5556", "listen address")
@@ -239,33 +114,123 @@ func init() {
 	rootCmd.PersistentFlags().Int("alias.memorable.length", 3, "memorable word count")
 
 	// Auth options
-	rootCmd.PersistentFlags().String("auth.driver", "none", "what auth backend to use (basic, key, none)")
+	rootCmd.PersistentFlags().String("auth.driver", "none", "what auth backend to use (basic, jwt, key, keys, oidc, proxy, none)")
 
 	rootCmd.PersistentFlags().String("auth.key", "", "upload API key")
+	rootCmd.PersistentFlags().StringSlice("auth.scopes", []string{string(auth.ScopeCreate)}, "what everyone may do with the none auth driver, or anyone with the key with the key auth driver (create, delete, admin, stats)")
+
+	rootCmd.PersistentFlags().String("auth.keys.path", "keys.json", "file holding the API keys managed with klein keys")
+
+	rootCmd.PersistentFlags().String("auth.jwt.secret", "", "shared secret to verify HS256 signed JWTs with")
+	rootCmd.PersistentFlags().String("auth.jwt.jwks", "", "path or URL of a JWKS to verify RS256 and ES256 signed JWTs with")
+	rootCmd.PersistentFlags().Duration("auth.jwt.jwks-refresh", time.Hour, "how often to reload the JWKS")
+	rootCmd.PersistentFlags().String("auth.jwt.issuer", "", "required iss claim of JWTs")
+	rootCmd.PersistentFlags().String("auth.jwt.audience", "", "required aud claim of JWTs")
+	rootCmd.PersistentFlags().Duration("auth.jwt.leeway", time.Minute, "allowed clock skew when checking the exp and nbf claims of JWTs. negative for none")
+	rootCmd.PersistentFlags().String("auth.jwt.name-claim", "sub", "JWT claim holding the name recorded as the creator of links")
+	rootCmd.PersistentFlags().String("auth.jwt.scopes-claim", "scope", "JWT claim holding the scopes, as a space separated string or a list")
+	rootCmd.PersistentFlags().String("auth.jwt.scope-prefix", "", "prefix of the scopes in the JWT scopes claim, eg klein:")
+
+	rootCmd.PersistentFlags().String("auth.oidc.issuer", "", "URL of the OpenID Connect provider, eg https://accounts.google.com")
+	rootCmd.PersistentFlags().String("auth.oidc.client-id", "", "OpenID Connect client ID")
+	rootCmd.PersistentFlags().String("auth.oidc.client-secret", "", "OpenID Connect client secret")
+	rootCmd.PersistentFlags().String("auth.oidc.redirect-url", "", "OpenID Connect callback URL. defaults to the public url followed by _auth/callback")
+	rootCmd.PersistentFlags().String("auth.oidc.session-secret", "", "secret to sign session cookies with, shared by every klein instance")
+	rootCmd.PersistentFlags().Duration("auth.oidc.session-ttl", 12*time.Hour, "how long a login lasts")
+	rootCmd.PersistentFlags().StringSlice("auth.oidc.domains", nil, "only let in users with a verified email address at these domains")
+	rootCmd.PersistentFlags().StringSlice("auth.oidc.groups", nil, "only let in members of at least one of these groups")
+	rootCmd.PersistentFlags().String("auth.oidc.groups-claim", "groups", "ID token claim listing the groups of a user")
+	rootCmd.PersistentFlags().StringSlice("auth.oidc.extra-scopes", nil, "OpenID Connect scopes to request besides openid, email and profile, eg groups")
+	rootCmd.PersistentFlags().StringSlice("auth.oidc.scopes", []string{string(auth.ScopeCreate)}, "what logged in users may do (create, delete, admin, stats)")
+
+	rootCmd.PersistentFlags().StringSlice("auth.proxy.trusted", nil, "addresses or CIDR ranges of the reverse proxies whose identity headers are trusted")
+	rootCmd.PersistentFlags().String("auth.proxy.secret", "", "secret the reverse proxy has to pass in auth.proxy.secret-header")
+	rootCmd.PersistentFlags().String("auth.proxy.secret-header", "X-Klein-Proxy-Secret", "header holding the reverse proxy's secret")
+	rootCmd.PersistentFlags().String("auth.proxy.user-header", "X-Forwarded-User", "header holding the user authenticated by the reverse proxy")
+	rootCmd.PersistentFlags().String("auth.proxy.email-header", "X-Forwarded-Email", "header holding the email address of the user authenticated by the reverse proxy")
+	rootCmd.PersistentFlags().StringSlice("auth.proxy.scopes", []string{string(auth.ScopeCreate)}, "what users authenticated by the reverse proxy may do (create, delete, admin, stats)")
 
 	rootCmd.PersistentFlags().String("auth.basic.username", "", "username for HTTP basic auth")
 	rootCmd.PersistentFlags().String("auth.basic.password", "", "password for HTTP basic auth")
+	rootCmd.PersistentFlags().String("auth.basic.file", "", "htpasswd file with bcrypt or argon2 hashed passwords, used instead of auth.basic.username and auth.basic.password")
+	rootCmd.PersistentFlags().StringSlice("auth.basic.scopes", []string{string(auth.ScopeCreate)}, "what users authenticated with HTTP basic auth may do (create, delete, admin, stats)")
 
 	// Storage options
-	rootCmd.PersistentFlags().String("storage.driver", "file", "what storage backend to use (file, boltdb, redis, spaces.stateful, sql.pg, memory)")
+	rootCmd.PersistentFlags().String("storage.driver", "file", "what storage backend to use (file, boltdb, badger, redis, etcd, s3, spaces.stateful, spaces.stateless, sql.pg, sql.mysql, sqlite, memory, replicated)")
+
+	rootCmd.PersistentFlags().Int("storage.cache.size", 0, "number of aliases to cache in memory in front of any storage driver. 0 to disable")
+	rootCmd.PersistentFlags().Duration("storage.cache.ttl", time.Minute, "time to cache urls in memory")
+	rootCmd.PersistentFlags().Duration("storage.cache.negative-ttl", 10*time.Second, "time to remember that an alias does not exist, at most the cache ttl. 0 to disable")
+	rootCmd.PersistentFlags().String("storage.cache.redis.address", "", "address:port of a redis instance to share cached urls between instances. empty to disable")
+	rootCmd.PersistentFlags().String("storage.cache.redis.auth", "", "password to access the cache redis")
+	rootCmd.PersistentFlags().Int("storage.cache.redis.db", 0, "db to select within the cache redis")
+	rootCmd.PersistentFlags().Int("storage.cache.redis.pool-size", 10, "number of connections to keep open to the cache redis")
+	rootCmd.PersistentFlags().String("storage.cache.redis.prefix", "klein:cache:", "prefix for cache keys in redis")
+	rootCmd.PersistentFlags().Duration("storage.cache.redis.ttl", time.Hour, "time to cache urls in redis. 0 to keep them until invalidated")
 
 	rootCmd.PersistentFlags().String("storage.file.path", "urls", "path to use for file store")
+	rootCmd.PersistentFlags().String("storage.file.layout", "flat", "how to lay out files (flat, sharded). sharded scales to many links and supports any alias")
 
 	rootCmd.PersistentFlags().String("storage.boltdb.path", "bolt.db", "path to use for bolt db")
+	rootCmd.PersistentFlags().String("storage.boltdb.bucket", "klein", "bucket to store urls in")
+	rootCmd.PersistentFlags().Duration("storage.boltdb.timeout", time.Second, "how long to wait for the bolt db file to be unlocked by another process")
+
+	rootCmd.PersistentFlags().String("storage.badger.path", "badger", "directory to use for the badger database")
+	rootCmd.PersistentFlags().Duration("storage.badger.ttl", 0, "expire links this long after they are created. 0 to keep them forever")
+	rootCmd.PersistentFlags().Duration("storage.badger.gc-interval", 5*time.Minute, "how often to reclaim space from deleted and expired links")
+	rootCmd.PersistentFlags().Float64("storage.badger.gc-discard-ratio", 0.5, "share of a badger value log file that must be stale for it to be rewritten")
+	rootCmd.PersistentFlags().Bool("storage.badger.sync-writes", false, "wait for every write to reach the disk. safer, but much slower")
 
 	rootCmd.PersistentFlags().String("storage.redis.address", "127.0.0.1:6379", "address:port of redis instance")
 	rootCmd.PersistentFlags().String("storage.redis.auth", "", "password to access redis")
 	rootCmd.PersistentFlags().Int("storage.redis.db", 0, "db to select within redis")
+	rootCmd.PersistentFlags().String("storage.redis.prefix", "", "prefix for the keys of stored urls, needed to list and count them")
+	rootCmd.PersistentFlags().Int("storage.redis.pool-size", 10, "number of connections to keep open to each redis server")
+	rootCmd.PersistentFlags().Duration("storage.redis.dial-timeout", 5*time.Second, "timeout for connecting to redis. 0 to disable")
+	rootCmd.PersistentFlags().Duration("storage.redis.read-timeout", 3*time.Second, "timeout for reading redis replies. 0 to disable")
+	rootCmd.PersistentFlags().Duration("storage.redis.write-timeout", 3*time.Second, "timeout for sending redis commands. 0 to disable")
+	rootCmd.PersistentFlags().Bool("storage.redis.tls", false, "connect to redis over tls")
+	rootCmd.PersistentFlags().String("storage.redis.tls-ca", "", "path to a CA bundle to verify the redis server with")
+	rootCmd.PersistentFlags().Bool("storage.redis.tls-skip-verify", false, "don't verify the redis server's tls certificate")
+	rootCmd.PersistentFlags().StringSlice("storage.redis.sentinel.addresses", nil, "address:port of redis sentinels to find the master through, instead of storage.redis.address")
+	rootCmd.PersistentFlags().String("storage.redis.sentinel.master", "", "name of the master monitored by sentinel")
+	rootCmd.PersistentFlags().Bool("storage.redis.cluster", false, "use redis cluster, discovering the nodes from storage.redis.address")
+
+	rootCmd.PersistentFlags().String("storage.s3.endpoint", "", "s3 API endpoint, leave empty for AWS")
+	rootCmd.PersistentFlags().String("storage.s3.region", "us-east-1", "s3 region")
+	rootCmd.PersistentFlags().String("storage.s3.bucket", "", "s3 bucket")
+	rootCmd.PersistentFlags().String("storage.s3.path", "klein", "path in the s3 bucket to store urls in")
+	rootCmd.PersistentFlags().Bool("storage.s3.path-style", false, "use path-style s3 addressing, needed by most self-hosted servers")
+	rootCmd.PersistentFlags().String("storage.s3.access-key", "", "s3 access key, leave empty to use the standard AWS credential chain")
+	rootCmd.PersistentFlags().String("storage.s3.secret-key", "", "s3 secret key")
+	rootCmd.PersistentFlags().String("storage.s3.sse", "", "s3 server-side encryption (AES256, aws:kms)")
+	rootCmd.PersistentFlags().String("storage.s3.sse-kms-key-id", "", "kms key id for aws:kms server-side encryption")
+
+	rootCmd.PersistentFlags().StringSlice("storage.etcd.endpoints", []string{"127.0.0.1:2379"}, "etcd endpoints, eg https://etcd-0:2379")
+	rootCmd.PersistentFlags().String("storage.etcd.prefix", "klein/", "prefix for the keys of stored urls")
+	rootCmd.PersistentFlags().String("storage.etcd.username", "", "etcd username")
+	rootCmd.PersistentFlags().String("storage.etcd.password", "", "etcd password")
+	rootCmd.PersistentFlags().Duration("storage.etcd.dial-timeout", 5*time.Second, "timeout for connecting to etcd")
+	rootCmd.PersistentFlags().Duration("storage.etcd.request-timeout", 5*time.Second, "timeout for etcd requests")
+	rootCmd.PersistentFlags().String("storage.etcd.tls-ca", "", "path to a CA bundle to verify the etcd servers with, enables tls")
+	rootCmd.PersistentFlags().String("storage.etcd.tls-cert", "", "path to a client certificate for etcd, enables tls")
+	rootCmd.PersistentFlags().String("storage.etcd.tls-key", "", "path to the client certificate's key")
+	rootCmd.PersistentFlags().Int("storage.etcd.cache-size", 0, "number of lookups to cache in memory, kept up to date by watching etcd. 0 to disable")
 
 	rootCmd.PersistentFlags().String("storage.spaces.access-key", "", "access key for spaces")
 	rootCmd.PersistentFlags().String("storage.spaces.secret-key", "", "secret key for spaces")
 	rootCmd.PersistentFlags().String("storage.spaces.region", "", "region for spaces")
 	rootCmd.PersistentFlags().String("storage.spaces.space", "", "space to use")
+	rootCmd.PersistentFlags().String("storage.spaces.endpoint", "", "spaces API endpoint, derived from the region if empty")
+	rootCmd.PersistentFlags().Bool("storage.spaces.path-style", false, "use path-style addressing for the space, for S3-compatible servers standing in for spaces")
 
 	rootCmd.PersistentFlags().String("storage.spaces.stateful.path", "klein.json", "path of the file in spaces")
+	rootCmd.PersistentFlags().Duration("storage.spaces.stateful.refresh-interval", time.Minute, "how often to reload the file to pick up urls stored by other instances. 0 to disable")
 
 	rootCmd.PersistentFlags().String("storage.spaces.stateless.path", "/klein", "path of the directory in spaces to store urls in")
 	rootCmd.PersistentFlags().Duration("storage.spaces.stateless.cache-duration", time.Minute, "time to cache spaces results in memory. 0 to disable")
+	rootCmd.PersistentFlags().Duration("storage.spaces.stateless.negative-cache-duration", 10*time.Second, "time to remember that an alias does not exist, at most the cache duration. 0 to disable")
+	rootCmd.PersistentFlags().Int("storage.spaces.stateless.cache-size", 10000, "maximum number of cached aliases. 0 for unlimited")
 
 	rootCmd.PersistentFlags().String("storage.sql.pg.host", "localhost", "postgresql host")
 	rootCmd.PersistentFlags().Int32("storage.sql.pg.port", 5432, "postgresql port")
@@ -274,6 +239,28 @@ func init() {
 	rootCmd.PersistentFlags().String("storage.sql.pg.database", "klein", "postgresql database")
 	rootCmd.PersistentFlags().String("storage.sql.pg.table", "klein", "postgresql table")
 	rootCmd.PersistentFlags().String("storage.sql.pg.sslmode", "prefer", "postgresql sslmode")
+	rootCmd.PersistentFlags().String("storage.sql.pg.dsn", "", "postgresql connection url or key=value string, used instead of the other connection options")
+	rootCmd.PersistentFlags().String("storage.sql.pg.schema", "", "postgresql schema to keep the table in, created if needed. defaults to the search_path")
+	rootCmd.PersistentFlags().Int("storage.sql.pg.max-open-conns", 0, "maximum number of open postgresql connections. 0 for unlimited")
+	rootCmd.PersistentFlags().Int("storage.sql.pg.max-idle-conns", 0, "maximum number of idle postgresql connections. 0 for the default of 2")
+	rootCmd.PersistentFlags().Duration("storage.sql.pg.statement-timeout", 0, "abort postgresql queries that take longer. 0 to disable")
+	rootCmd.PersistentFlags().Bool("storage.sql.pg.auto-migrate", true, "apply pending postgresql schema migrations on startup, otherwise refuse to start until klein db migrate is run")
+
+	rootCmd.PersistentFlags().String("storage.sql.mysql.host", "localhost", "mysql host")
+	rootCmd.PersistentFlags().Int32("storage.sql.mysql.port", 3306, "mysql port")
+	rootCmd.PersistentFlags().String("storage.sql.mysql.user", "klein", "mysql user")
+	rootCmd.PersistentFlags().String("storage.sql.mysql.password", "secret", "mysql password")
+	rootCmd.PersistentFlags().String("storage.sql.mysql.database", "klein", "mysql database")
+	rootCmd.PersistentFlags().String("storage.sql.mysql.table", "klein", "mysql table")
+	rootCmd.PersistentFlags().String("storage.sql.mysql.tls", "preferred", "mysql tls mode (disable, preferred, skip-verify, verify-full)")
+	rootCmd.PersistentFlags().String("storage.sql.mysql.tls-ca", "", "path to a CA bundle to verify the mysql server with in the verify-full tls mode")
+
+	rootCmd.PersistentFlags().StringSlice("storage.replicated.drivers", nil, "storage drivers to replicate to, the first one is the primary")
+	rootCmd.PersistentFlags().String("storage.replicated.consistency", "all", "when a replicated write is done (all, primary, async)")
+	rootCmd.PersistentFlags().StringSlice("storage.replicated.read-order", nil, "storage drivers to read from in order until one has the link. defaults to the drivers' order")
+
+	rootCmd.PersistentFlags().String("storage.sqlite.path", "klein.sqlite", "path to use for sqlite database")
+	rootCmd.PersistentFlags().String("storage.sqlite.table", "klein", "sqlite table")
 
 	viper.BindPFlags(rootCmd.PersistentFlags())
 }
@@ -282,6 +269,14 @@ func initConfig() {
 	viper.SetEnvPrefix("klein")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	viper.AutomaticEnv()
+
+	if configFile := viper.GetString("config"); configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			fmt.Printf("could not read config file: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 }
 
 // Execute executes the root command
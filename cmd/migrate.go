@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// destinationPrefix namespaces the destination's storage options, eg
+// --to.storage.sql.pg.host
+const destinationPrefix = "to."
+
+func init() {
+	migrateCmd.Flags().String("from", "", "storage driver to copy links from")
+	migrateCmd.Flags().String("to", "", "storage driver to copy links to")
+	migrateCmd.Flags().Bool("dry-run", false, "report what would be copied without writing anything")
+
+	// every storage option can be set separately for the destination
+	rootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if strings.HasPrefix(f.Name, "storage.") {
+			addDestinationFlag(migrateCmd.Flags(), f)
+		}
+	})
+
+	rootCmd.AddCommand(migrateCmd)
+}
+
+// addDestinationFlag adds a copy of a storage option, of the same type, for the destination
+func addDestinationFlag(flags *pflag.FlagSet, f *pflag.Flag) {
+	name, usage := destinationPrefix+f.Name, f.Usage+" (destination)"
+
+	root := rootCmd.PersistentFlags()
+	switch f.Value.Type() {
+	case "bool":
+		v, _ := root.GetBool(f.Name)
+		flags.Bool(name, v, usage)
+	case "int":
+		v, _ := root.GetInt(f.Name)
+		flags.Int(name, v, usage)
+	case "int32":
+		v, _ := root.GetInt32(f.Name)
+		flags.Int32(name, v, usage)
+	case "float64":
+		v, _ := root.GetFloat64(f.Name)
+		flags.Float64(name, v, usage)
+	case "duration":
+		v, _ := root.GetDuration(f.Name)
+		flags.Duration(name, v, usage)
+	case "string":
+		v, _ := root.GetString(f.Name)
+		flags.String(name, v, usage)
+	case "stringSlice":
+		v, _ := root.GetStringSlice(f.Name)
+		flags.StringSlice(name, v, usage)
+	default:
+		// a string copy would let viper hand the destination a value of the wrong type
+		panic(fmt.Sprintf("migrate: storage option %s has unsupported type %s", f.Name, f.Value.Type()))
+	}
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "copy every link from one storage driver to another",
+	Long: `copy every link from one storage driver to another.
+
+The source is configured using the usual storage options, and the destination
+using the same options prefixed with to., eg
+klein migrate --from file --to sql.pg --storage.file.path urls --to.storage.sql.pg.host db
+
+This also allows copying between two databases or directories of the same
+driver, eg
+klein migrate --from file --to file --storage.file.path old --to.storage.file.path new
+
+Links that already exist in the destination with the same URL are skipped, so
+an interrupted migration can be resumed by running the same command again.
+Aliases that exist in the destination with a different URL are reported as
+conflicts and left untouched.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stdout, "[klein] ", log.Ldate|log.Ltime)
+
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		if from == "" || to == "" {
+			logger.Fatal("You need to provide both --from and --to storage drivers")
+		}
+
+		src, err := newStorageProvider(from)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		differs, err := useDestinationOptions(cmd.Flags())
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if from == to && !differs {
+			logger.Fatalf("the source and destination are the same, set the destination's options with --%sstorage.*\n", destinationPrefix)
+		}
+		dst, err := newStorageProvider(to)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		err = migrateLinks(logger, src, dst, from, to, dryRun)
+		if cerr := closeStorage(dst); cerr != nil && err == nil {
+			err = cerr
+		}
+		closeStorage(src)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// useDestinationOptions points viper's storage options at the destination's,
+// after the source has been opened. It reports whether they differ from the
+// source's.
+func useDestinationOptions(flags *pflag.FlagSet) (bool, error) {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if strings.HasPrefix(f.Name, destinationPrefix+"storage.") && err == nil {
+			err = viper.BindPFlag(f.Name, f)
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	differs := false
+	for _, key := range viper.AllKeys() {
+		if !strings.HasPrefix(key, destinationPrefix+"storage.") {
+			continue
+		}
+
+		srcKey, value := strings.TrimPrefix(key, destinationPrefix), viper.Get(key)
+		if fmt.Sprint(viper.Get(srcKey)) != fmt.Sprint(value) {
+			differs = true
+		}
+		viper.Set(srcKey, value)
+	}
+
+	return differs, nil
+}
+
+// migrateLinks copies every link from src to dst and checks that they all
+// made it over
+func migrateLinks(logger *log.Logger, src, dst storage.Provider, from, to string, dryRun bool) error {
+	walker, ok := src.(storage.Walker)
+	if !ok {
+		return fmt.Errorf("the %s storage driver does not support listing links", from)
+	}
+
+	var total, copied, skipped, conflicts int
+	err := walker.Walk(func(alias, url string) error {
+		total++
+		if total%1000 == 0 {
+			logger.Printf("processed %d links\n", total)
+		}
+
+		existing, err := dst.Get(alias)
+		switch err {
+		case nil:
+			if existing == url {
+				skipped++
+			} else {
+				conflicts++
+				logger.Printf("conflict: %q points to %q in %s but to %q in %s\n", alias, url, from, existing, to)
+			}
+			return nil
+		case storage.ErrNotFound:
+		default:
+			return err
+		}
+
+		if dryRun {
+			copied++
+			return nil
+		}
+
+		err = dst.Store(url, alias)
+		switch err {
+		case nil:
+			copied++
+		case storage.ErrAlreadyExists:
+			conflicts++
+			logger.Printf("conflict: %q was created in %s while migrating\n", alias, to)
+		default:
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("migration interrupted after %d links, run the same command again to resume: %s", total, err.Error())
+	}
+
+	verb := "copied"
+	if dryRun {
+		verb = "would copy"
+	}
+	logger.Printf("%d links in %s: %s %d, skipped %d already in %s, %d conflicts\n", total, from, verb, copied, skipped, to, conflicts)
+
+	if dryRun {
+		return nil
+	}
+
+	// verify that every link made it over
+	var verified, missing int
+	err = walker.Walk(func(alias, url string) error {
+		existing, err := dst.Get(alias)
+		switch {
+		case err == nil && existing == url:
+			verified++
+		case err == nil || err == storage.ErrNotFound:
+			missing++
+		default:
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not verify migration: %s", err.Error())
+	}
+
+	if dstWalker, ok := dst.(storage.Walker); ok {
+		var count int
+		err = dstWalker.Walk(func(alias, url string) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not count links in %s: %s", to, err.Error())
+		}
+		logger.Printf("%s now holds %d links\n", to, count)
+	}
+
+	if missing != conflicts {
+		return fmt.Errorf("verification failed: %d of %d links match in %s, %d do not", verified, total, to, missing)
+	}
+	logger.Printf("verified %d of %d links in %s\n", verified, total, to)
+
+	if conflicts > 0 {
+		return fmt.Errorf("%d conflicting aliases were not migrated", conflicts)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/file"
+	"github.com/kamaln7/klein/storage/memory"
+	"github.com/spf13/pflag"
+)
+
+func TestMigrateLinks(t *testing.T) {
+	src, dst := memory.New(&memory.Config{}), memory.New(&memory.Config{})
+	src.Store("http://a.example.com", "a")
+	src.Store("http://b.example.com", "b")
+	src.Store("http://c.example.com", "c")
+	dst.Store("http://b.example.com", "b")
+
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+
+	if err := migrateLinks(logger, src, dst, "memory", "other", true); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := dst.Exists("a"); exists {
+		t.Error("expected a dry run not to copy anything")
+	}
+
+	if err := migrateLinks(logger, src, dst, "memory", "other", false); err != nil {
+		t.Fatalf("%v\n%s", err, logs.String())
+	}
+	for _, alias := range []string{"a", "b", "c"} {
+		if url, err := dst.Get(alias); err != nil || url != "http://"+alias+".example.com" {
+			t.Errorf("expected %s to be copied, got %q, %v", alias, url, err)
+		}
+	}
+	if !strings.Contains(logs.String(), "copied 2, skipped 1") {
+		t.Errorf("expected the existing link to be skipped, got:\n%s", logs.String())
+	}
+
+	// conflicting aliases are left alone and fail the migration
+	src.Store("http://d.example.com", "d")
+	dst.Store("http://other.example.com", "d")
+	if err := migrateLinks(logger, src, dst, "memory", "other", false); err == nil || !strings.Contains(err.Error(), "1 conflicting") {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	if url, _ := dst.Get("d"); url != "http://other.example.com" {
+		t.Errorf("expected the conflicting link to be left alone, got %q", url)
+	}
+
+	// the source has to be listable
+	if err := migrateLinks(logger, struct{ storage.Provider }{src}, dst, "memory", "other", false); err == nil {
+		t.Error("expected an error for a source that can't be listed")
+	}
+}
+
+func TestMigrateOptions(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+
+	src, err := file.New(&file.Config{Path: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Store("http://example.com", "example")
+
+	rootCmd.SetArgs([]string{"migrate", "--from", "file", "--to", "file", "--storage.file.path", from, "--to.storage.file.path", to})
+	rootCmd.SetOutput(ioutil.Discard)
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := file.New(&file.Config{Path: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, err := dst.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the link to be copied to the destination directory, got %q, %v", url, err)
+	}
+}
+
+func TestDestinationFlags(t *testing.T) {
+	rootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if !strings.HasPrefix(f.Name, "storage.") {
+			return
+		}
+
+		dst := migrateCmd.Flags().Lookup(destinationPrefix + f.Name)
+		if dst == nil {
+			t.Errorf("expected a destination flag for %s", f.Name)
+			return
+		}
+		if dst.Value.Type() != f.Value.Type() || dst.DefValue != f.DefValue {
+			t.Errorf("expected %s to be a %s defaulting to %q, got a %s defaulting to %q", dst.Name, f.Value.Type(), f.DefValue, dst.Value.Type(), dst.DefValue)
+		}
+	})
+}
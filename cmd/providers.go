@@ -0,0 +1,531 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kamaln7/klein/alias"
+	"github.com/kamaln7/klein/alias/alphanumeric"
+	"github.com/kamaln7/klein/alias/emoji"
+	"github.com/kamaln7/klein/alias/memorable"
+	"github.com/kamaln7/klein/auth"
+	"github.com/kamaln7/klein/auth/apikeys"
+	"github.com/kamaln7/klein/auth/httpbasic"
+	"github.com/kamaln7/klein/auth/jwt"
+	"github.com/kamaln7/klein/auth/oidc"
+	"github.com/kamaln7/klein/auth/proxy"
+	"github.com/kamaln7/klein/auth/statickey"
+	"github.com/kamaln7/klein/auth/unauthenticated"
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/badger"
+	"github.com/kamaln7/klein/storage/bolt"
+	"github.com/kamaln7/klein/storage/cache"
+	"github.com/kamaln7/klein/storage/etcd"
+	"github.com/kamaln7/klein/storage/file"
+	"github.com/kamaln7/klein/storage/memory"
+	"github.com/kamaln7/klein/storage/mysql"
+	"github.com/kamaln7/klein/storage/postgresql"
+	"github.com/kamaln7/klein/storage/redis"
+	"github.com/kamaln7/klein/storage/replicated"
+	"github.com/kamaln7/klein/storage/s3"
+	"github.com/kamaln7/klein/storage/spaces"
+	"github.com/kamaln7/klein/storage/spacesstateless"
+	"github.com/kamaln7/klein/storage/sqlite"
+	"github.com/spf13/viper"
+)
+
+func newNotFoundHTML() ([]byte, error) {
+	notFoundPath := viper.GetString("error-template")
+	if notFoundPath == "" {
+		return []byte("404 not found"), nil
+	}
+
+	return ioutil.ReadFile(notFoundPath)
+}
+
+func newAuthProvider() (auth.Provider, error) {
+	switch viper.GetString("auth.driver") {
+	case "none":
+		scopes, err := parseScopes("auth.scopes")
+		if err != nil {
+			return nil, err
+		}
+
+		return unauthenticated.New(&unauthenticated.Config{
+			Scopes: scopes,
+		}), nil
+	case "basic":
+		username := viper.GetString("auth.basic.username")
+		password := viper.GetString("auth.basic.password")
+		file := viper.GetString("auth.basic.file")
+		if file == "" && (username == "" || password == "") {
+			return nil, errors.New("You need to provide a username and password or an htpasswd file in order to use basic auth")
+		}
+
+		scopes, err := parseScopes("auth.basic.scopes")
+		if err != nil {
+			return nil, err
+		}
+
+		return httpbasic.New(&httpbasic.Config{
+			Username: username,
+			Password: password,
+			File:     file,
+			Scopes:   scopes,
+		})
+	case "key":
+		key := viper.GetString("auth.key")
+		if key == "" {
+			return nil, errors.New("You need to provide an auth key in order to use key auth")
+		}
+
+		scopes, err := parseScopes("auth.scopes")
+		if err != nil {
+			return nil, err
+		}
+
+		return statickey.New(&statickey.Config{
+			Key:    key,
+			Scopes: scopes,
+		}), nil
+	case "keys":
+		return apikeys.New(&apikeys.Config{
+			Path: viper.GetString("auth.keys.path"),
+		})
+	case "jwt":
+		secret := viper.GetString("auth.jwt.secret")
+		jwks := viper.GetString("auth.jwt.jwks")
+		if secret == "" && jwks == "" {
+			return nil, errors.New("You need to provide a secret or a JWKS in order to use JWT auth")
+		}
+
+		return jwt.New(&jwt.Config{
+			Secret:      secret,
+			JWKS:        jwks,
+			JWKSRefresh: viper.GetDuration("auth.jwt.jwks-refresh"),
+			Issuer:      viper.GetString("auth.jwt.issuer"),
+			Audience:    viper.GetString("auth.jwt.audience"),
+			Leeway:      viper.GetDuration("auth.jwt.leeway"),
+			NameClaim:   viper.GetString("auth.jwt.name-claim"),
+			ScopesClaim: viper.GetString("auth.jwt.scopes-claim"),
+			ScopePrefix: viper.GetString("auth.jwt.scope-prefix"),
+		})
+	case "oidc":
+		redirectURL := viper.GetString("auth.oidc.redirect-url")
+		if redirectURL == "" {
+			redirectURL = strings.TrimRight(publicURL(), "/") + "/_auth/callback"
+		}
+
+		scopes, err := parseScopes("auth.oidc.scopes")
+		if err != nil {
+			return nil, err
+		}
+
+		return oidc.New(&oidc.Config{
+			Issuer:        viper.GetString("auth.oidc.issuer"),
+			ClientID:      viper.GetString("auth.oidc.client-id"),
+			ClientSecret:  viper.GetString("auth.oidc.client-secret"),
+			RedirectURL:   redirectURL,
+			SessionSecret: viper.GetString("auth.oidc.session-secret"),
+			SessionTTL:    viper.GetDuration("auth.oidc.session-ttl"),
+			Domains:       viper.GetStringSlice("auth.oidc.domains"),
+			Groups:        viper.GetStringSlice("auth.oidc.groups"),
+			GroupsClaim:   viper.GetString("auth.oidc.groups-claim"),
+			ExtraScopes:   viper.GetStringSlice("auth.oidc.extra-scopes"),
+			Scopes:        scopes,
+		})
+	case "proxy":
+		proxies := viper.GetStringSlice("auth.proxy.trusted")
+		if len(proxies) == 0 {
+			return nil, errors.New("You need to provide the addresses of the trusted proxies in order to use proxy auth")
+		}
+
+		scopes, err := parseScopes("auth.proxy.scopes")
+		if err != nil {
+			return nil, err
+		}
+
+		return proxy.New(&proxy.Config{
+			Proxies:      proxies,
+			Secret:       viper.GetString("auth.proxy.secret"),
+			SecretHeader: viper.GetString("auth.proxy.secret-header"),
+			UserHeader:   viper.GetString("auth.proxy.user-header"),
+			EmailHeader:  viper.GetString("auth.proxy.email-header"),
+			Scopes:       scopes,
+		})
+	default:
+		return nil, errors.New("invalid auth driver")
+	}
+}
+
+// parseScopes reads a list of scopes from the config
+func parseScopes(key string) ([]auth.Scope, error) {
+	scopes := []auth.Scope{}
+	for _, name := range viper.GetStringSlice(key) {
+		scope, err := auth.ParseScope(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+func newStorageProvider(driver string) (storage.Provider, error) {
+	switch driver {
+	case "file":
+		p, err := file.New(&file.Config{
+			Path:   viper.GetString("storage.file.path"),
+			Layout: viper.GetString("storage.file.layout"),
+		})
+		if err == file.ErrUnconverted {
+			return nil, fmt.Errorf("%s, eg with klein file convert", err.Error())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not open file storage: %s", err.Error())
+		}
+
+		return p, nil
+	case "boltdb":
+		p, err := bolt.New(&bolt.Config{
+			Path:    viper.GetString("storage.boltdb.path"),
+			Bucket:  viper.GetString("storage.boltdb.bucket"),
+			Timeout: viper.GetDuration("storage.boltdb.timeout"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not open bolt database: %s", err.Error())
+		}
+
+		return p, nil
+	case "badger":
+		p, err := badger.New(&badger.Config{
+			Path:           viper.GetString("storage.badger.path"),
+			TTL:            viper.GetDuration("storage.badger.ttl"),
+			GCInterval:     viper.GetDuration("storage.badger.gc-interval"),
+			GCDiscardRatio: viper.GetFloat64("storage.badger.gc-discard-ratio"),
+			SyncWrites:     viper.GetBool("storage.badger.sync-writes"),
+			Log:            log.New(os.Stderr, "[badger] ", log.Ldate|log.Ltime),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not open badger database: %s", err.Error())
+		}
+
+		return p, nil
+	case "etcd":
+		p, err := etcd.New(&etcd.Config{
+			Endpoints:      stringSlice("storage.etcd.endpoints"),
+			Prefix:         viper.GetString("storage.etcd.prefix"),
+			Username:       viper.GetString("storage.etcd.username"),
+			Password:       viper.GetString("storage.etcd.password"),
+			DialTimeout:    viper.GetDuration("storage.etcd.dial-timeout"),
+			RequestTimeout: viper.GetDuration("storage.etcd.request-timeout"),
+			TLSCA:          viper.GetString("storage.etcd.tls-ca"),
+			TLSCert:        viper.GetString("storage.etcd.tls-cert"),
+			TLSKey:         viper.GetString("storage.etcd.tls-key"),
+			CacheSize:      viper.GetInt("storage.etcd.cache-size"),
+			Log:            log.New(os.Stderr, "[etcd] ", log.Ldate|log.Ltime),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to etcd: %s", err.Error())
+		}
+
+		return p, nil
+	case "redis":
+		p, err := redis.New(&redis.Config{
+			Address: viper.GetString("storage.redis.address"),
+			Auth:    viper.GetString("storage.redis.auth"),
+			DB:      viper.GetInt("storage.redis.db"),
+			Prefix:  viper.GetString("storage.redis.prefix"),
+
+			PoolSize:     viper.GetInt("storage.redis.pool-size"),
+			DialTimeout:  viper.GetDuration("storage.redis.dial-timeout"),
+			ReadTimeout:  viper.GetDuration("storage.redis.read-timeout"),
+			WriteTimeout: viper.GetDuration("storage.redis.write-timeout"),
+
+			TLS:           viper.GetBool("storage.redis.tls"),
+			TLSCA:         viper.GetString("storage.redis.tls-ca"),
+			TLSSkipVerify: viper.GetBool("storage.redis.tls-skip-verify"),
+
+			SentinelAddresses: stringSlice("storage.redis.sentinel.addresses"),
+			SentinelMaster:    viper.GetString("storage.redis.sentinel.master"),
+			Cluster:           viper.GetBool("storage.redis.cluster"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not open redis database: %s", err.Error())
+		}
+
+		return p, nil
+	case "spaces.stateful":
+		accessKey := viper.GetString("storage.spaces.access_key")
+		secretKey := viper.GetString("storage.spaces.secret_key")
+		region := viper.GetString("storage.spaces.region")
+		space := viper.GetString("storage.spaces.space")
+
+		if accessKey == "" || secretKey == "" || region == "" || space == "" {
+			return nil, errors.New("You need to provide an access key, secret key, region and space to use the spaces storage backend")
+		}
+
+		p, err := spaces.New(&spaces.Config{
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+			Region:    region,
+			Space:     space,
+			Endpoint:  viper.GetString("storage.spaces.endpoint"),
+			PathStyle: viper.GetBool("storage.spaces.path-style"),
+			Path:      viper.GetString("storage.spaces.stateful.path"),
+
+			RefreshInterval: viper.GetDuration("storage.spaces.stateful.refresh-interval"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to spaces: %s", err.Error())
+		}
+
+		return p, nil
+	case "spaces.stateless":
+		accessKey := viper.GetString("storage.spaces.access_key")
+		secretKey := viper.GetString("storage.spaces.secret_key")
+		region := viper.GetString("storage.spaces.region")
+		space := viper.GetString("storage.spaces.space")
+
+		if accessKey == "" || secretKey == "" || region == "" || space == "" {
+			return nil, errors.New("You need to provide an access key, secret key, region and space to use the spaces stateless storage backend")
+		}
+
+		p, err := spacesstateless.New(&spacesstateless.Config{
+			AccessKey:     accessKey,
+			SecretKey:     secretKey,
+			Region:        region,
+			Space:         space,
+			Endpoint:      viper.GetString("storage.spaces.endpoint"),
+			PathStyle:     viper.GetBool("storage.spaces.path-style"),
+			Path:          viper.GetString("storage.spaces.stateless.path"),
+			CacheDuration: viper.GetDuration("storage.spaces.stateless.cache-duration"),
+
+			NegativeCacheDuration: viper.GetDuration("storage.spaces.stateless.negative-cache-duration"),
+			CacheSize:             viper.GetInt("storage.spaces.stateless.cache-size"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to spaces: %s", err.Error())
+		}
+
+		return p, nil
+	case "s3":
+		p, err := s3.New(&s3.Config{
+			Endpoint:    viper.GetString("storage.s3.endpoint"),
+			Region:      viper.GetString("storage.s3.region"),
+			Bucket:      viper.GetString("storage.s3.bucket"),
+			Path:        viper.GetString("storage.s3.path"),
+			PathStyle:   viper.GetBool("storage.s3.path-style"),
+			AccessKey:   viper.GetString("storage.s3.access-key"),
+			SecretKey:   viper.GetString("storage.s3.secret-key"),
+			SSE:         viper.GetString("storage.s3.sse"),
+			SSEKMSKeyID: viper.GetString("storage.s3.sse-kms-key-id"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not set up s3: %s", err.Error())
+		}
+
+		return p, nil
+	case "sql.pg":
+		p, err := postgresql.New(postgresqlConfig())
+		if err == postgresql.ErrOutdatedSchema {
+			return nil, fmt.Errorf("%s, eg with klein db migrate", err.Error())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to postgresql: %s", err.Error())
+		}
+
+		return p, nil
+	case "sql.mysql":
+		p, err := mysql.New(&mysql.Config{
+			Host:     viper.GetString("storage.sql.mysql.host"),
+			Port:     viper.GetInt32("storage.sql.mysql.port"),
+			User:     viper.GetString("storage.sql.mysql.user"),
+			Password: viper.GetString("storage.sql.mysql.password"),
+			Database: viper.GetString("storage.sql.mysql.database"),
+			Table:    viper.GetString("storage.sql.mysql.table"),
+			TLSMode:  viper.GetString("storage.sql.mysql.tls"),
+			TLSCA:    viper.GetString("storage.sql.mysql.tls-ca"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to mysql: %s", err.Error())
+		}
+
+		return p, nil
+	case "sqlite":
+		p, err := sqlite.New(&sqlite.Config{
+			Path:  viper.GetString("storage.sqlite.path"),
+			Table: viper.GetString("storage.sqlite.table"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not open sqlite database: %s", err.Error())
+		}
+
+		return p, nil
+	case "memory":
+		return memory.New(&memory.Config{}), nil
+	case "replicated":
+		drivers := stringSlice("storage.replicated.drivers")
+		if len(drivers) == 0 {
+			return nil, errors.New("You need to provide at least one driver to use the replicated storage backend")
+		}
+
+		c := &replicated.Config{
+			Consistency: replicated.Consistency(viper.GetString("storage.replicated.consistency")),
+			Log:         log.New(os.Stderr, "[replicated] ", log.Ldate|log.Ltime),
+		}
+		index := make(map[string]int)
+		for i, d := range drivers {
+			if d == "replicated" {
+				return nil, errors.New("the replicated storage backend can't replicate to itself")
+			}
+			if _, ok := index[d]; ok {
+				return nil, fmt.Errorf("the %s storage driver is listed twice for replication", d)
+			}
+
+			p, err := newStorageProvider(d)
+			if err != nil {
+				return nil, err
+			}
+			c.Providers = append(c.Providers, p)
+			index[d] = i
+		}
+		for _, d := range stringSlice("storage.replicated.read-order") {
+			i, ok := index[d]
+			if !ok {
+				return nil, fmt.Errorf("the %s storage driver is in the read order but not replicated to", d)
+			}
+			c.ReadOrder = append(c.ReadOrder, i)
+		}
+
+		p, err := replicated.New(c)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up replicated storage: %s", err.Error())
+		}
+
+		return p, nil
+	default:
+		return nil, errors.New("invalid storage driver")
+	}
+}
+
+// stringSlice reads a list option, accepting comma-separated values from
+// environment variables and config files as well as flags
+func stringSlice(key string) []string {
+	var values []string
+	for _, v := range viper.GetStringSlice(key) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+
+	return values
+}
+
+func postgresqlConfig() *postgresql.Config {
+	return &postgresql.Config{
+		Host:     viper.GetString("storage.sql.pg.host"),
+		Port:     viper.GetInt32("storage.sql.pg.port"),
+		User:     viper.GetString("storage.sql.pg.user"),
+		Password: viper.GetString("storage.sql.pg.password"),
+		Database: viper.GetString("storage.sql.pg.database"),
+		Table:    viper.GetString("storage.sql.pg.table"),
+		SSLMode:  viper.GetString("storage.sql.pg.sslmode"),
+
+		DSN:              viper.GetString("storage.sql.pg.dsn"),
+		Schema:           viper.GetString("storage.sql.pg.schema"),
+		MaxOpenConns:     viper.GetInt("storage.sql.pg.max-open-conns"),
+		MaxIdleConns:     viper.GetInt("storage.sql.pg.max-idle-conns"),
+		StatementTimeout: viper.GetDuration("storage.sql.pg.statement-timeout"),
+		Migrate:          viper.GetBool("storage.sql.pg.auto-migrate"),
+	}
+}
+
+// withStorageCache wraps a storage provider in the read-through cache if it is enabled
+func withStorageCache(p storage.Provider, logger *log.Logger) (storage.Provider, error) {
+	size := viper.GetInt("storage.cache.size")
+	redisAddress := viper.GetString("storage.cache.redis.address")
+	if size == 0 && redisAddress == "" {
+		return p, nil
+	}
+
+	c := &cache.Config{
+		Backend:     p,
+		Size:        size,
+		TTL:         viper.GetDuration("storage.cache.ttl"),
+		NegativeTTL: viper.GetDuration("storage.cache.negative-ttl"),
+		Log:         logger,
+	}
+	if redisAddress != "" {
+		c.Redis = &cache.RedisConfig{
+			Address: redisAddress,
+			Auth:    viper.GetString("storage.cache.redis.auth"),
+			DB:      viper.GetInt("storage.cache.redis.db"),
+			Prefix:  viper.GetString("storage.cache.redis.prefix"),
+			TTL:     viper.GetDuration("storage.cache.redis.ttl"),
+
+			PoolSize: viper.GetInt("storage.cache.redis.pool-size"),
+		}
+	}
+
+	cached, err := cache.New(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up storage cache: %s", err.Error())
+	}
+
+	return cached, nil
+}
+
+func newAliasProvider() (alias.Provider, error) {
+	switch viper.GetString("alias.driver") {
+	case "alphanumeric":
+		p, err := alphanumeric.New(&alphanumeric.Config{
+			Length: viper.GetInt("alias.alphanumeric.length"),
+			Alpha:  viper.GetBool("alias.alphanumeric.alpha"),
+			Num:    viper.GetBool("alias.alphanumeric.num"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not select alphanumeric alias: %s", err.Error())
+		}
+
+		return p, nil
+	case "emoji":
+		return emoji.New(&emoji.Config{
+			Length: viper.GetInt("alias.emoji.length"),
+		}), nil
+	case "memorable":
+		return memorable.New(&memorable.Config{
+			Length: viper.GetInt("alias.memorable.length"),
+		}), nil
+	default:
+		return nil, errors.New("invalid alias driver")
+	}
+}
+
+func publicURL() string {
+	u := viper.GetString("url")
+	if u == "" {
+		u = fmt.Sprintf("http://%s/", viper.GetString("listen"))
+	}
+
+	return u
+}
+
+// closeStorage closes storage providers that hold on to files or connections,
+// stops the background work of those that have any and flushes the pending
+// writes of those that buffer them
+func closeStorage(p storage.Provider) error {
+	if closer, ok := p.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kamaln7/klein/server"
+	"github.com/spf13/viper"
+)
+
+// reloader swaps klein's configuration at runtime whenever the process
+// receives a SIGHUP or the config file changes on disk
+type reloader struct {
+	klein    *server.Klein
+	logger   *log.Logger
+	mutex    sync.Mutex
+	settings map[string]string
+}
+
+// restartKeys are config key prefixes that cannot be applied without a restart
+var restartKeys = []string{"listen", "config", "storage."}
+
+func newReloader(k *server.Klein, logger *log.Logger) *reloader {
+	return &reloader{
+		klein:    k,
+		logger:   logger,
+		settings: settingsSnapshot(),
+	}
+}
+
+// Watch listens for SIGHUP and config file changes in the background. Both
+// reread the config file through Reload, which keeps viper from being used
+// by two goroutines at once.
+func (rl *reloader) Watch() {
+	if file := viper.ConfigFileUsed(); file != "" {
+		if err := rl.watchFile(file); err != nil {
+			rl.logger.Printf("reload: could not watch the config file, only reloading on SIGHUP: %s\n", err.Error())
+		}
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			rl.Reload("received SIGHUP")
+		}
+	}()
+}
+
+// watchFile reloads when file changes. The directory is watched rather than
+// the file itself, as editors often save by replacing the file.
+func (rl *reloader) watchFile(file string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					rl.Reload("config file changed")
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				rl.logger.Printf("reload: error watching the config file: %s\n", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reload rereads the config file, if there is one, and swaps in a new
+// configuration built from viper, as long as it is valid and does not
+// attempt to switch storage drivers. Only the providers whose settings
+// changed are rebuilt.
+func (rl *reloader) Reload(reason string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.logger.Printf("reload: %s, reloading config\n", reason)
+
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			rl.logger.Printf("reload: could not read config file, keeping current config: %s\n", err.Error())
+			return
+		}
+	}
+
+	settings := settingsSnapshot()
+	if old, new := rl.settings["storage.driver"], settings["storage.driver"]; old != new {
+		rl.logger.Printf("reload: refusing to switch storage driver from %q to %q while running, keeping current config\n", old, new)
+		return
+	}
+
+	notFoundHTML, err := newNotFoundHTML()
+	if err != nil {
+		rl.logger.Printf("reload: could not read error template, keeping current config: %s\n", err.Error())
+		return
+	}
+
+	current := rl.klein.Config()
+	templateChanged := !bytes.Equal(current.NotFoundHTML, notFoundHTML)
+
+	// settings that need a restart are reported every time, until klein is
+	// restarted, and otherwise left alone
+	var changed []string
+	for _, key := range diffSettings(rl.settings, settings) {
+		if requiresRestart(key) {
+			rl.logger.Printf("reload: %s changed but requires a restart to take effect, ignoring\n", key)
+			continue
+		}
+		changed = append(changed, key)
+	}
+
+	if len(changed) == 0 && !templateChanged {
+		rl.logger.Println("reload: nothing to apply")
+		return
+	}
+
+	c := &server.Config{
+		Alias:        current.Alias,
+		Auth:         current.Auth,
+		Log:          current.Log,
+		NotFoundHTML: notFoundHTML,
+
+		RootURL:   viper.GetString("root"),
+		PublicURL: publicURL(),
+	}
+	if changedPrefix(changed, "auth.", "url") {
+		if c.Auth, err = newAuthProvider(); err != nil {
+			rl.logger.Printf("reload: %s, keeping current config\n", err.Error())
+			return
+		}
+	}
+	if changedPrefix(changed, "alias.") {
+		if c.Alias, err = newAliasProvider(); err != nil {
+			rl.logger.Printf("reload: %s, keeping current config\n", err.Error())
+			return
+		}
+	}
+
+	for _, key := range changed {
+		if isSecret(key) {
+			rl.logger.Printf("reload: %s changed\n", key)
+		} else {
+			rl.logger.Printf("reload: %s changed from %q to %q\n", key, rl.settings[key], settings[key])
+		}
+	}
+	if templateChanged {
+		rl.logger.Println("reload: error template contents changed")
+	}
+
+	rl.klein.Reload(c)
+	for _, key := range changed {
+		if value, ok := settings[key]; ok {
+			rl.settings[key] = value
+		} else {
+			delete(rl.settings, key)
+		}
+	}
+
+	rl.logger.Println("reload: new config is now active")
+}
+
+// changedPrefix reports whether any of the changed keys starts with one of
+// the prefixes
+func changedPrefix(changed []string, prefixes ...string) bool {
+	for _, key := range changed {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// settingsSnapshot flattens the current viper config into comparable strings
+func settingsSnapshot() map[string]string {
+	settings := make(map[string]string)
+	for _, key := range viper.AllKeys() {
+		settings[key] = fmt.Sprint(viper.Get(key))
+	}
+
+	return settings
+}
+
+// diffSettings returns the sorted list of keys whose values differ
+func diffSettings(old, new map[string]string) []string {
+	var changed []string
+	for key, value := range new {
+		if oldValue, ok := old[key]; !ok || oldValue != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+func requiresRestart(key string) bool {
+	for _, prefix := range restartKeys {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecret reports whether a key's value should be kept out of the logs
+func isSecret(key string) bool {
+	for _, word := range []string{"password", "secret", "key", "auth"} {
+		if strings.Contains(key[strings.LastIndex(key, ".")+1:], word) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kamaln7/klein/auth/unauthenticated"
+	"github.com/kamaln7/klein/server"
+	"github.com/kamaln7/klein/storage/memory"
+	"github.com/spf13/viper"
+)
+
+// useConfig points viper at a config file holding contents, and empties it
+// again after the test
+func useConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "klein.yaml")
+	writeConfig(t, path, contents)
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		writeConfig(t, path, "")
+		viper.ReadInConfig()
+	})
+	return path
+}
+
+func writeConfig(t *testing.T, path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	old := map[string]string{"a": "1", "b": "2", "c": "3"}
+	new := map[string]string{"a": "1", "b": "20", "d": "4"}
+
+	if changed := diffSettings(old, new); !reflect.DeepEqual(changed, []string{"b", "c", "d"}) {
+		t.Errorf("expected b, c and d to have changed, got %v", changed)
+	}
+	if changed := diffSettings(old, old); len(changed) != 0 {
+		t.Errorf("expected nothing to have changed, got %v", changed)
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	for key, restart := range map[string]bool{
+		"listen":               true,
+		"config":               true,
+		"storage.driver":       true,
+		"storage.redis.prefix": true,
+		"auth.driver":          false,
+		"alias.length":         false,
+		"root":                 false,
+		"url":                  false,
+	} {
+		if got := requiresRestart(key); got != restart {
+			t.Errorf("requiresRestart(%q) = %v, expected %v", key, got, restart)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := useConfig(t, "root: https://example.com\nauth:\n  driver: none\n")
+
+	var logs bytes.Buffer
+	a := unauthenticated.New(&unauthenticated.Config{})
+	k := server.New(&server.Config{
+		Auth:    a,
+		Storage: memory.New(&memory.Config{}),
+		Log:     log.New(ioutil.Discard, "", 0),
+	})
+	rl := newReloader(k, log.New(&logs, "", 0))
+
+	// providers are only rebuilt if their settings changed
+	writeConfig(t, path, "root: https://example.org\nauth:\n  driver: none\n")
+	rl.Reload("test")
+	if c := k.Config(); c.RootURL != "https://example.org" || c.Auth != a {
+		t.Errorf("expected only the root url to change, got %q and %T", c.RootURL, c.Auth)
+	}
+
+	writeConfig(t, path, "root: https://example.org\nauth:\n  driver: key\n  key: secret\n")
+	rl.Reload("test")
+	if c := k.Config(); c.Auth == a {
+		t.Error("expected the auth provider to be rebuilt")
+	}
+
+	// settings that need a restart are reported on every reload
+	writeConfig(t, path, "root: https://example.org\nauth:\n  driver: key\n  key: secret\nlisten: 0.0.0.0:80\n")
+	logs.Reset()
+	rl.Reload("test")
+	rl.Reload("test")
+	if n := strings.Count(logs.String(), "listen changed but requires a restart"); n != 2 {
+		t.Errorf("expected the restart warning to be logged twice, got:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "nothing to apply") {
+		t.Errorf("expected nothing to be applied, got:\n%s", logs.String())
+	}
+
+	// invalid configs are not applied
+	writeConfig(t, path, "root: https://example.net\nauth:\n  driver: bogus\n")
+	rl.Reload("test")
+	if c := k.Config(); c.RootURL != "https://example.org" {
+		t.Errorf("expected the invalid config not to be applied, got %q", c.RootURL)
+	}
+}
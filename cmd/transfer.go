@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/transfer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	formats := strings.Join(transfer.Formats, ", ")
+
+	exportCmd.Flags().String("format", "jsonl", "export format ("+formats+")")
+	exportCmd.Flags().StringP("output", "o", "-", "file to write the export to, - for stdout")
+	rootCmd.AddCommand(exportCmd)
+
+	importCmd.Flags().String("format", "jsonl", "import format ("+formats+")")
+	importCmd.Flags().String("conflicts", "skip", "what to do with aliases that already exist with a different URL (skip, overwrite)")
+	rootCmd.AddCommand(importCmd)
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export every link from the configured storage driver",
+	Long:  "export every link from the configured storage driver",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// stdout may hold the export, so log to stderr
+		logger := log.New(os.Stderr, "[klein] ", log.Ldate|log.Ltime)
+
+		format, _ := cmd.Flags().GetString("format")
+		output, _ := cmd.Flags().GetString("output")
+
+		n, err := exportLinks(format, output)
+		if err != nil {
+			logger.Fatalf("export failed after %d links: %s\n", n, err.Error())
+		}
+		logger.Printf("exported %d links\n", n)
+	},
+}
+
+// exportLinks writes every link of the configured storage driver to output,
+// or to stdout for -, and returns how many it wrote
+func exportLinks(format, output string) (n int, err error) {
+	storageProvider, err := newStorageProvider(viper.GetString("storage.driver"))
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := closeStorage(storageProvider); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	walker, ok := storageProvider.(storage.Walker)
+	if !ok {
+		return 0, errors.New("the storage driver does not support listing links")
+	}
+
+	var (
+		out io.Writer = os.Stdout
+		f   *os.File
+	)
+	if output != "-" {
+		f, err = os.Create(output)
+		if err != nil {
+			return 0, err
+		}
+		out = f
+	}
+
+	w, err := transfer.NewWriter(format, out)
+	if err == nil {
+		n, err = transfer.Export(walker, w)
+	}
+	if f != nil {
+		// the end of the export may only reach the disk when the file is closed
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return n, err
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "import links into the configured storage driver",
+	Long: `import links into the configured storage driver.
+
+Links are read from the given file, or from stdin if no file or - is given.
+Aliases that already exist with the same URL are skipped.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.New(os.Stderr, "[klein] ", log.Ldate|log.Ltime)
+
+		format, _ := cmd.Flags().GetString("format")
+		conflicts, _ := cmd.Flags().GetString("conflicts")
+
+		input := "-"
+		if len(args) == 1 {
+			input = args[0]
+		}
+
+		res, err := importLinks(format, input, transfer.ConflictPolicy(conflicts))
+		for _, e := range res.Errors {
+			logger.Println(e)
+		}
+		logger.Printf("imported %d links, skipped %d, overwrote %d, %d failed\n", res.Imported, res.Skipped, res.Overwritten, res.Failed)
+		if err != nil {
+			logger.Fatalf("import failed: %s\n", err.Error())
+		}
+		if res.Failed > 0 {
+			logger.Fatalf("%d lines could not be imported\n", res.Failed)
+		}
+	},
+}
+
+// importLinks reads links from input, or from stdin for -, into the
+// configured storage driver. The result is never nil.
+func importLinks(format, input string, policy transfer.ConflictPolicy) (res *transfer.Result, err error) {
+	res = &transfer.Result{}
+
+	var in io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return res, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	r, err := transfer.NewReader(format, in)
+	if err != nil {
+		return res, err
+	}
+
+	storageProvider, err := newStorageProvider(viper.GetString("storage.driver"))
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if cerr := closeStorage(storageProvider); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	return transfer.Import(storageProvider, r, policy)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kamaln7/klein/auth"
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/transfer"
+)
+
+// export streams every link in the requested format
+func (b *Klein) export(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := b.authenticate(c, w, r, auth.ScopeAdmin); !ok {
+		return
+	}
+
+	walker, ok := c.Storage.(storage.Walker)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not support listing links"))
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	tw, err := transfer.NewWriter(format, w)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", transfer.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="klein.%s"`, format))
+
+	n, err := transfer.Export(walker, tw)
+	if err == storage.ErrNotSupported && n == 0 {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not support listing links"))
+		return
+	}
+	if err != nil {
+		// the response has already started, all we can do is log and cut it short
+		c.Log.Printf("export failed after %d links: %s\n", n, err.Error())
+	}
+}
+
+// importLinks reads links in the requested format from the request body
+func (b *Klein) importLinks(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := b.authenticate(c, w, r, auth.ScopeAdmin); !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	policy := transfer.ConflictPolicy(r.URL.Query().Get("conflicts"))
+	if policy == "" {
+		policy = transfer.Skip
+	}
+
+	tr, err := transfer.NewReader(format, r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	res, err := transfer.Import(c.Storage, tr, policy)
+	if err != nil {
+		msg := fmt.Sprintf("import failed after importing %d links: %s", res.Imported+res.Overwritten, err.Error())
+		c.Log.Println(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(msg))
+		return
+	}
+
+	c.Log.Printf("imported %d links, skipped %d, overwrote %d, %d failed\n", res.Imported, res.Skipped, res.Overwritten, res.Failed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// backup streams a copy of the storage driver's data in its own format
+func (b *Klein) backup(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := b.authenticate(c, w, r, auth.ScopeAdmin); !ok {
+		return
+	}
+
+	backuper, ok := c.Storage.(storage.Backuper)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not support backups"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="klein.backup"`)
+
+	n, err := backuper.Backup(w)
+	if err == storage.ErrNotSupported && n == 0 {
+		w.Header().Del("Content-Disposition")
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not support backups"))
+		return
+	}
+	if err != nil {
+		// the response has already started, abort the connection so that
+		// the client can't mistake a partial backup for a complete one
+		c.Log.Printf("backup failed after %d bytes: %s\n", n, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+
+	c.Log.Printf("sent a %d byte backup\n", n)
+}
+
+// invalidate drops an alias from the storage driver's cache on this instance,
+// so that changes made outside of klein are picked up on the next lookup
+func (b *Klein) invalidate(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := b.authenticate(c, w, r, auth.ScopeAdmin); !ok {
+		return
+	}
+
+	alias := r.URL.Query().Get("alias")
+	if alias == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing alias"))
+		return
+	}
+
+	invalidator, ok := c.Storage.(storage.Invalidator)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not cache lookups"))
+		return
+	}
+
+	invalidator.Invalidate(alias)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// counters are updated atomically as requests are handled
+type counters struct {
+	redirects, notFound, created, deleted uint64
+}
+
+// Stats contains usage counters since the server started
+type Stats struct {
+	// Links is the number of stored links, or nil if the storage driver cannot count them
+	Links     *int      `json:"links,omitempty"`
+	Redirects uint64    `json:"redirects"`
+	NotFound  uint64    `json:"not_found"`
+	Created   uint64    `json:"created"`
+	Deleted   uint64    `json:"deleted"`
+	Since     time.Time `json:"since"`
+	// Storage holds the storage driver's own counters, if it keeps any
+	Storage map[string]uint64 `json:"storage,omitempty"`
+}
+
+// Stats returns the server's usage counters
+func (b *Klein) Stats() (*Stats, error) {
+	stats := &Stats{
+		Redirects: atomic.LoadUint64(&b.stats.redirects),
+		NotFound:  atomic.LoadUint64(&b.stats.notFound),
+		Created:   atomic.LoadUint64(&b.stats.created),
+		Deleted:   atomic.LoadUint64(&b.stats.deleted),
+		Since:     b.since,
+	}
+
+	c := b.Config()
+	if counter, ok := c.Storage.(storage.Counter); ok {
+		n, err := counter.Count()
+		switch err {
+		case nil:
+			stats.Links = &n
+		case storage.ErrNotSupported:
+		default:
+			return nil, err
+		}
+	}
+	if reporter, ok := c.Storage.(storage.StatsReporter); ok {
+		stats.Storage = reporter.Stats()
+	}
+
+	return stats, nil
+}
+
+func (b *Klein) statsHandler(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := b.authenticate(c, w, r, auth.ScopeStats); !ok {
+		return
+	}
+
+	stats, err := b.Stats()
+	if err != nil {
+		c.Log.Printf("could not count links: %s\n", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kamaln7/klein/alias/alphanumeric"
+	"github.com/kamaln7/klein/auth/unauthenticated"
+	"github.com/kamaln7/klein/storage/memory"
+)
+
+const benchLinks = 1000
+
+func newBenchServer(b *testing.B) *Klein {
+	aliasProvider, err := alphanumeric.New(&alphanumeric.Config{
+		Length: 10,
+		Alpha:  true,
+		Num:    true,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	storage := memory.New(&memory.Config{})
+	for i := 0; i < benchLinks; i++ {
+		storage.Store("http://example.com/"+strconv.Itoa(i), "bench-"+strconv.Itoa(i))
+	}
+
+	return New(&Config{
+		Alias:        aliasProvider,
+		Auth:         unauthenticated.New(&unauthenticated.Config{}),
+		Storage:      storage,
+		Log:          log.New(ioutil.Discard, "", 0),
+		NotFoundHTML: []byte("404 not found"),
+		PublicURL:    "http://example.com",
+	})
+}
+
+// serve runs a request through the whole handler, the way the HTTP server
+// would. It doesn't stop the benchmark on failure, as it's called from
+// RunParallel's goroutines.
+func serve(b *testing.B, k *Klein, r *http.Request, status int) {
+	w := httptest.NewRecorder()
+	k.ServeHTTP(w, r)
+
+	if w.Code != status {
+		b.Errorf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+}
+
+func BenchmarkRedirect(b *testing.B) {
+	k := newBenchServer(b)
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			serve(b, k, httptest.NewRequest("GET", "/bench-"+strconv.Itoa(i%benchLinks), nil), http.StatusFound)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				serve(b, k, httptest.NewRequest("GET", "/bench-"+strconv.Itoa(i%benchLinks), nil), http.StatusFound)
+			}
+		})
+	})
+}
+
+func BenchmarkCreate(b *testing.B) {
+	k := newBenchServer(b)
+	body := url.Values{"url": {"http://example.com/new"}}.Encode()
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			serve(b, k, newRequest(), http.StatusCreated)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				serve(b, k, newRequest(), http.StatusCreated)
+			}
+		})
+	})
+}
+
+// BenchmarkHTTP goes through a real listener and HTTP client, to include the cost of the network stack
+func BenchmarkHTTP(b *testing.B) {
+	ts := httptest.NewServer(newBenchServer(b))
+	defer ts.Close()
+
+	c := ts.Client()
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	c.Transport.(*http.Transport).MaxIdleConnsPerHost = 100
+
+	b.Run("redirect", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				res, err := c.Get(ts.URL + "/bench-" + strconv.Itoa(i%benchLinks))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode != http.StatusFound {
+					b.Errorf("expected status %d, got %d", http.StatusFound, res.StatusCode)
+				}
+			}
+		})
+	})
+
+	b.Run("create", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				res, err := c.PostForm(ts.URL+"/", url.Values{"url": {"http://example.com/new"}})
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode != http.StatusCreated {
+					b.Errorf("expected status %d, got %d", http.StatusCreated, res.StatusCode)
+				}
+			}
+		})
+	})
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kamaln7/klein/alias"
 	"github.com/kamaln7/klein/auth"
@@ -12,8 +16,13 @@ import (
 
 // Klein is a URL shortener
 type Klein struct {
-	Config *Config
+	stats  counters     // first for 64-bit alignment of the atomic counters
+	config atomic.Value // *Config
 	mux    *http.ServeMux
+	since  time.Time
+
+	mutex  sync.Mutex
+	server *http.Server
 }
 
 // Config contains the necessary configuration to run the URL shortener
@@ -31,51 +40,115 @@ type Config struct {
 func New(c *Config) *Klein {
 	c.PublicURL = strings.TrimRight(c.PublicURL, "/") + "/"
 
-	return &Klein{
-		Config: c,
+	k := &Klein{
+		mux:   http.NewServeMux(),
+		since: time.Now(),
 	}
+	k.config.Store(c)
+
+	k.mux.HandleFunc("/", k.httpHandler)
+	k.mux.HandleFunc("/_admin/export", k.export)
+	k.mux.HandleFunc("/_admin/import", k.importLinks)
+	k.mux.HandleFunc("/_admin/stats", k.statsHandler)
+	k.mux.HandleFunc("/_admin/backup", k.backup)
+	k.mux.HandleFunc("/_admin/invalidate", k.invalidate)
+	k.mux.HandleFunc("/_auth/", k.authHandler)
+
+	return k
+}
+
+// Config returns the configuration that is currently in use
+func (b *Klein) Config() *Config {
+	return b.config.Load().(*Config)
+}
+
+// Reload atomically replaces the running configuration. Requests that are
+// already being handled keep using the configuration they started with.
+// The storage backend and listen address cannot be changed while running,
+// so they are always carried over from the current configuration.
+func (b *Klein) Reload(c *Config) {
+	old := b.Config()
+
+	c.PublicURL = strings.TrimRight(c.PublicURL, "/") + "/"
+	c.Storage = old.Storage
+	c.ListenAddr = old.ListenAddr
+	if c.Log == nil {
+		c.Log = old.Log
+	}
+
+	b.config.Store(c)
 }
 
-// Serve starts Klein's HTTP server
+// Serve starts Klein's HTTP server and returns once Shutdown is called
 func (b *Klein) Serve() {
-	b.mux = http.NewServeMux()
-	b.mux.HandleFunc("/", b.httpHandler)
+	c := b.Config()
 
-	b.Config.Log.Printf("listening on %s\n", b.Config.ListenAddr)
-	if err := http.ListenAndServe(b.Config.ListenAddr, b.mux); err != nil {
-		b.Config.Log.Fatal(err)
+	server := &http.Server{Addr: c.ListenAddr, Handler: b}
+	b.mutex.Lock()
+	b.server = server
+	b.mutex.Unlock()
+
+	c.Log.Printf("listening on %s\n", c.ListenAddr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		c.Log.Fatal(err)
+	}
+}
+
+// Shutdown stops the HTTP server, waiting for requests in flight to finish
+// until ctx is done
+func (b *Klein) Shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	server := b.server
+	b.mutex.Unlock()
+
+	if server == nil {
+		return nil
 	}
+
+	return server.Shutdown(ctx)
+}
+
+// ServeHTTP handles requests to klein
+func (b *Klein) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mux.ServeHTTP(w, r)
 }
 
 func (b *Klein) httpHandler(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
 	path := r.URL.Path
 
 	// root redirect & upload handlers
 	if path == "/" {
 		switch r.Method {
 		case "GET":
-			if b.Config.RootURL != "" {
-				http.Redirect(w, r, b.Config.RootURL, 302)
+			if c.RootURL != "" {
+				http.Redirect(w, r, c.RootURL, 302)
 			} else {
-				b.notFound(w, r)
+				b.notFound(c, w, r)
 			}
 		case "POST":
-			b.create(w, r)
+			b.create(c, w, r)
 		}
 
 		return
 	}
 
-	b.redirect(w, r, path[1:])
+	if r.Method == "DELETE" {
+		b.delete(c, w, r, path[1:])
+		return
+	}
+
+	b.redirect(c, w, r, path[1:])
 }
 
-func (b *Klein) redirect(w http.ResponseWriter, r *http.Request, alias string) {
-	url, err := b.Config.Storage.Get(alias)
+func (b *Klein) redirect(c *Config, w http.ResponseWriter, r *http.Request, alias string) {
+	url, err := c.Storage.Get(alias)
 
 	switch err {
 	case nil:
 	case storage.ErrNotFound:
-		b.notFound(w, r)
+		atomic.AddUint64(&b.stats.notFound, 1)
+		b.notFound(c, w, r)
 		return
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
@@ -83,26 +156,19 @@ func (b *Klein) redirect(w http.ResponseWriter, r *http.Request, alias string) {
 		return
 	}
 
+	atomic.AddUint64(&b.stats.redirects, 1)
 	http.Redirect(w, r, url, 302)
 }
 
-func (b *Klein) create(w http.ResponseWriter, r *http.Request) {
+func (b *Klein) create(c *Config, w http.ResponseWriter, r *http.Request) {
 	var (
 		err error
 		url = r.FormValue("url")
 	)
 
 	// authenticate
-	authed, err := b.Config.Auth.Authenticate(w, r)
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error"))
-		return
-	}
-	if !authed {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("unauthenticated"))
+	principal, ok := b.authenticate(c, w, r, auth.ScopeCreate)
+	if !ok {
 		return
 	}
 
@@ -118,8 +184,8 @@ func (b *Klein) create(w http.ResponseWriter, r *http.Request) {
 	if alias == "" {
 		exists := true
 		for exists {
-			alias = b.Config.Alias.Generate()
-			exists, err = b.Config.Storage.Exists(alias)
+			alias = c.Alias.Generate()
+			exists, err = c.Storage.Exists(alias)
 
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
@@ -128,7 +194,7 @@ func (b *Klein) create(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	} else {
-		exists, err := b.Config.Storage.Exists(alias)
+		exists, err := c.Storage.Exists(alias)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("error"))
@@ -142,18 +208,125 @@ func (b *Klein) create(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// store the URL
-	err = b.Config.Storage.Store(url, alias)
+	// store the URL, along with who created it if possible
+	if recorder, ok := c.Storage.(storage.CreatorRecorder); ok && principal != nil && principal.Name != "" {
+		err = recorder.StoreCreatedBy(url, alias, principal.Name)
+	} else {
+		err = c.Storage.Store(url, alias)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	atomic.AddUint64(&b.stats.created, 1)
+	if principal != nil && principal.Name != "" {
+		c.Log.Printf("%s created %s\n", principal.Name, alias)
+	}
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(b.Config.PublicURL + alias))
+	w.Write([]byte(c.PublicURL + alias))
+}
+
+func (b *Klein) delete(c *Config, w http.ResponseWriter, r *http.Request, alias string) {
+	principal, ok := b.authenticate(c, w, r, auth.ScopeDelete)
+	if !ok {
+		return
+	}
+
+	deleter, ok := c.Storage.(storage.Deleter)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not support deleting links"))
+		return
+	}
+
+	err := deleter.Delete(alias)
+	switch err {
+	case nil:
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+		return
+	case storage.ErrNotSupported:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage driver does not support deleting links"))
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("error"))
+		return
+	}
+
+	atomic.AddUint64(&b.stats.deleted, 1)
+	if principal != nil && principal.Name != "" {
+		c.Log.Printf("%s deleted %s\n", principal.Name, alias)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authHandler passes requests to the auth provider's own endpoints, if it
+// has any
+func (b *Klein) authHandler(w http.ResponseWriter, r *http.Request) {
+	c := b.Config()
+
+	handler, ok := c.Auth.(auth.Handler)
+	if !ok {
+		b.notFound(c, w, r)
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// authenticate checks the request's credentials and writes an error
+// response if they are missing or invalid. Auth providers that identify
+// requests also have to have granted scope, and the principal they return is
+// passed on. Other providers can't grant scopes, so they only allow creating
+// links, and the principal is nil.
+func (b *Klein) authenticate(c *Config, w http.ResponseWriter, r *http.Request, scope auth.Scope) (*auth.Principal, bool) {
+	if identifier, ok := c.Auth.(auth.Identifier); ok {
+		principal, err := identifier.Identify(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("error"))
+			return nil, false
+		}
+		if principal == nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("unauthenticated"))
+			return nil, false
+		}
+		if !principal.Can(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("missing scope " + string(scope)))
+			return nil, false
+		}
+
+		return principal, true
+	}
+
+	authed, err := c.Auth.Authenticate(w, r)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("error"))
+		return nil, false
+	}
+	if !authed {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("unauthenticated"))
+		return nil, false
+	}
+	if scope != auth.ScopeCreate {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("missing scope " + string(scope)))
+		return nil, false
+	}
+
+	return nil, true
 }
 
-func (b *Klein) notFound(w http.ResponseWriter, r *http.Request) {
+func (b *Klein) notFound(c *Config, w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
-	w.Write(b.Config.NotFoundHTML)
+	w.Write(c.NotFoundHTML)
 }
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/kamaln7/klein/alias/alphanumeric"
+	"github.com/kamaln7/klein/auth"
+	"github.com/kamaln7/klein/auth/apikeys"
+	"github.com/kamaln7/klein/auth/httpbasic"
+	"github.com/kamaln7/klein/auth/jwt"
+	"github.com/kamaln7/klein/auth/proxy"
+	"github.com/kamaln7/klein/auth/unauthenticated"
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/bolt"
+	"github.com/kamaln7/klein/storage/memory"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newServer(t *testing.T, a auth.Provider, s storage.Provider) *Klein {
+	aliasProvider, err := alphanumeric.New(&alphanumeric.Config{
+		Length: 5,
+		Alpha:  true,
+		Num:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(&Config{
+		Alias:        aliasProvider,
+		Auth:         a,
+		Storage:      s,
+		Log:          log.New(ioutil.Discard, "", 0),
+		NotFoundHTML: []byte("404 not found"),
+		PublicURL:    "http://example.com",
+	})
+}
+
+// do runs a request through the whole handler, the way the HTTP server would
+func do(k *Klein, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	k.ServeHTTP(w, r)
+
+	return w
+}
+
+func newCreateRequest(link, alias string) *http.Request {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"url": {link}, "alias": {alias}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return r
+}
+
+// scopedRequests returns a request that needs each scope
+func scopedRequests() []struct {
+	scope auth.Scope
+	r     *http.Request
+} {
+	return []struct {
+		scope auth.Scope
+		r     *http.Request
+	}{
+		{auth.ScopeCreate, newCreateRequest("http://example.com", "")},
+		{auth.ScopeDelete, httptest.NewRequest("DELETE", "/example", nil)},
+		{auth.ScopeAdmin, httptest.NewRequest("GET", "/_admin/export", nil)},
+		{auth.ScopeAdmin, httptest.NewRequest("POST", "/_admin/import", strings.NewReader(""))},
+		{auth.ScopeAdmin, httptest.NewRequest("GET", "/_admin/backup", nil)},
+		{auth.ScopeAdmin, httptest.NewRequest("POST", "/_admin/invalidate?alias=example", nil)},
+		{auth.ScopeStats, httptest.NewRequest("GET", "/_admin/stats", nil)},
+	}
+}
+
+func TestScopes(t *testing.T) {
+	for _, granted := range auth.Scopes {
+		k := newServer(t, unauthenticated.New(&unauthenticated.Config{Scopes: []auth.Scope{granted}}), memory.New(&memory.Config{}))
+
+		for _, req := range scopedRequests() {
+			w := do(k, req.r)
+
+			if req.scope == granted && w.Code == http.StatusForbidden {
+				t.Errorf("expected %s %s to be allowed with the %s scope, got %s", req.r.Method, req.r.URL.Path, granted, w.Body.String())
+			}
+			if req.scope != granted && (w.Code != http.StatusForbidden || w.Body.String() != "missing scope "+string(req.scope)) {
+				t.Errorf("expected %s %s to need the %s scope, got %d: %s", req.r.Method, req.r.URL.Path, req.scope, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	_, token, err := apikeys.Create(path, "ci", []auth.Scope{auth.ScopeCreate}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := apikeys.New(&apikeys.Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newServer(t, a, memory.New(&memory.Config{}))
+
+	for _, req := range scopedRequests() {
+		req.r.Header.Set("Authorization", "Bearer "+token)
+		w := do(k, req.r)
+
+		if req.scope == auth.ScopeCreate && w.Code != http.StatusCreated {
+			t.Errorf("expected the key to create links, got %d: %s", w.Code, w.Body.String())
+		}
+		if req.scope != auth.ScopeCreate && (w.Code != http.StatusForbidden || w.Body.String() != "missing scope "+string(req.scope)) {
+			t.Errorf("expected %s %s to need the %s scope, got %d: %s", req.r.Method, req.r.URL.Path, req.scope, w.Code, w.Body.String())
+		}
+	}
+
+	// keys are only read from the Authorization header
+	r := newCreateRequest("http://example.com", "")
+	r.URL.RawQuery = url.Values{"key": {token}}.Encode()
+	if w := do(k, r); w.Code != http.StatusForbidden || w.Body.String() != "unauthenticated" {
+		t.Errorf("expected a key in the query string to be ignored, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// authenticator lets every request through without saying who made it
+type authenticator struct{}
+
+func (authenticator) Authenticate(w http.ResponseWriter, r *http.Request) (bool, error) {
+	return true, nil
+}
+
+func TestScopesWithoutIdentifier(t *testing.T) {
+	k := newServer(t, authenticator{}, memory.New(&memory.Config{}))
+
+	for _, req := range scopedRequests() {
+		w := do(k, req.r)
+
+		if req.scope == auth.ScopeCreate && w.Code != http.StatusCreated {
+			t.Errorf("expected auth drivers that can't grant scopes to allow creating links, got %d: %s", w.Code, w.Body.String())
+		}
+		if req.scope != auth.ScopeCreate && w.Code != http.StatusForbidden {
+			t.Errorf("expected %s %s to be refused, got %d", req.r.Method, req.r.URL.Path, w.Code)
+		}
+	}
+}
+
+// invalidator records the aliases it is asked to drop from its cache
+type invalidator struct {
+	*memory.Provider
+	invalidated []string
+}
+
+func (i *invalidator) Invalidate(alias string) {
+	i.invalidated = append(i.invalidated, alias)
+}
+
+func TestInvalidate(t *testing.T) {
+	a := unauthenticated.New(&unauthenticated.Config{Scopes: auth.Scopes})
+	s := &invalidator{Provider: memory.New(&memory.Config{})}
+	k := newServer(t, a, s)
+
+	if w := do(k, httptest.NewRequest("POST", "/_admin/invalidate?alias=example", nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(s.invalidated) != 1 || s.invalidated[0] != "example" {
+		t.Errorf("expected example to be invalidated, got %v", s.invalidated)
+	}
+
+	if w := do(k, httptest.NewRequest("POST", "/_admin/invalidate", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a missing alias to be refused, got %d", w.Code)
+	}
+
+	k = newServer(t, a, memory.New(&memory.Config{}))
+	if w := do(k, httptest.NewRequest("POST", "/_admin/invalidate?alias=example", nil)); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected drivers without a cache to respond with 501, got %d", w.Code)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	a := unauthenticated.New(&unauthenticated.Config{Scopes: auth.Scopes})
+	s, err := bolt.New(&bolt.Config{Path: filepath.Join(t.TempDir(), "klein.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	k := newServer(t, a, s)
+
+	if w := do(k, newCreateRequest("http://example.com", "example")); w.Code != http.StatusCreated {
+		t.Fatalf("couldn't create a link, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := do(k, httptest.NewRequest("GET", "/_admin/backup", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") == "" {
+		t.Fatalf("expected a backup to download, got %d: %s", w.Code, w.Body.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if err := ioutil.WriteFile(path, w.Body.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := bolt.New(&bolt.Config{Path: path})
+	if err != nil {
+		t.Fatalf("couldn't open the backup: %v", err)
+	}
+	defer restored.Close()
+	if url, err := restored.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the backup to hold the link, got %q (%v)", url, err)
+	}
+
+	k = newServer(t, a, memory.New(&memory.Config{}))
+	if w := do(k, httptest.NewRequest("GET", "/_admin/backup", nil)); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected drivers without backups to respond with 501, got %d", w.Code)
+	}
+}
+
+func TestCreatedBy(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte(fmt.Sprintf("alice:%s\n", hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := httpbasic.New(&httpbasic.Config{File: htpasswd})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := bolt.New(&bolt.Config{Path: filepath.Join(t.TempDir(), "klein.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	k := newServer(t, a, s)
+
+	r := newCreateRequest("http://example.com", "example")
+	r.SetBasicAuth("alice", "secret")
+	if w := do(k, r); w.Code != http.StatusCreated {
+		t.Fatalf("couldn't create a link, got %d: %s", w.Code, w.Body.String())
+	}
+
+	meta, err := s.Meta("example")
+	if err != nil || meta.CreatedBy != "alice" {
+		t.Errorf("expected the link to be recorded as created by alice, got %+v (%v)", meta, err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	secret := "a shared secret that is long enough for HS256"
+	a, err := jwt.New(&jwt.Config{Secret: secret, Issuer: "https://id.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := bolt.New(&bolt.Config{Path: filepath.Join(t.TempDir(), "klein.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	k := newServer(t, a, s)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(secret)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+		"iss":   "https://id.example.com",
+		"sub":   "ci",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "create",
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newCreateRequest("http://example.com", "example")
+	r.Header.Set("Authorization", "Bearer "+token)
+	if w := do(k, r); w.Code != http.StatusCreated {
+		t.Fatalf("couldn't create a link, got %d: %s", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("DELETE", "/example", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if w := do(k, r); w.Code != http.StatusForbidden || w.Body.String() != "missing scope delete" {
+		t.Errorf("expected deleting to need the delete scope, got %d: %s", w.Code, w.Body.String())
+	}
+
+	meta, err := s.Meta("example")
+	if err != nil || meta.CreatedBy != "ci" {
+		t.Errorf("expected the link to be recorded as created by ci, got %+v (%v)", meta, err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	a, err := proxy.New(&proxy.Config{
+		// where httptest requests come from
+		Proxies: []string{"192.0.2.0/24"},
+		Secret:  "proxy secret",
+		Scopes:  []auth.Scope{auth.ScopeCreate, auth.ScopeDelete},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := bolt.New(&bolt.Config{Path: filepath.Join(t.TempDir(), "klein.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var logs bytes.Buffer
+	k := newServer(t, a, s)
+	c := *k.Config()
+	c.Log = log.New(&logs, "", 0)
+	k.Reload(&c)
+
+	headers := map[string]string{
+		"X-Forwarded-User":     "1234",
+		"X-Forwarded-Email":    "alice@example.com",
+		"X-Klein-Proxy-Secret": "proxy secret",
+	}
+	r := newCreateRequest("http://example.com", "example")
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	if w := do(k, r); w.Code != http.StatusCreated {
+		t.Fatalf("couldn't create a link, got %d: %s", w.Code, w.Body.String())
+	}
+	if meta, err := s.Meta("example"); err != nil || meta.CreatedBy != "alice@example.com" {
+		t.Errorf("expected the link to be recorded as created by alice, got %+v (%v)", meta, err)
+	}
+
+	r = httptest.NewRequest("DELETE", "/example", nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	if w := do(k, r); w.Code != http.StatusNoContent {
+		t.Fatalf("couldn't delete the link, got %d: %s", w.Code, w.Body.String())
+	}
+	if expected := "alice@example.com created example\nalice@example.com deleted example\n"; logs.String() != expected {
+		t.Errorf("expected the changes to be logged, got %q", logs.String())
+	}
+
+	// without the secret, the identity headers aren't trusted
+	r = newCreateRequest("http://example.com", "")
+	r.Header.Set("X-Forwarded-User", "mallory")
+	if w := do(k, r); w.Code != http.StatusForbidden || w.Body.String() != "unauthenticated" {
+		t.Errorf("expected the request to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,99 @@
+package badger
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/bolt"
+	"github.com/kamaln7/klein/storage/file"
+)
+
+// backends returns the embedded backends to compare. bolt and file always
+// sync to disk, so badger is benchmarked both ways.
+func backends(b *testing.B) map[string]func(b *testing.B) storage.Provider {
+	return map[string]func(b *testing.B) storage.Provider{
+		"badger": func(b *testing.B) storage.Provider {
+			return newProvider(b, &Config{Path: b.TempDir()})
+		},
+		"badger-sync": func(b *testing.B) storage.Provider {
+			return newProvider(b, &Config{Path: b.TempDir(), SyncWrites: true})
+		},
+		"bolt": func(b *testing.B) storage.Provider {
+			p, err := bolt.New(&bolt.Config{Path: filepath.Join(b.TempDir(), "klein.db")})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { p.Close() })
+
+			return p
+		},
+		"file": func(b *testing.B) storage.Provider {
+			p, err := file.New(&file.Config{Path: b.TempDir(), Layout: file.LayoutSharded})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			return p
+		},
+	}
+}
+
+func BenchmarkStore(b *testing.B) {
+	for name, open := range backends(b) {
+		b.Run(name, func(b *testing.B) {
+			p := open(b)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := p.Store("http://example.com", "alias"+strconv.Itoa(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStoreParallel stores from many goroutines at once, like batch jobs do
+func BenchmarkStoreParallel(b *testing.B) {
+	for name, open := range backends(b) {
+		b.Run(name, func(b *testing.B) {
+			p := open(b)
+			var n int64
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					alias := "alias" + strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+					if err := p.Store("http://example.com", alias); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	const links = 1000
+
+	for name, open := range backends(b) {
+		b.Run(name, func(b *testing.B) {
+			p := open(b)
+			for i := 0; i < links; i++ {
+				if err := p.Store("http://example.com", "alias"+strconv.Itoa(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Get("alias" + strconv.Itoa(i%links)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
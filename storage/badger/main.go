@@ -0,0 +1,287 @@
+package badger
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kamaln7/klein/storage"
+)
+
+// Provider implements a storage system backed by an embedded BadgerDB
+// database, which handles many concurrent writers better than bolt
+type Provider struct {
+	Config *Config
+	db     *badger.DB
+	done   chan struct{}
+	gcDone chan struct{}
+	close  sync.Once
+}
+
+// Config contains the configuration for the badger storage
+type Config struct {
+	// Path is the directory holding the database
+	Path string
+	// TTL expires links this long after they are created. 0 keeps them forever
+	TTL time.Duration
+	// GCInterval is how often to reclaim space in the value log, defaults to 5 minutes
+	GCInterval time.Duration
+	// GCDiscardRatio is the share of a value log file that must be stale
+	// for it to be rewritten, defaults to 0.5
+	GCDiscardRatio float64
+	// SyncWrites waits for every write to reach the disk, which is safer
+	// but much slower
+	SyncWrites bool
+	// InMemory keeps the whole database in memory and ignores Path
+	InMemory bool
+	// Log receives badger's warnings and errors, if set
+	Log *log.Logger
+}
+
+// ensure that the storage.Walker, storage.Deleter, storage.Counter and storage.Backuper interfaces are implemented
+var (
+	_ storage.Walker   = new(Provider)
+	_ storage.Deleter  = new(Provider)
+	_ storage.Counter  = new(Provider)
+	_ storage.Backuper = new(Provider)
+)
+
+// New opens the database and starts collecting value log garbage in the background
+func New(c *Config) (*Provider, error) {
+	if c.GCInterval == 0 {
+		c.GCInterval = 5 * time.Minute
+	}
+	if c.GCDiscardRatio == 0 {
+		c.GCDiscardRatio = 0.5
+	}
+	if c.GCDiscardRatio <= 0 || c.GCDiscardRatio >= 1 {
+		return nil, errors.New("badger gc discard ratio must be between 0 and 1")
+	}
+
+	opts := badger.DefaultOptions(c.Path).
+		WithSyncWrites(c.SyncWrites).
+		WithLogger(&logger{c.Log})
+	if c.InMemory {
+		opts = opts.WithDir("").WithValueDir("").WithInMemory(true)
+	}
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		Config: c,
+		db:     db,
+		done:   make(chan struct{}),
+		gcDone: make(chan struct{}),
+	}
+	go p.gc()
+
+	return p, nil
+}
+
+// Get attempts to find a URL by its alias and returns its original URL
+func (p *Provider) Get(alias string) (string, error) {
+	var url []byte
+
+	err := p.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(alias))
+		// badger refuses empty keys, which can't have been stored either
+		if err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		url, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(url)), nil
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	_, err := p.Get(alias)
+
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Store creates a new short URL, which expires after Config.TTL if set
+func (p *Provider) Store(url, alias string) error {
+	err := p.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(alias))
+		if err == nil {
+			return storage.ErrAlreadyExists
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		e := badger.NewEntry([]byte(alias), bytes.TrimSpace([]byte(url)))
+		if p.Config.TTL > 0 {
+			e = e.WithTTL(p.Config.TTL)
+		}
+
+		return txn.SetEntry(e)
+	})
+
+	// another transaction stored the same alias after this one checked for it
+	if err == badger.ErrConflict {
+		return storage.ErrAlreadyExists
+	}
+
+	return err
+}
+
+// Walk calls fn for every stored URL that hasn't expired
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	return p.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			url, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if err := fn(string(item.Key()), string(bytes.TrimSpace(url))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	return p.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(alias))
+		if err == badger.ErrKeyNotFound || err == badger.ErrEmptyKey {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		return txn.Delete([]byte(alias))
+	})
+}
+
+// Count returns the number of stored URLs that haven't expired. badger
+// doesn't keep a count, so this iterates over the keys without reading values.
+func (p *Provider) Count() (int, error) {
+	n := 0
+	err := p.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// Backup writes a full backup in badger's backup format to w, which can be
+// restored into an empty database with badger's DB.Load
+func (p *Provider) Backup(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	_, err := p.db.Backup(cw, 0)
+
+	return cw.n, err
+}
+
+// Close stops collecting garbage and closes the database. Closing more than once is a no-op
+func (p *Provider) Close() (err error) {
+	p.close.Do(func() {
+		close(p.done)
+		<-p.gcDone
+
+		err = p.db.Close()
+	})
+
+	return err
+}
+
+// gc rewrites value log files with enough stale entries, from deleted and
+// expired links, every Config.GCInterval until the provider is closed
+func (p *Provider) gc() {
+	defer close(p.gcDone)
+
+	ticker := time.NewTicker(p.Config.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		// each run rewrites at most one file, keep going until there is nothing left to do
+		for {
+			err := p.db.RunValueLogGC(p.Config.GCDiscardRatio)
+			if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+				break
+			}
+			if err != nil {
+				if p.Config.Log != nil {
+					p.Config.Log.Printf("badger value log gc failed: %s\n", err.Error())
+				}
+				break
+			}
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+
+	return n, err
+}
+
+// logger passes badger's warnings and errors on to a log.Logger and drops the rest
+type logger struct {
+	log *log.Logger
+}
+
+func (l *logger) Errorf(format string, v ...interface{}) {
+	if l.log != nil {
+		l.log.Printf("badger: "+format, v...)
+	}
+}
+
+func (l *logger) Warningf(format string, v ...interface{}) {
+	l.Errorf(format, v...)
+}
+
+func (l *logger) Infof(string, ...interface{})  {}
+func (l *logger) Debugf(string, ...interface{}) {}
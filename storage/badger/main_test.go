@@ -0,0 +1,159 @@
+package badger
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+func newProvider(t testing.TB, c *Config) *Provider {
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't open badger database: %v\n", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	p := newProvider(t, &Config{
+		Path: t.TempDir(),
+	})
+
+	storagetest.RunTests(p, t)
+}
+
+func TestInMemory(t *testing.T) {
+	storagetest.RunBasicTests(newProvider(t, &Config{InMemory: true}), t)
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	p := newProvider(t, &Config{Path: dir})
+	p.Store("http://example.com", "example")
+	p.Close()
+
+	p, err := New(&Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't reopen the database: %v", err)
+	}
+	defer p.Close()
+	if url, err := p.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the link to be persisted, got %q, %v", url, err)
+	}
+}
+
+func TestEmptyAlias(t *testing.T) {
+	p := newProvider(t, &Config{InMemory: true})
+
+	if _, err := p.Get(""); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound looking up an empty alias, got %v", err)
+	}
+	if exists, err := p.Exists(""); err != nil || exists {
+		t.Errorf("expected an empty alias not to exist, got %v, %v", exists, err)
+	}
+	if err := p.Delete(""); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound deleting an empty alias, got %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	p := newProvider(t, &Config{InMemory: true, TTL: time.Second})
+
+	p.Store("http://example.com", "example")
+	if _, err := p.Get("example"); err != nil {
+		t.Fatalf("expected the link to exist before it expires, got %v", err)
+	}
+
+	// badger's TTLs have a resolution of a second
+	time.Sleep(2 * time.Second)
+	if _, err := p.Get("example"); err != storage.ErrNotFound {
+		t.Errorf("expected the link to expire, got %v", err)
+	}
+	if n, _ := p.Count(); n != 0 {
+		t.Errorf("expected expired links not to be counted, got %d", n)
+	}
+	if err := p.Store("http://example.com/new", "example"); err != nil {
+		t.Errorf("expected the alias to be free again, got %v", err)
+	}
+}
+
+func TestConcurrentStore(t *testing.T) {
+	p := newProvider(t, &Config{InMemory: true})
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		stored int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := p.Store("http://example.com/"+strconv.Itoa(i), "example")
+			switch err {
+			case nil:
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			case storage.ErrAlreadyExists:
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stored != 1 {
+		t.Errorf("expected exactly one store to win, got %d", stored)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	p := newProvider(t, &Config{InMemory: true})
+	for i := 0; i < 10; i++ {
+		p.Store("http://example.com/"+strconv.Itoa(i), "alias"+strconv.Itoa(i))
+	}
+
+	var buf bytes.Buffer
+	n, err := p.Backup(&buf)
+	if err != nil || n != int64(buf.Len()) || n == 0 {
+		t.Fatalf("couldn't back up: %d, %v", n, err)
+	}
+
+	restored := newProvider(t, &Config{InMemory: true})
+	if err := restored.db.Load(&buf, 16); err != nil {
+		t.Fatalf("couldn't load the backup: %v", err)
+	}
+	if count, _ := restored.Count(); count != 10 {
+		t.Errorf("expected 10 restored links, got %d", count)
+	}
+}
+
+func TestGC(t *testing.T) {
+	p := newProvider(t, &Config{Path: t.TempDir(), GCInterval: 10 * time.Millisecond})
+
+	// let the collector run a few times on an empty database
+	time.Sleep(50 * time.Millisecond)
+	if err := p.db.RunValueLogGC(0.5); err != badger.ErrNoRewrite && err != badger.ErrRejected {
+		t.Errorf("expected nothing left to collect, got %v", err)
+	}
+
+	if _, err := New(&Config{InMemory: true, GCDiscardRatio: 1}); err == nil {
+		t.Errorf("expected a discard ratio of 1 to be rejected")
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		return newProvider(b, &Config{Path: b.TempDir()})
+	}, b)
+}
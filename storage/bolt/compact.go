@@ -0,0 +1,132 @@
+package bolt
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxSize is roughly how many bytes are copied per write transaction while compacting
+const compactTxSize = 1 << 20
+
+// Compact copies every bucket of the database at src into a new database at
+// dst, leaving out the free pages that bolt never returns to the filesystem.
+// src must not be in use by a running klein, dst must not exist yet.
+func Compact(dst, src string, timeout time.Duration) error {
+	if _, err := os.Stat(dst); err == nil {
+		return errors.New(dst + " already exists")
+	}
+
+	from, err := bolt.Open(src, 0600, &bolt.Options{Timeout: timeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return err
+	}
+	c := &compactor{db: to}
+
+	err = from.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return c.copyBucket([][]byte{clone(name)}, b)
+		})
+	})
+	if err == nil {
+		err = c.commit()
+	} else if c.tx != nil {
+		c.tx.Rollback()
+	}
+	if cerr := to.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
+
+// compactor writes into the destination database in batches, so that large
+// databases don't have to fit into a single transaction
+type compactor struct {
+	db   *bolt.DB
+	tx   *bolt.Tx
+	size int
+}
+
+func (c *compactor) copyBucket(path [][]byte, b *bolt.Bucket) error {
+	// create the bucket even if it is empty
+	if _, err := c.bucket(path); err != nil {
+		return err
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return c.copyBucket(append(path[:len(path):len(path)], clone(k)), b.Bucket(k))
+		}
+
+		return c.put(path, k, v)
+	})
+}
+
+func (c *compactor) put(path [][]byte, k, v []byte) error {
+	if c.size+len(k)+len(v) > compactTxSize {
+		if err := c.commit(); err != nil {
+			return err
+		}
+	}
+
+	b, err := c.bucket(path)
+	if err != nil {
+		return err
+	}
+	c.size += len(k) + len(v)
+
+	// keys and values belong to the source transaction
+	return b.Put(clone(k), clone(v))
+}
+
+// bucket returns the bucket at path in the current transaction, creating it if needed
+func (c *compactor) bucket(path [][]byte) (*bolt.Bucket, error) {
+	if c.tx == nil {
+		tx, err := c.db.Begin(true)
+		if err != nil {
+			return nil, err
+		}
+		c.tx = tx
+	}
+
+	b, err := c.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// keys are copied in order, so pages can be filled completely
+	b.FillPercent = 1
+	return b, nil
+}
+
+func (c *compactor) commit() error {
+	if c.tx == nil {
+		return nil
+	}
+
+	err := c.tx.Commit()
+	c.tx, c.size = nil, 0
+	return err
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
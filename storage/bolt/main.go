@@ -2,12 +2,22 @@ package bolt
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/kamaln7/klein/storage"
+	bolt "go.etcd.io/bbolt"
 )
 
+// metaSuffix is appended to the bucket name to get the name of the bucket holding metadata
+const metaSuffix = ".meta"
+
+// ErrInvalidBucket is returned for bucket names that clash with metadata buckets
+var ErrInvalidBucket = errors.New("bolt bucket names can't end in " + metaSuffix)
+
 // Provider implements a file-based storage system
 type Provider struct {
 	Config *Config
@@ -17,13 +27,41 @@ type Provider struct {
 // Config contains the configuration for the file storage
 type Config struct {
 	Path string
+	// Bucket is the bucket that holds the links, defaults to klein
+	Bucket string
+	// Timeout is how long to wait for another process to close the file, defaults to a second
+	Timeout time.Duration
+}
+
+// Meta holds what is known about a link besides its URL
+type Meta struct {
+	CreatedAt time.Time `json:"created_at"`
+	// CreatedBy is who created the link, if it was created by an authenticated user
+	CreatedBy string `json:"created_by,omitempty"`
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+// ensure that the storage.Walker, storage.Deleter, storage.Replacer, storage.Counter, storage.Backuper and storage.CreatorRecorder interfaces are implemented
+var (
+	_ storage.Walker          = new(Provider)
+	_ storage.Deleter         = new(Provider)
+	_ storage.Replacer        = new(Provider)
+	_ storage.Counter         = new(Provider)
+	_ storage.Backuper        = new(Provider)
+	_ storage.CreatorRecorder = new(Provider)
+)
 
 // New returns a new Provider instance
 func New(c *Config) (*Provider, error) {
+	if c.Bucket == "" {
+		c.Bucket = "klein"
+	}
+	if strings.HasSuffix(c.Bucket, metaSuffix) {
+		return nil, ErrInvalidBucket
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second
+	}
+
 	provider := &Provider{
 		Config: c,
 	}
@@ -37,17 +75,21 @@ func New(c *Config) (*Provider, error) {
 
 // Init sets up the BoltDB database
 func (p *Provider) Init() error {
-	db, err := bolt.Open(p.Config.Path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	db, err := bolt.Open(p.Config.Path, 0600, &bolt.Options{Timeout: p.Config.Timeout})
 	if err != nil {
 		return err
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("klein"))
+		if _, err := tx.CreateBucketIfNotExists(p.bucket()); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(p.metaBucket())
 
 		return err
 	})
 	if err != nil {
+		db.Close()
 		return err
 	}
 
@@ -55,12 +97,20 @@ func (p *Provider) Init() error {
 	return nil
 }
 
+func (p *Provider) bucket() []byte {
+	return []byte(p.Config.Bucket)
+}
+
+func (p *Provider) metaBucket() []byte {
+	return []byte(p.Config.Bucket + metaSuffix)
+}
+
 // Get attempts to find a URL by its alias and returns its original URL
 func (p *Provider) Get(alias string) (string, error) {
 	var url []byte
 
 	err := p.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("klein"))
+		b := tx.Bucket(p.bucket())
 		url = bytes.TrimSpace(b.Get([]byte(alias)))
 		if url == nil {
 			return storage.ErrNotFound
@@ -87,22 +137,119 @@ func (p *Provider) Exists(alias string) (bool, error) {
 	return true, err
 }
 
-// Store creates a new short URL
+// Store creates a new short URL and records when it was created
 func (p *Provider) Store(url, alias string) error {
-	exists, err := p.Exists(alias)
+	return p.StoreCreatedBy(url, alias, "")
+}
+
+// StoreCreatedBy creates a new short URL and records when and by whom it was created
+func (p *Provider) StoreCreatedBy(url, alias, creator string) error {
+	meta, err := json.Marshal(&Meta{
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: creator,
+	})
 	if err != nil {
 		return err
 	}
-	if exists {
-		return storage.ErrAlreadyExists
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket())
+		if b.Get([]byte(alias)) != nil {
+			return storage.ErrAlreadyExists
+		}
+
+		if err := b.Put([]byte(alias), bytes.TrimSpace([]byte(url))); err != nil {
+			return err
+		}
+		return tx.Bucket(p.metaBucket()).Put([]byte(alias), meta)
+	})
+}
+
+// Meta returns the metadata of a link. Links stored before metadata was
+// recorded have an empty Meta.
+func (p *Provider) Meta(alias string) (*Meta, error) {
+	meta := &Meta{}
+
+	err := p.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(p.bucket()).Get([]byte(alias)) == nil {
+			return storage.ErrNotFound
+		}
+
+		v := tx.Bucket(p.metaBucket()).Get([]byte(alias))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, meta)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	err = p.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("klein"))
-		err := b.Put([]byte(alias), bytes.TrimSpace([]byte(url)))
+	return meta, nil
+}
+
+// Walk calls fn for every stored URL
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	return p.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket())
+		return b.ForEach(func(alias, url []byte) error {
+			return fn(string(alias), string(bytes.TrimSpace(url)))
+		})
+	})
+}
 
+// Delete removes a short URL and its metadata
+func (p *Provider) Delete(alias string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket())
+		if b.Get([]byte(alias)) == nil {
+			return storage.ErrNotFound
+		}
+
+		if err := b.Delete([]byte(alias)); err != nil {
+			return err
+		}
+		return tx.Bucket(p.metaBucket()).Delete([]byte(alias))
+	})
+}
+
+// Replace points an existing alias at a new URL and keeps its metadata
+func (p *Provider) Replace(url, alias string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket())
+		if b.Get([]byte(alias)) == nil {
+			return storage.ErrNotFound
+		}
+
+		return b.Put([]byte(alias), bytes.TrimSpace([]byte(url)))
+	})
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	var n int
+	err := p.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(p.bucket()).Stats().KeyN
+		return nil
+	})
+
+	return n, err
+}
+
+// Backup writes a consistent copy of the whole database file, including
+// every bucket, to w without blocking writers
+func (p *Provider) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
 		return err
 	})
 
-	return err
+	return n, err
+}
+
+// Close closes the database file
+func (p *Provider) Close() error {
+	return p.db.Close()
 }
@@ -1,13 +1,28 @@
 package bolt
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/kamaln7/klein/storage"
 	"github.com/kamaln7/klein/storage/storagetest"
 )
 
+func newProvider(t testing.TB, c *Config) *Provider {
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't init bolt driver: %v\n", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
 func TestProvider(t *testing.T) {
 	file, err := ioutil.TempFile("", "klein")
 	if err != nil {
@@ -22,5 +37,140 @@ func TestProvider(t *testing.T) {
 		t.Errorf("couldn't init bolt driver: %v\n", err)
 	}
 
-	storagetest.RunBasicTests(p, t)
+	storagetest.RunTests(p, t)
+}
+
+func TestBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "klein.db")
+
+	a := newProvider(t, &Config{Path: path, Bucket: "a"})
+	storagetest.RunBasicTests(a, t)
+	a.Store("http://example.com/a", "shared")
+	a.Close()
+
+	b := newProvider(t, &Config{Path: path, Bucket: "b"})
+	if _, err := b.Get("shared"); err != storage.ErrNotFound {
+		t.Errorf("expected buckets to be separate, got %v", err)
+	}
+	if err := b.Store("http://example.com/b", "shared"); err != nil {
+		t.Errorf("couldn't store alias in the second bucket: %v", err)
+	}
+	b.Close()
+
+	a = newProvider(t, &Config{Path: path, Bucket: "a"})
+	if url, err := a.Get("shared"); err != nil || url != "http://example.com/a" {
+		t.Errorf("expected the first bucket to be untouched, got %q, %v", url, err)
+	}
+
+	if _, err := New(&Config{Path: path, Bucket: "a.meta"}); err != ErrInvalidBucket {
+		t.Errorf("expected ErrInvalidBucket, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "klein.db")
+	newProvider(t, &Config{Path: path})
+
+	start := time.Now()
+	if _, err := New(&Config{Path: path, Timeout: 50 * time.Millisecond}); err == nil {
+		t.Errorf("expected opening a locked file to fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected to give up after the timeout, took %s", time.Since(start))
+	}
+}
+
+func TestMeta(t *testing.T) {
+	p := newProvider(t, &Config{Path: filepath.Join(t.TempDir(), "klein.db")})
+
+	before := time.Now().Add(-time.Second)
+	p.Store("http://example.com", "example")
+
+	meta, err := p.Meta("example")
+	if err != nil {
+		t.Fatalf("couldn't get metadata: %v", err)
+	}
+	if meta.CreatedAt.Before(before) || meta.CreatedAt.After(time.Now()) {
+		t.Errorf("expected the creation time to be recorded, got %s", meta.CreatedAt)
+	}
+
+	// the metadata bucket doesn't show up as links
+	if n, _ := p.Count(); n != 1 {
+		t.Errorf("expected 1 link, got %d", n)
+	}
+
+	p.Delete("example")
+	if _, err := p.Meta("example"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	p.Store("http://example.com/new", "example")
+	if meta, err := p.Meta("example"); err != nil || meta.CreatedAt.IsZero() {
+		t.Errorf("expected metadata of the new link, got %v, %v", meta, err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	p := newProvider(t, &Config{Path: filepath.Join(dir, "klein.db"), Bucket: "tenant"})
+	p.Store("http://example.com", "example")
+
+	var buf bytes.Buffer
+	n, err := p.Backup(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("couldn't back up: %d, %v", n, err)
+	}
+
+	path := filepath.Join(dir, "backup.db")
+	ioutil.WriteFile(path, buf.Bytes(), 0600)
+	restored := newProvider(t, &Config{Path: path, Bucket: "tenant"})
+	if url, err := restored.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the backup to hold the link, got %q, %v", url, err)
+	}
+	if _, err := restored.Meta("example"); err != nil {
+		t.Errorf("expected the backup to hold the metadata, got %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "klein.db"), filepath.Join(dir, "compact.db")
+
+	p := newProvider(t, &Config{Path: src})
+	for i := 0; i < 2000; i++ {
+		p.Store("http://example.com/"+strconv.Itoa(i), "alias"+strconv.Itoa(i))
+	}
+	for i := 0; i < 1900; i++ {
+		p.Delete("alias" + strconv.Itoa(i))
+	}
+	p.Close()
+
+	if err := Compact(dst, src, time.Second); err != nil {
+		t.Fatalf("couldn't compact: %v", err)
+	}
+	if err := Compact(dst, src, time.Second); err == nil {
+		t.Errorf("expected compacting into an existing file to fail")
+	}
+
+	before, _ := os.Stat(src)
+	after, _ := os.Stat(dst)
+	if after.Size() >= before.Size() {
+		t.Errorf("expected the compacted file to be smaller, got %d from %d bytes", after.Size(), before.Size())
+	}
+
+	p = newProvider(t, &Config{Path: dst})
+	if n, _ := p.Count(); n != 100 {
+		t.Errorf("expected 100 links, got %d", n)
+	}
+	if url, err := p.Get("alias1999"); err != nil || url != "http://example.com/1999" {
+		t.Errorf("expected links to be copied, got %q, %v", url, err)
+	}
+	if meta, err := p.Meta("alias1999"); err != nil || meta.CreatedAt.IsZero() {
+		t.Errorf("expected metadata to be copied, got %v, %v", meta, err)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		return newProvider(b, &Config{Path: filepath.Join(b.TempDir(), "klein.db")})
+	}, b)
 }
@@ -0,0 +1,371 @@
+package cache
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/internal/lru"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Provider wraps any storage provider with a read-through cache. Lookups are
+// served from an in-process LRU first, then from an optional shared redis
+// cache, and only then from the wrapped provider.
+type Provider struct {
+	Config *Config
+
+	local *lru.Cache
+	redis *pool.Pool
+
+	hits, misses, redisHits, errors uint64
+	// redisDown is 1 while redis commands are failing
+	redisDown int32
+}
+
+// Config contains the configuration for the caching layer
+type Config struct {
+	// Backend is the provider being cached
+	Backend storage.Provider
+
+	// Size caps the number of aliases held in memory. 0 disables the in-process cache.
+	Size int
+	// TTL is how long URLs are cached in memory
+	TTL time.Duration
+	// NegativeTTL is how long to remember in memory that an alias does not
+	// exist. It is capped at TTL, 0 disables negative caching.
+	NegativeTTL time.Duration
+
+	// Redis enables a second cache level shared between instances
+	Redis *RedisConfig
+
+	// Log is told when redis stops responding and when it recovers, rather
+	// than about every failed command. Defaults to the standard logger's output.
+	Log *log.Logger
+}
+
+// RedisConfig contains the configuration for the shared redis cache
+type RedisConfig struct {
+	Address string
+	Auth    string
+	DB      int
+	// Prefix is prepended to every alias to build its key
+	Prefix string
+	// TTL is how long URLs are cached in redis
+	TTL time.Duration
+	// PoolSize is the number of connections kept open to redis. Defaults to 10.
+	PoolSize int
+}
+
+// ensure that the storage.Walker, storage.Deleter, storage.Replacer, storage.Counter, storage.Invalidator, storage.StatsReporter, storage.Backuper and storage.CreatorRecorder interfaces are implemented
+var (
+	_ storage.Walker          = new(Provider)
+	_ storage.Deleter         = new(Provider)
+	_ storage.Replacer        = new(Provider)
+	_ storage.Counter         = new(Provider)
+	_ storage.Invalidator     = new(Provider)
+	_ storage.StatsReporter   = new(Provider)
+	_ storage.Backuper        = new(Provider)
+	_ storage.CreatorRecorder = new(Provider)
+)
+
+// New returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	p := &Provider{
+		Config: c,
+	}
+
+	if c.Size > 0 {
+		p.local = lru.New(c.Size)
+	}
+	if c.NegativeTTL > c.TTL {
+		c.NegativeTTL = c.TTL
+	}
+	if c.Log == nil {
+		c.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if c.Redis != nil {
+		df := func(network, addr string) (*redis.Client, error) {
+			client, err := redis.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			if c.Redis.Auth != "" {
+				if err = client.Cmd("AUTH", c.Redis.Auth).Err; err != nil {
+					client.Close()
+					return nil, err
+				}
+			}
+
+			if err = client.Cmd("SELECT", c.Redis.DB).Err; err != nil {
+				client.Close()
+				return nil, err
+			}
+
+			return client, nil
+		}
+
+		size := c.Redis.PoolSize
+		if size <= 0 {
+			size = 10
+		}
+
+		pool, err := pool.NewCustom("tcp", c.Redis.Address, size, df)
+		if err != nil {
+			return nil, err
+		}
+		p.redis = pool
+	}
+
+	return p, nil
+}
+
+// Get attempts to find a URL by its alias and returns its original URL
+func (p *Provider) Get(alias string) (string, error) {
+	if p.local != nil {
+		if url, ok := p.local.Get(alias); ok {
+			atomic.AddUint64(&p.hits, 1)
+			if url == nil {
+				return "", storage.ErrNotFound
+			}
+			return *url, nil
+		}
+	}
+
+	if p.redis != nil {
+		r := p.redis.Cmd("GET", p.key(alias))
+		if r.Err != nil {
+			// the shared cache is best-effort, fall through to the backend
+			p.redisFailed(r.Err)
+		} else {
+			p.redisWorked()
+			if url, _ := r.Str(); url != "" {
+				atomic.AddUint64(&p.redisHits, 1)
+				p.setLocal(alias, &url)
+				return url, nil
+			}
+		}
+	}
+
+	atomic.AddUint64(&p.misses, 1)
+	url, err := p.Config.Backend.Get(alias)
+	switch err {
+	case nil:
+		p.set(alias, url)
+	case storage.ErrNotFound:
+		if p.Config.NegativeTTL > 0 && p.local != nil {
+			p.local.Add(alias, nil, p.Config.NegativeTTL)
+		}
+	}
+
+	return url, err
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	_, err := p.Get(alias)
+	switch err {
+	case nil:
+		return true, nil
+	case storage.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Store creates a new short URL. The existence check is left to the backend
+// so that a cached miss can never cause an alias to be overwritten.
+func (p *Provider) Store(url, alias string) error {
+	return p.StoreCreatedBy(url, alias, "")
+}
+
+// StoreCreatedBy creates a new short URL, recording its creator if the
+// backend supports it
+func (p *Provider) StoreCreatedBy(url, alias, creator string) error {
+	url = strings.TrimSpace(url)
+
+	var err error
+	if recorder, ok := p.Config.Backend.(storage.CreatorRecorder); ok && creator != "" {
+		err = recorder.StoreCreatedBy(url, alias, creator)
+	} else {
+		err = p.Config.Backend.Store(url, alias)
+	}
+	switch err {
+	case nil:
+		p.set(alias, url)
+	case storage.ErrAlreadyExists:
+		// whatever we had cached for this alias is wrong
+		p.Invalidate(alias)
+	}
+
+	return err
+}
+
+// Walk calls fn for every URL stored in the backend
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	walker, ok := p.Config.Backend.(storage.Walker)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+
+	return walker.Walk(fn)
+}
+
+// Delete removes a short URL from the backend and the cache
+func (p *Provider) Delete(alias string) error {
+	deleter, ok := p.Config.Backend.(storage.Deleter)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+
+	err := deleter.Delete(alias)
+	if err == nil || err == storage.ErrNotFound {
+		p.Invalidate(alias)
+	}
+
+	return err
+}
+
+// Replace points an existing alias at a new URL in the backend, and drops
+// the old URL from the cache
+func (p *Provider) Replace(url, alias string) error {
+	replacer, ok := p.Config.Backend.(storage.Replacer)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+
+	err := replacer.Replace(url, alias)
+	if err == nil || err == storage.ErrNotFound {
+		p.Invalidate(alias)
+	}
+
+	return err
+}
+
+// Count returns the number of URLs stored in the backend
+func (p *Provider) Count() (int, error) {
+	counter, ok := p.Config.Backend.(storage.Counter)
+	if !ok {
+		return 0, storage.ErrNotSupported
+	}
+
+	return counter.Count()
+}
+
+// Backup writes a copy of the backend's data to w
+func (p *Provider) Backup(w io.Writer) (int64, error) {
+	backuper, ok := p.Config.Backend.(storage.Backuper)
+	if !ok {
+		return 0, storage.ErrNotSupported
+	}
+
+	return backuper.Backup(w)
+}
+
+// Close releases the shared cache's connections and closes the wrapped
+// provider if it can be closed
+func (p *Provider) Close() error {
+	if p.redis != nil {
+		p.redis.Empty()
+	}
+
+	if closer, ok := p.Config.Backend.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Invalidate drops an alias from every cache level, and from the backend's own cache if it has one
+func (p *Provider) Invalidate(alias string) {
+	if p.local != nil {
+		p.local.Delete(alias)
+	}
+
+	if p.redis != nil {
+		if err := p.redis.Cmd("DEL", p.key(alias)).Err; err != nil {
+			p.redisFailed(err)
+		} else {
+			p.redisWorked()
+		}
+	}
+
+	if invalidator, ok := p.Config.Backend.(storage.Invalidator); ok {
+		invalidator.Invalidate(alias)
+	}
+}
+
+// Stats returns the cache counters since the provider was created
+func (p *Provider) Stats() map[string]uint64 {
+	stats := map[string]uint64{
+		"cache_hits":   atomic.LoadUint64(&p.hits),
+		"cache_misses": atomic.LoadUint64(&p.misses),
+	}
+	if p.local != nil {
+		stats["cache_size"] = uint64(p.local.Len())
+	}
+	if p.redis != nil {
+		stats["cache_redis_hits"] = atomic.LoadUint64(&p.redisHits)
+		stats["cache_redis_errors"] = atomic.LoadUint64(&p.errors)
+	}
+	if reporter, ok := p.Config.Backend.(storage.StatsReporter); ok {
+		for k, v := range reporter.Stats() {
+			stats[k] = v
+		}
+	}
+
+	return stats
+}
+
+// set caches a URL at every level
+func (p *Provider) set(alias, url string) {
+	p.setLocal(alias, &url)
+
+	if p.redis != nil {
+		ttl := int64(p.Config.Redis.TTL / time.Millisecond)
+		var err error
+		if ttl > 0 {
+			err = p.redis.Cmd("SET", p.key(alias), url, "PX", ttl).Err
+		} else {
+			err = p.redis.Cmd("SET", p.key(alias), url).Err
+		}
+		if err != nil {
+			p.redisFailed(err)
+		} else {
+			p.redisWorked()
+		}
+	}
+}
+
+func (p *Provider) setLocal(alias string, url *string) {
+	if p.local != nil && p.Config.TTL > 0 {
+		p.local.Set(alias, url, p.Config.TTL)
+	}
+}
+
+func (p *Provider) key(alias string) string {
+	return p.Config.Redis.Prefix + alias
+}
+
+// redisFailed counts a failed redis command, and logs it if redis was working until now
+func (p *Provider) redisFailed(err error) {
+	atomic.AddUint64(&p.errors, 1)
+	if atomic.CompareAndSwapInt32(&p.redisDown, 0, 1) {
+		p.Config.Log.Printf("cache: redis is unavailable, using the backend until it recovers: %v\n", err)
+	}
+}
+
+// redisWorked logs that redis recovered if it was failing until now
+func (p *Provider) redisWorked() {
+	if atomic.CompareAndSwapInt32(&p.redisDown, 1, 0) {
+		p.Config.Log.Printf("cache: redis is available again\n")
+	}
+}
@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/memory"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+func newProvider(t testing.TB, c *Config) *Provider {
+	if c.Backend == nil {
+		c.Backend = memory.New(&memory.Config{})
+	}
+	if c.Log == nil {
+		c.Log = log.New(ioutil.Discard, "", 0)
+	}
+
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't init cache: %v\n", err)
+	}
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("couldn't start redis server: %v\n", err)
+	}
+	defer redisServer.Close()
+
+	for name, c := range map[string]*Config{
+		"local":  {Size: 100, TTL: time.Minute, NegativeTTL: time.Minute},
+		"redis":  {Redis: &RedisConfig{Address: redisServer.Addr(), Prefix: "cache:", TTL: time.Minute}},
+		"layers": {Size: 100, TTL: time.Minute, NegativeTTL: time.Minute, Redis: &RedisConfig{Address: redisServer.Addr(), Prefix: "layers:", TTL: time.Minute}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			storagetest.RunTests(newProvider(t, c), t)
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	p := newProvider(t, &Config{Size: 100, TTL: time.Minute})
+	p.Config.Backend.Store("http://example.com", "example")
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get("example"); err != nil {
+			t.Fatalf("couldn't get alias: %v", err)
+		}
+	}
+
+	stats := p.Stats()
+	if stats["cache_misses"] != 1 || stats["cache_hits"] != 2 || stats["cache_size"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	p := newProvider(t, &Config{Size: 100, TTL: time.Minute, NegativeTTL: 50 * time.Millisecond})
+
+	if _, err := p.Get("example"); err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// stored behind the cache's back, the cached miss hides it
+	p.Config.Backend.Store("http://example.com", "example")
+	if _, err := p.Get("example"); err != storage.ErrNotFound {
+		t.Errorf("expected the miss to be cached, got %v", err)
+	}
+
+	// but the miss must never allow overwriting the alias
+	if err := p.Store("http://example.org", "example"); err != storage.ErrAlreadyExists {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+	if url, err := p.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the conflict to invalidate the cached miss, got %q, %v", url, err)
+	}
+
+	p.Config.Backend.Store("http://example.com", "expiring")
+	p.local.Set("expiring", nil, p.Config.NegativeTTL)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := p.Get("expiring"); err != nil {
+		t.Errorf("expected the cached miss to expire, got %v", err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	p := newProvider(t, &Config{Size: 2, TTL: time.Minute})
+	for _, alias := range []string{"a", "b", "c"} {
+		if err := p.Store("http://example.com/"+alias, alias); err != nil {
+			t.Fatalf("couldn't store %s: %v", alias, err)
+		}
+	}
+
+	if n := p.local.Len(); n != 2 {
+		t.Errorf("expected 2 cached aliases, got %d", n)
+	}
+	if _, ok := p.local.Get("a"); ok {
+		t.Errorf("expected the least recently used alias to be evicted")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	p := newProvider(t, &Config{Size: 100, TTL: time.Minute})
+	p.Store("http://example.com", "example")
+
+	if err := p.Delete("example"); err != nil {
+		t.Fatalf("couldn't delete alias: %v", err)
+	}
+	if _, err := p.Get("example"); err != storage.ErrNotFound {
+		t.Errorf("expected deleted alias to be gone, got %v", err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	p := newProvider(t, &Config{Size: 100, TTL: time.Minute})
+	p.Store("http://example.com", "example")
+
+	if err := p.Replace("http://example.org", "example"); err != nil {
+		t.Fatalf("couldn't replace alias: %v", err)
+	}
+	if url, err := p.Get("example"); err != nil || url != "http://example.org" {
+		t.Errorf("expected the replaced url, got %q, %v", url, err)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("couldn't start redis server: %v\n", err)
+	}
+	defer redisServer.Close()
+
+	backend := memory.New(&memory.Config{})
+	redisConfig := &RedisConfig{Address: redisServer.Addr(), Prefix: "klein:", TTL: time.Minute}
+	a := newProvider(t, &Config{Backend: backend, Size: 100, TTL: time.Minute, Redis: redisConfig})
+	b := newProvider(t, &Config{Backend: backend, Size: 100, TTL: time.Minute, Redis: redisConfig})
+
+	if err := a.Store("http://example.com", "example"); err != nil {
+		t.Fatalf("couldn't store alias: %v", err)
+	}
+	if ttl := redisServer.TTL("klein:example"); ttl != time.Minute {
+		t.Errorf("expected the redis key to expire in a minute, got %v", ttl)
+	}
+
+	if url, err := b.Get("example"); err != nil || url != "http://example.com" {
+		t.Fatalf("couldn't get alias: %q, %v", url, err)
+	}
+	if stats := b.Stats(); stats["cache_redis_hits"] != 1 || stats["cache_misses"] != 0 {
+		t.Errorf("expected a redis hit, got %v", stats)
+	}
+
+	// redis going away must not break lookups
+	c := newProvider(t, &Config{Backend: backend, Redis: redisConfig})
+	redisServer.Close()
+	if url, err := c.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected to fall back to the backend, got %q, %v", url, err)
+	}
+}
+
+// failing is a backend whose lookups always fail
+type failing struct {
+	storage.Provider
+	calls int
+}
+
+func (f *failing) Get(alias string) (string, error) {
+	f.calls++
+	return "", errors.New("backend unavailable")
+}
+
+func TestErrorsAreNotCached(t *testing.T) {
+	backend := &failing{}
+	p := newProvider(t, &Config{Backend: backend, Size: 100, TTL: time.Minute, NegativeTTL: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.Get("example"); err == nil || err == storage.ErrNotFound {
+			t.Errorf("expected the backend error, got %v", err)
+		}
+	}
+	if backend.calls != 2 {
+		t.Errorf("expected every lookup to reach the backend, got %d calls", backend.calls)
+	}
+	if err := p.Walk(nil); err != storage.ErrNotSupported {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestRedisLog(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("couldn't start redis server: %v\n", err)
+	}
+	defer redisServer.Close()
+
+	buf := new(bytes.Buffer)
+	p := newProvider(t, &Config{
+		Redis: &RedisConfig{Address: redisServer.Addr(), Prefix: "klein:", PoolSize: 1},
+		Log:   log.New(buf, "", 0),
+	})
+	p.Store("http://example.com", "example")
+
+	// every lookup fails while redis is down, but that's only logged once
+	addr := redisServer.Addr()
+	redisServer.Close()
+	for i := 0; i < 3; i++ {
+		p.Get("example")
+	}
+	if n := strings.Count(buf.String(), "unavailable"); n != 1 {
+		t.Errorf("expected redis going away to be logged once, got %q", buf.String())
+	}
+
+	if err := redisServer.StartAddr(addr); err != nil {
+		t.Fatalf("couldn't restart redis server: %v\n", err)
+	}
+	for i := 0; i < 3; i++ {
+		p.Get("example")
+	}
+	if n := strings.Count(buf.String(), "available again"); n != 1 {
+		t.Errorf("expected redis coming back to be logged once, got %q", buf.String())
+	}
+}
+
+// closer is a backend that records being closed
+type closer struct {
+	storage.Provider
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	backend := &closer{Provider: memory.New(&memory.Config{})}
+	p := newProvider(t, &Config{Backend: backend, Size: 100, TTL: time.Minute})
+
+	if err := p.Close(); err != nil || !backend.closed {
+		t.Errorf("expected the backend to be closed, got %v", err)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	for name, c := range map[string]Config{
+		"local": {Size: 100000, TTL: time.Minute, NegativeTTL: time.Minute},
+		"redis": {Redis: &RedisConfig{Prefix: "cache:", TTL: time.Minute}},
+	} {
+		b.Run(name, func(b *testing.B) {
+			storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+				c := c
+				if c.Redis != nil {
+					redisServer, err := miniredis.Run()
+					if err != nil {
+						b.Fatalf("couldn't start redis server: %v\n", err)
+					}
+					b.Cleanup(redisServer.Close)
+
+					redis := *c.Redis
+					redis.Address = redisServer.Addr()
+					c.Redis = &redis
+				}
+
+				return newProvider(b, &c)
+			}, b)
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/internal/lru"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// walkPageSize is how many links Walk reads from etcd at a time
+var walkPageSize int64 = 1000
+
+// Provider implements a storage system backed by etcd. Links are created in
+// transactions, so replicas sharing a cluster can't overwrite each other's
+// links, and cached lookups are invalidated by watching the key prefix.
+type Provider struct {
+	Config *Config
+	client *clientv3.Client
+
+	// the cache is only used while the watch is running, see cacheable
+	mutex    sync.Mutex
+	cache    *lru.Cache
+	watching bool
+	// lookups made before freshRev are not cached, they may have missed
+	// changes that the watch or this instance already made
+	freshRev int64
+
+	cacheHits, cacheMisses uint64
+
+	cancel    context.CancelFunc
+	watchDone chan struct{}
+}
+
+// Config contains the configuration for the etcd storage
+type Config struct {
+	Endpoints []string
+	// Prefix is prepended to aliases to get their keys
+	Prefix             string
+	Username, Password string
+	// DialTimeout defaults to 5 seconds
+	DialTimeout time.Duration
+	// RequestTimeout caps every request to etcd, defaults to 5 seconds
+	RequestTimeout time.Duration
+
+	// TLS is enabled if any of TLSCA, TLSCert or TLSKey is set. TLSCert and
+	// TLSKey are the client certificate for servers that require one.
+	TLSCA, TLSCert, TLSKey string
+
+	// CacheSize caps the number of lookups, found or not, to keep in memory.
+	// Entries are dropped as soon as the watch reports a change. 0 disables caching.
+	CacheSize int
+
+	Log *log.Logger
+}
+
+// ensure that the storage.Walker, storage.Deleter, storage.Counter, storage.Invalidator and storage.StatsReporter interfaces are implemented
+var (
+	_ storage.Walker        = new(Provider)
+	_ storage.Deleter       = new(Provider)
+	_ storage.Counter       = new(Provider)
+	_ storage.Invalidator   = new(Provider)
+	_ storage.StatsReporter = new(Provider)
+)
+
+// New connects to etcd and, if caching is enabled, starts watching for changes
+func New(c *Config) (*Provider, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, errors.New("no etcd endpoints configured")
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 5 * time.Second
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = 5 * time.Second
+	}
+
+	var tlsConfig *tls.Config
+	if c.TLSCA != "" || c.TLSCert != "" || c.TLSKey != "" {
+		var err error
+		tlsConfig, err = transport.TLSInfo{
+			TrustedCAFile: c.TLSCA,
+			CertFile:      c.TLSCert,
+			KeyFile:       c.TLSKey,
+		}.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.Endpoints,
+		Username:    c.Username,
+		Password:    c.Password,
+		DialTimeout: c.DialTimeout,
+		TLS:         tlsConfig,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		Config: c,
+		client: client,
+	}
+
+	// fail early if etcd can't be reached or the credentials are wrong
+	if _, err := p.Count(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if c.CacheSize > 0 {
+		var ctx context.Context
+		ctx, p.cancel = context.WithCancel(context.Background())
+		p.cache = lru.New(c.CacheSize)
+		p.watchDone = make(chan struct{})
+		go p.watch(ctx)
+	}
+
+	return p, nil
+}
+
+func (p *Provider) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.Config.RequestTimeout)
+}
+
+func (p *Provider) key(alias string) string {
+	return p.Config.Prefix + alias
+}
+
+// keyRange returns the first key and the end of the range holding every link
+func (p *Provider) keyRange() (string, string) {
+	// etcd doesn't accept empty keys, "\x00" starts from the first key or goes on to the last
+	if p.Config.Prefix == "" {
+		return "\x00", "\x00"
+	}
+
+	return p.Config.Prefix, clientv3.GetPrefixRangeEnd(p.Config.Prefix)
+}
+
+// Get attempts to find a URL by its alias and returns its original URL
+func (p *Provider) Get(alias string) (string, error) {
+	if p.cache != nil {
+		if url, ok := p.cached(alias); ok {
+			atomic.AddUint64(&p.cacheHits, 1)
+			if url == nil {
+				return "", storage.ErrNotFound
+			}
+			return *url, nil
+		}
+		atomic.AddUint64(&p.cacheMisses, 1)
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	res, err := p.client.Get(ctx, p.key(alias))
+	if err != nil {
+		return "", err
+	}
+
+	var url *string
+	if len(res.Kvs) > 0 {
+		s := string(res.Kvs[0].Value)
+		url = &s
+	}
+	if p.cache != nil {
+		p.setCache(alias, url, res.Header.Revision)
+	}
+
+	if url == nil {
+		return "", storage.ErrNotFound
+	}
+	return *url, nil
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	_, err := p.Get(alias)
+
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Store creates a new short URL if the alias doesn't exist yet, in a single transaction
+func (p *Provider) Store(url, alias string) error {
+	url = strings.TrimSpace(url)
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	key := p.key(alias)
+	res, err := p.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, url)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !res.Succeeded {
+		return storage.ErrAlreadyExists
+	}
+
+	p.changed(alias, res.Header.Revision)
+	return nil
+}
+
+// Walk calls fn for every stored URL. Links are read in pages from a
+// single revision, so changes made while walking are not seen.
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	from, end := p.keyRange()
+	var rev int64
+	for {
+		ctx, cancel := p.context()
+		res, err := p.client.Get(ctx, from,
+			clientv3.WithRange(end),
+			clientv3.WithRev(rev),
+			clientv3.WithLimit(walkPageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		)
+		cancel()
+		if err != nil {
+			return err
+		}
+		rev = res.Header.Revision
+
+		for _, kv := range res.Kvs {
+			if err := fn(strings.TrimPrefix(string(kv.Key), p.Config.Prefix), string(kv.Value)); err != nil {
+				return err
+			}
+		}
+
+		if !res.More || len(res.Kvs) == 0 {
+			return nil
+		}
+		from = string(res.Kvs[len(res.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	ctx, cancel := p.context()
+	defer cancel()
+
+	res, err := p.client.Delete(ctx, p.key(alias))
+	if err != nil {
+		return err
+	}
+	if res.Deleted == 0 {
+		return storage.ErrNotFound
+	}
+
+	p.changed(alias, res.Header.Revision)
+	return nil
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+
+	start, end := p.keyRange()
+	res, err := p.client.Get(ctx, start, clientv3.WithRange(end), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+
+	return int(res.Count), nil
+}
+
+// Invalidate drops the cached lookup of an alias. Changes are picked up from
+// the watch anyway, this only speeds up seeing this instance's own writes.
+func (p *Provider) Invalidate(alias string) {
+	if p.cache == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	p.cache.Delete(alias)
+	p.mutex.Unlock()
+}
+
+// Stats returns the cache's counters
+func (p *Provider) Stats() map[string]uint64 {
+	if p.cache == nil {
+		return nil
+	}
+
+	p.mutex.Lock()
+	size := p.cache.Len()
+	p.mutex.Unlock()
+
+	return map[string]uint64{
+		"etcd_cache_hits":   atomic.LoadUint64(&p.cacheHits),
+		"etcd_cache_misses": atomic.LoadUint64(&p.cacheMisses),
+		"etcd_cache_size":   uint64(size),
+	}
+}
+
+// Close stops watching and disconnects from etcd
+func (p *Provider) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.watchDone
+	}
+
+	return p.client.Close()
+}
+
+func (p *Provider) cached(alias string) (*string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.watching {
+		return nil, false
+	}
+	return p.cache.Get(alias)
+}
+
+// setCache caches a lookup made at revision rev, unless it may have missed
+// changes that were already seen. Changes that weren't seen yet will still
+// drop the entry once the watch reports them.
+func (p *Provider) setCache(alias string, url *string, rev int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.watching && rev >= p.freshRev {
+		p.cache.Set(alias, url, 0)
+	}
+}
+
+// changed drops the cached lookup of an alias this instance changed at
+// revision rev, without waiting for the watch, so that its own writes are
+// seen right away
+func (p *Provider) changed(alias string, rev int64) {
+	if p.cache == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.cache.Delete(alias)
+	if rev > p.freshRev {
+		p.freshRev = rev
+	}
+}
+
+// watch drops cached lookups of changed aliases until ctx is cancelled. The
+// cache is cleared and disabled whenever the watch breaks, since changes
+// may have been missed, until a new watch is running.
+func (p *Provider) watch(ctx context.Context) {
+	defer close(p.watchDone)
+
+	for ctx.Err() == nil {
+		start, end := p.keyRange()
+		wch := p.client.Watch(clientv3.WithRequireLeader(ctx), start,
+			clientv3.WithRange(end),
+			clientv3.WithCreatedNotify(),
+			clientv3.WithProgressNotify(),
+		)
+
+		for res := range wch {
+			if err := res.Err(); err != nil {
+				p.logf("etcd watch failed, clearing the cache: %s\n", err.Error())
+				break
+			}
+
+			p.mutex.Lock()
+			if res.Created {
+				// anything cached before now may be stale
+				p.cache.Clear()
+				p.watching = true
+			}
+			for _, ev := range res.Events {
+				p.cache.Delete(strings.TrimPrefix(string(ev.Kv.Key), p.Config.Prefix))
+			}
+			if res.Header.Revision > p.freshRev {
+				p.freshRev = res.Header.Revision
+			}
+			p.mutex.Unlock()
+		}
+
+		p.mutex.Lock()
+		p.watching = false
+		p.cache.Clear()
+		p.mutex.Unlock()
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (p *Provider) logf(format string, v ...interface{}) {
+	if p.Config.Log != nil {
+		p.Config.Log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,266 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/storagetest"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+)
+
+// newEtcd starts a single node etcd server and returns its client url
+func newEtcd(t testing.TB, tlsInfo *transport.TLSInfo) string {
+	scheme := "http"
+	if tlsInfo != nil {
+		scheme = "https"
+	}
+	clientURL := url.URL{Scheme: scheme, Host: freeAddr(t)}
+	peerURL := url.URL{Scheme: "http", Host: freeAddr(t)}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.ZapLoggerBuilder = embed.NewZapLoggerBuilder(zap.NewNop())
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	if tlsInfo != nil {
+		cfg.ClientTLSInfo = *tlsInfo
+	}
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("couldn't start etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd took too long to start")
+	}
+
+	return clientURL.String()
+}
+
+func newProvider(t testing.TB, c *Config) *Provider {
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't connect to etcd: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	endpoint := newEtcd(t, nil)
+
+	for name, c := range map[string]*Config{
+		"uncached": {Endpoints: []string{endpoint}, Prefix: "uncached/"},
+		"cached":   {Endpoints: []string{endpoint}, Prefix: "cached/", CacheSize: 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			storagetest.RunTests(newProvider(t, c), t)
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	endpoint := newEtcd(t, nil)
+	other := newProvider(t, &Config{Endpoints: []string{endpoint}, Prefix: "other/"})
+	other.Store("http://example.com/other", "unrelated")
+
+	p := newProvider(t, &Config{Endpoints: []string{endpoint}, Prefix: "klein/"})
+	storagetest.RunBasicTests(p, t)
+
+	if _, err := p.Get("unrelated"); err != storage.ErrNotFound {
+		t.Errorf("expected keys outside the prefix to be invisible, got %v", err)
+	}
+
+	// walk over more than one page
+	defer func(size int64) { walkPageSize = size }(walkPageSize)
+	walkPageSize = 3
+	for i := 0; i < 10; i++ {
+		p.Store("http://example.com/"+strconv.Itoa(i), "alias"+strconv.Itoa(i))
+	}
+
+	walked := make(map[string]string)
+	p.Walk(func(alias, url string) error {
+		walked[alias] = url
+		return nil
+	})
+	// as well as example, which the basic tests stored
+	if len(walked) != 11 || walked["alias9"] != "http://example.com/9" {
+		t.Errorf("expected to walk over the 11 prefixed links, got %v", walked)
+	}
+	if n, err := p.Count(); err != nil || n != 11 {
+		t.Errorf("expected to count 11 prefixed links, got %d, %v", n, err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	endpoint := newEtcd(t, nil)
+	a := newProvider(t, &Config{Endpoints: []string{endpoint}, CacheSize: 10})
+	b := newProvider(t, &Config{Endpoints: []string{endpoint}})
+
+	storagetest.RunBasicTests(a, t)
+
+	// wait for the watch to be running
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Get("missing"); a.Stats()["etcd_cache_size"] == 0; a.Get("missing") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected lookups to be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hits := a.Stats()["etcd_cache_hits"]
+	if _, err := a.Get("missing"); err != storage.ErrNotFound || a.Stats()["etcd_cache_hits"] != hits+1 {
+		t.Errorf("expected a cached miss, got %v, %v", err, a.Stats())
+	}
+
+	// another instance's changes are picked up from the watch
+	b.Store("http://example.com/b", "missing")
+	waitFor(t, a, "missing", "http://example.com/b")
+	b.Delete("missing")
+	waitFor(t, a, "missing", "")
+
+	// own changes are seen right away
+	a.Get("own")
+	if err := a.Store("http://example.com/a", "own"); err != nil {
+		t.Fatal(err)
+	}
+	if url, err := a.Get("own"); err != nil || url != "http://example.com/a" {
+		t.Errorf("expected to see the stored link, got %q, %v", url, err)
+	}
+}
+
+// waitFor waits until p sees url for alias, or doesn't find it if url is empty
+func waitFor(t *testing.T, p *Provider, alias, url string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := p.Get(alias)
+		if got == url && (url != "" || err == storage.ErrNotFound) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q to be %q, got %q, %v", alias, url, got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, dir, "ca", nil, nil)
+	newCertificate(t, dir, "server", ca, caKey)
+	newCertificate(t, dir, "client", ca, caKey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	endpoint := newEtcd(t, &transport.TLSInfo{
+		CertFile:       path("server.pem"),
+		KeyFile:        path("server-key.pem"),
+		TrustedCAFile:  path("ca.pem"),
+		ClientCertAuth: true,
+	})
+
+	p := newProvider(t, &Config{
+		Endpoints: []string{endpoint},
+		TLSCA:     path("ca.pem"),
+		TLSCert:   path("client.pem"),
+		TLSKey:    path("client-key.pem"),
+	})
+	storagetest.RunBasicTests(p, t)
+
+	if _, err := New(&Config{Endpoints: []string{endpoint}, TLSCA: path("ca.pem"), DialTimeout: time.Second, RequestTimeout: time.Second}); err == nil {
+		t.Errorf("expected connecting without a client certificate to fail")
+	}
+}
+
+func freeAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// newCertificate writes name.pem and name-key.pem to dir. The certificate
+// is a CA if parent is nil, otherwise it is valid for 127.0.0.1 and signed by parent.
+func newCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("couldn't create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func BenchmarkProvider(b *testing.B) {
+	endpoint := newEtcd(b, nil)
+
+	for name, c := range map[string]Config{
+		"uncached": {Endpoints: []string{endpoint}},
+		"cached":   {Endpoints: []string{endpoint}, CacheSize: 10000},
+	} {
+		b.Run(name, func(b *testing.B) {
+			storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+				c := c
+				// every dataset gets its own prefix, so they start out empty
+				c.Prefix = b.Name() + "/"
+				return newProvider(b, &c)
+			}, b, 100, 1000)
+		})
+	}
+}
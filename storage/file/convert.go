@@ -0,0 +1,107 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kamaln7/klein/storage"
+)
+
+// staging is where Convert keeps flat files that are still to be converted
+const staging = ".flat"
+
+// hasFlatLinks checks whether a directory holds links in the flat layout
+func hasFlatLinks(path string) (bool, error) {
+	files, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// aliases may start with a dot in the flat layout, so only temporary
+	// files are ignored, as when walking
+	for _, f := range files {
+		if f.Name() == staging || (!f.IsDir() && !strings.HasPrefix(f.Name(), tmpPrefix)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Convert moves the links stored in the flat layout under path into the
+// sharded layout, in place. The flat files are first moved aside, since
+// their names may clash with shard directories, so an interrupted
+// conversion can be resumed by running it again. It returns the number of
+// converted links.
+func Convert(path string) (int, error) {
+	stage := filepath.Join(path, staging)
+	if err := os.MkdirAll(stage, 0755); err != nil {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), tmpPrefix) {
+			continue
+		}
+
+		if err := os.Rename(filepath.Join(path, f.Name()), filepath.Join(stage, f.Name())); err != nil {
+			return 0, err
+		}
+	}
+
+	p := &Provider{
+		Config: &Config{
+			Path:   path,
+			Layout: LayoutSharded,
+		},
+	}
+
+	files, err = ioutil.ReadDir(stage)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		alias := f.Name()
+		name := filepath.Join(stage, alias)
+		url, err := ioutil.ReadFile(name)
+		if err != nil {
+			return n, err
+		}
+
+		err = p.Store(string(url), alias)
+		if err == storage.ErrAlreadyExists {
+			// converted before being interrupted
+			if existing, _ := p.Get(alias); existing != string(bytes.TrimSpace(url)) {
+				return n, fmt.Errorf("%q already exists in the sharded layout with a different URL", alias)
+			}
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if err := os.Remove(name); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, os.Remove(stage)
+}
@@ -2,15 +2,37 @@ package file
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/kamaln7/klein/storage"
 )
 
+// Layouts
+const (
+	// LayoutFlat stores every URL in a single directory, in a file named
+	// after its alias. Aliases that aren't valid file names are rejected.
+	LayoutFlat = "flat"
+	// LayoutSharded spreads URLs over two levels of directories picked by a
+	// hash of the alias, in files named after the encoded alias.
+	LayoutSharded = "sharded"
+)
+
+// tmpPrefix marks files that are still being written
+const tmpPrefix = ".tmp-"
+
+// Errors
+var (
+	ErrInvalidAlias = errors.New("alias can't be stored as a file name")
+	ErrUnconverted  = errors.New("directory holds links in the flat layout, convert it before using the sharded layout")
+)
+
 // Provider implements a file-based storage system
 type Provider struct {
 	Config *Config
@@ -20,24 +42,67 @@ type Provider struct {
 // Config contains the configuration for the file storage
 type Config struct {
 	Path string
+	// Layout is LayoutFlat or LayoutSharded, defaults to LayoutFlat
+	Layout string
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+// ensure that the storage.Walker, storage.Deleter and storage.Counter interfaces are implemented
+var (
+	_ storage.Walker  = new(Provider)
+	_ storage.Deleter = new(Provider)
+	_ storage.Counter = new(Provider)
+)
 
 // New returns a new Provider instance
-func New(c *Config) *Provider {
+func New(c *Config) (*Provider, error) {
+	switch c.Layout {
+	case "":
+		c.Layout = LayoutFlat
+	case LayoutFlat:
+	case LayoutSharded:
+		flat, err := hasFlatLinks(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		if flat {
+			return nil, ErrUnconverted
+		}
+	default:
+		return nil, errors.New("unknown file storage layout")
+	}
+
 	return &Provider{
 		Config: c,
+	}, nil
+}
+
+// filename returns the path an alias is stored at
+func (p *Provider) filename(alias string) (string, error) {
+	if p.Config.Layout == LayoutFlat {
+		if alias == "" || alias == "." || alias == ".." || strings.HasPrefix(alias, tmpPrefix) || strings.ContainsAny(alias, "/\\\x00") {
+			return "", ErrInvalidAlias
+		}
+
+		return filepath.Join(p.Config.Path, alias), nil
 	}
+
+	name := encode(alias)
+	if len(name) > 255 {
+		return "", ErrInvalidAlias
+	}
+
+	return filepath.Join(p.Config.Path, shard(alias), name), nil
 }
 
 // Get attempts to find a URL by its alias and returns its original URL
 func (p *Provider) Get(alias string) (string, error) {
-	alias = path.Base(alias)
+	name, err := p.filename(alias)
+	if err != nil {
+		return "", storage.ErrNotFound
+	}
 
 	p.mutex.RLock()
-	url, err := ioutil.ReadFile(filepath.Join(p.Config.Path, alias))
+	url, err := ioutil.ReadFile(name)
 	p.mutex.RUnlock()
 	if err != nil {
 		return "", storage.ErrNotFound
@@ -48,27 +113,224 @@ func (p *Provider) Get(alias string) (string, error) {
 
 // Exists checks if there is a URL with the requested alias
 func (p *Provider) Exists(alias string) (bool, error) {
+	name, err := p.filename(alias)
+	if err != nil {
+		return false, nil
+	}
+
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 
-	_, err := os.Stat(filepath.Join(p.Config.Path, path.Base(alias)))
+	_, err = os.Stat(name)
 	return !os.IsNotExist(err), nil
 }
 
-// Store creates a new short URL
+// Store creates a new short URL. The URL is written to a temporary file
+// first, which is then linked into place so that readers never see a
+// partial file and an existing alias is never replaced.
 func (p *Provider) Store(url, alias string) error {
-	exists, _ := p.Exists(alias)
-	if exists {
-		return storage.ErrAlreadyExists
+	name, err := p.filename(alias)
+	if err != nil {
+		return err
 	}
+	dir := filepath.Dir(name)
 
 	p.mutex.Lock()
-	err := ioutil.WriteFile(filepath.Join(p.Config.Path, alias), bytes.TrimSpace([]byte(url)), 0644)
-	p.mutex.Unlock()
+	defer p.mutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(bytes.TrimSpace([]byte(url)))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	err = os.Link(tmp.Name(), name)
+	switch {
+	case err == nil:
+		return nil
+	case os.IsExist(err):
+		return storage.ErrAlreadyExists
+	}
+
+	// the filesystem doesn't support hard links, fall back to renaming,
+	// which only guards against other writers in this process
+	if _, err := os.Lstat(name); err == nil {
+		return storage.ErrAlreadyExists
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Walk calls fn for every stored URL
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	return p.walk(func(alias string) error {
+		url, err := p.Get(alias)
+		if err == storage.ErrNotFound {
+			// deleted since the directory was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fn(alias, url)
+	})
+}
+
+// walk calls fn with every stored alias
+func (p *Provider) walk(fn func(alias string) error) error {
+	if p.Config.Layout == LayoutFlat {
+		p.mutex.RLock()
+		files, err := ioutil.ReadDir(p.Config.Path)
+		p.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), tmpPrefix) {
+				continue
+			}
+
+			if err := fn(f.Name()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
 
+	shards, err := filepath.Glob(filepath.Join(p.Config.Path, "[0-9a-f][0-9a-f]", "[0-9a-f][0-9a-f]"))
 	if err != nil {
 		return err
 	}
 
+	for _, dir := range shards {
+		p.mutex.RLock()
+		files, err := ioutil.ReadDir(dir)
+		p.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+
+			alias, err := decode(f.Name())
+			if err != nil {
+				// not ours
+				continue
+			}
+
+			if err := fn(alias); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	name, err := p.filename(alias)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	}
+
+	return err
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	n := 0
+	err := p.walk(func(alias string) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// shard returns the directory, relative to the root, that an alias is stored in
+func shard(alias string) string {
+	sum := sha256.Sum256([]byte(alias))
+	h := hex.EncodeToString(sum[:2])
+
+	return filepath.Join(h[:2], h[2:])
+}
+
+// encode turns an alias into a file name that is safe on every filesystem,
+// including case-insensitive ones. Lowercase letters, digits, dashes and
+// dots are kept, except for a leading dot, everything else is written as
+// %XX using lowercase hex.
+func encode(alias string) string {
+	var b strings.Builder
+	for i := 0; i < len(alias); i++ {
+		c := alias[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteString(hex.EncodeToString([]byte{c}))
+		}
+	}
+
+	return b.String()
+}
+
+// decode reverses encode. Names that encode wouldn't have produced are rejected.
+func decode(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+
+		if i+3 > len(name) {
+			return "", ErrInvalidAlias
+		}
+		c, err := hex.DecodeString(name[i+1 : i+3])
+		if err != nil {
+			return "", ErrInvalidAlias
+		}
+		b.WriteByte(c[0])
+		i += 2
+	}
+
+	alias := b.String()
+	if encode(alias) != name {
+		return "", ErrInvalidAlias
+	}
+
+	return alias, nil
+}
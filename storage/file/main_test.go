@@ -3,11 +3,25 @@ package file
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/kamaln7/klein/storage"
 	"github.com/kamaln7/klein/storage/storagetest"
 )
 
+func newProvider(t testing.TB, layout string) *Provider {
+	p, err := New(&Config{
+		Path:   t.TempDir(),
+		Layout: layout,
+	})
+	if err != nil {
+		t.Fatalf("couldn't init file storage: %v\n", err)
+	}
+
+	return p
+}
+
 func TestProvider(t *testing.T) {
 	dir, err := ioutil.TempDir("", "klein")
 	if err != nil {
@@ -15,9 +29,152 @@ func TestProvider(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	p := New(&Config{
+	p, err := New(&Config{
 		Path: dir,
 	})
+	if err != nil {
+		t.Fatalf("couldn't init file storage: %v\n", err)
+	}
+
+	storagetest.RunTests(p, t)
+}
+
+func TestSharded(t *testing.T) {
+	storagetest.RunTests(newProvider(t, LayoutSharded), t)
+}
+
+func TestAliases(t *testing.T) {
+	p := newProvider(t, LayoutSharded)
+
+	aliases := []string{"a/b", "b", "Abc", "abc", "🦄", ".hidden", "..", "100%", "%41", "with space"}
+	for _, alias := range aliases {
+		if err := p.Store("http://example.com/"+alias, alias); err != nil {
+			t.Fatalf("couldn't store %q: %v", alias, err)
+		}
+	}
+
+	for _, alias := range aliases {
+		if url, err := p.Get(alias); err != nil || url != "http://example.com/"+alias {
+			t.Errorf("expected %q to round trip, got %q, %v", alias, url, err)
+		}
+	}
+
+	walked := make(map[string]bool)
+	p.Walk(func(alias, url string) error {
+		walked[alias] = true
+		return nil
+	})
+	for _, alias := range aliases {
+		if !walked[alias] {
+			t.Errorf("expected to walk over %q", alias)
+		}
+	}
+	if len(walked) != len(aliases) {
+		t.Errorf("expected to walk over %d aliases, got %d", len(aliases), len(walked))
+	}
+
+	// names are lowercase only, so they can't collide on case-insensitive filesystems
+	for _, alias := range aliases {
+		name := encode(alias)
+		for _, c := range name {
+			if c >= 'A' && c <= 'Z' {
+				t.Errorf("expected %q to be encoded without uppercase letters, got %q", alias, name)
+			}
+		}
+	}
+}
+
+func TestFlatAliases(t *testing.T) {
+	p := newProvider(t, LayoutFlat)
+
+	// a/b used to be stored as b
+	if err := p.Store("http://example.com", "a/b"); err != ErrInvalidAlias {
+		t.Errorf("expected ErrInvalidAlias, got %v", err)
+	}
+	if _, err := p.Get("b"); err != storage.ErrNotFound {
+		t.Errorf("expected b not to exist, got %v", err)
+	}
+	if _, err := p.Get("../b"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAtomicWrites(t *testing.T) {
+	p := newProvider(t, LayoutSharded)
+	if err := p.Store("http://example.com", "example"); err != nil {
+		t.Fatalf("couldn't store alias: %v", err)
+	}
+
+	// a temporary file left over by a crash is ignored
+	dir := filepath.Join(p.Config.Path, shard("other"))
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, tmpPrefix+"123"), []byte("http://example.org"), 0644)
+
+	if n, err := p.Count(); err != nil || n != 1 {
+		t.Errorf("expected 1 link, got %d, %v", n, err)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Join(p.Config.Path, shard("example")))
+	if len(files) != 1 {
+		t.Errorf("expected the temporary file to be cleaned up, got %d files", len(files))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	flat, err := New(&Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't init file storage: %v\n", err)
+	}
+
+	aliases := []string{"ab", "Ab", "example", "00", ".hidden"}
+	for _, alias := range aliases {
+		flat.Store("http://example.com/"+alias, alias)
+	}
+	if count, _ := flat.Count(); count != len(aliases) {
+		t.Errorf("expected %d links before converting, got %d", len(aliases), count)
+	}
+	// left behind by an interrupted write
+	ioutil.WriteFile(filepath.Join(dir, tmpPrefix+"123"), []byte("http://example.com/tmp"), 0644)
 
-	storagetest.RunBasicTests(p, t)
+	if _, err := New(&Config{Path: dir, Layout: LayoutSharded}); err != ErrUnconverted {
+		t.Errorf("expected ErrUnconverted, got %v", err)
+	}
+
+	// pretend an earlier conversion was interrupted after converting one link
+	os.MkdirAll(filepath.Join(dir, staging), 0755)
+	os.Rename(filepath.Join(dir, "example"), filepath.Join(dir, staging, "example"))
+	partial := &Provider{Config: &Config{Path: dir, Layout: LayoutSharded}}
+	partial.Store("http://example.com/example", "example")
+
+	n, err := Convert(dir)
+	if err != nil {
+		t.Fatalf("couldn't convert: %v", err)
+	}
+	if n != len(aliases) {
+		t.Errorf("expected to convert %d links, got %d", len(aliases), n)
+	}
+
+	p, err := New(&Config{Path: dir, Layout: LayoutSharded})
+	if err != nil {
+		t.Fatalf("couldn't open converted directory: %v", err)
+	}
+	for _, alias := range aliases {
+		if url, err := p.Get(alias); err != nil || url != "http://example.com/"+alias {
+			t.Errorf("expected %q to be converted, got %q, %v", alias, url, err)
+		}
+	}
+	if count, _ := p.Count(); count != len(aliases) {
+		t.Errorf("expected %d links after converting, got %d", len(aliases), count)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	for _, layout := range []string{LayoutFlat, LayoutSharded} {
+		b.Run(layout, func(b *testing.B) {
+			storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+				return newProvider(b, layout)
+			}, b)
+		})
+	}
 }
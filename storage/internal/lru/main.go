@@ -0,0 +1,151 @@
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// entry is a single cached lookup. A nil url records an alias that does not exist.
+type entry struct {
+	alias   string
+	url     *string
+	expires time.Time
+}
+
+// expired reports whether the entry has outlived its ttl. Entries cached
+// without a ttl never expire.
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// Cache is a size-capped map of aliases to URLs that evicts the least
+// recently used entry once it is full. Every entry carries its own expiry
+// time. It is safe for concurrent use.
+type Cache struct {
+	size int
+
+	mutex sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+// New returns a Cache that holds up to size entries. 0 means unlimited.
+func New(size int) *Cache {
+	return &Cache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns an unexpired entry and marks it as recently used. The url is
+// nil if the alias was cached as missing.
+func (c *Cache) Get(alias string) (url *string, found bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[alias]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if e.expired(time.Now()) {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return e.url, true
+}
+
+// Set caches a lookup for ttl, evicting the oldest entries if the cache is
+// full. A ttl of 0 keeps the entry until it is evicted or deleted.
+func (c *Cache) Set(alias string, url *string, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.set(alias, url, ttl)
+}
+
+// Add caches a lookup unless the alias already has an unexpired entry, so a
+// miss read before a concurrent store can't hide the newly stored URL
+func (c *Cache) Add(alias string, url *string, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[alias]; ok && !el.Value.(*entry).expired(time.Now()) {
+		return
+	}
+	c.set(alias, url, ttl)
+}
+
+func (c *Cache) set(alias string, url *string, ttl time.Duration) {
+	e := &entry{
+		alias: alias,
+		url:   url,
+	}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+
+	if el, ok := c.items[alias]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[alias] = c.order.PushFront(e)
+	for c.size > 0 && c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete drops an alias from the cache
+func (c *Cache) Delete(alias string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[alias]; ok {
+		c.remove(el)
+	}
+}
+
+// DeleteExpired drops every expired entry. Expired entries are otherwise
+// only dropped when they are looked up or evicted.
+func (c *Cache) DeleteExpired() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*entry).expired(now) {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// Clear drops every entry
+func (c *Cache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// Len returns the number of cached entries, including expired ones that have not been dropped yet
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).alias)
+}
@@ -0,0 +1,56 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func url(s string) *string {
+	return &s
+}
+
+func TestEviction(t *testing.T) {
+	c := New(2)
+
+	c.Set("a", url("http://example.com/a"), 0)
+	c.Set("b", url("http://example.com/b"), 0)
+	c.Get("a")
+	c.Set("c", url("http://example.com/c"), 0)
+
+	if _, found := c.Get("b"); found {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if u, found := c.Get("a"); !found || *u != "http://example.com/a" {
+		t.Errorf("expected the recently used entry to stay cached, got %v", u)
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := New(0)
+
+	c.Set("missing", nil, 10*time.Millisecond)
+	c.Set("forever", url("http://example.com"), 0)
+
+	if u, found := c.Get("missing"); !found || u != nil {
+		t.Errorf("expected a cached miss, got %v (%v)", u, found)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Add only replaces expired entries
+	c.Add("forever", nil, time.Minute)
+	if u, found := c.Get("forever"); !found || u == nil {
+		t.Error("expected entries without a ttl not to expire")
+	}
+
+	c.DeleteExpired()
+	if n := c.Len(); n != 1 {
+		t.Errorf("expected the expired entry to be dropped, got %d entries", n)
+	}
+	if _, found := c.Get("missing"); found {
+		t.Error("expected the entry to expire")
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"io"
 )
 
 // A Provider implements all the necessary functions for a storage backend for URLs
@@ -11,8 +12,64 @@ type Provider interface {
 	Store(url, alias string) error
 }
 
+// A Walker is a Provider that can list every URL it stores.
+// Walk calls fn once for every alias and stops at the first error fn returns.
+type Walker interface {
+	Provider
+	Walk(fn func(alias, url string) error) error
+}
+
+// A Deleter is a Provider that can remove stored URLs.
+// Delete returns ErrNotFound if the alias does not exist.
+type Deleter interface {
+	Provider
+	Delete(alias string) error
+}
+
+// A Replacer is a Provider that can point an existing alias at a new URL in
+// one step. Replace returns ErrNotFound if the alias does not exist.
+type Replacer interface {
+	Provider
+	Replace(url, alias string) error
+}
+
+// A Counter is a Provider that can cheaply count the URLs it stores
+type Counter interface {
+	Provider
+	Count() (int, error)
+}
+
+// An Invalidator is a Provider that caches lookups. Invalidate drops any
+// cached entry for an alias so that the next lookup goes to the backend.
+type Invalidator interface {
+	Provider
+	Invalidate(alias string)
+}
+
+// A StatsReporter is a Provider that keeps its own usage counters, such as cache hits
+type StatsReporter interface {
+	Provider
+	Stats() map[string]uint64
+}
+
+// A Backuper is a Provider that can write a consistent copy of everything
+// it stores, in its own format, while it keeps serving requests
+type Backuper interface {
+	Provider
+	Backup(w io.Writer) (int64, error)
+}
+
+// A CreatorRecorder is a Provider that can keep who created a link along with it
+type CreatorRecorder interface {
+	Provider
+	StoreCreatedBy(url, alias, creator string) error
+}
+
 // Errors
 var (
 	ErrNotFound      = errors.New("URL does not exist")
 	ErrAlreadyExists = errors.New("Alias already exists")
+	// ErrNotSupported is returned by wrapping providers when the provider
+	// they wrap does not support an operation
+	ErrNotSupported = errors.New("not supported by the storage driver")
 )
@@ -1,6 +1,9 @@
 package memory
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/kamaln7/klein/storage"
 )
 
@@ -8,15 +11,21 @@ import (
 type Provider struct {
 	Config *Config
 
-	urls map[string]string
+	mutex sync.RWMutex
+	urls  map[string]string
 }
 
 // Config contains the configuration for the in-memory storage
 type Config struct {
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+// ensure that the storage.Walker, storage.Deleter, storage.Replacer and storage.Counter interfaces are implemented
+var (
+	_ storage.Walker   = new(Provider)
+	_ storage.Deleter  = new(Provider)
+	_ storage.Replacer = new(Provider)
+	_ storage.Counter  = new(Provider)
+)
 
 // New returns a new Provider instance
 func New(c *Config) *Provider {
@@ -28,6 +37,9 @@ func New(c *Config) *Provider {
 
 // Get attempts to find a URL by its alias and returns its original URL
 func (p *Provider) Get(alias string) (string, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
 	url, found := p.urls[alias]
 	if !found {
 		return "", storage.ErrNotFound
@@ -38,6 +50,9 @@ func (p *Provider) Get(alias string) (string, error) {
 
 // Exists checks if there is a URL with the requested alias
 func (p *Provider) Exists(alias string) (bool, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
 	_, found := p.urls[alias]
 
 	return found, nil
@@ -45,11 +60,67 @@ func (p *Provider) Exists(alias string) (bool, error) {
 
 // Store creates a new short URL
 func (p *Provider) Store(url, alias string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	_, found := p.urls[alias]
 	if found {
 		return storage.ErrAlreadyExists
 	}
 
-	p.urls[alias] = url
+	p.urls[alias] = strings.TrimSpace(url)
+	return nil
+}
+
+// Walk calls fn for every stored URL. URLs stored while walking may or may not be seen.
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	// copy the links, so that fn can store or delete without deadlocking
+	p.mutex.RLock()
+	urls := make(map[string]string, len(p.urls))
+	for alias, url := range p.urls {
+		urls[alias] = url
+	}
+	p.mutex.RUnlock()
+
+	for alias, url := range urls {
+		if err := fn(alias, url); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, found := p.urls[alias]; !found {
+		return storage.ErrNotFound
+	}
+
+	delete(p.urls, alias)
+	return nil
+}
+
+// Replace points an existing alias at a new URL
+func (p *Provider) Replace(url, alias string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, found := p.urls[alias]; !found {
+		return storage.ErrNotFound
+	}
+
+	p.urls[alias] = strings.TrimSpace(url)
+	return nil
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return len(p.urls), nil
+}
@@ -3,11 +3,18 @@ package memory
 import (
 	"testing"
 
+	"github.com/kamaln7/klein/storage"
 	"github.com/kamaln7/klein/storage/storagetest"
 )
 
 func TestProvider(t *testing.T) {
 	p := New(&Config{})
 
-	storagetest.RunBasicTests(p, t)
+	storagetest.RunTests(p, t)
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		return New(&Config{})
+	}, b)
 }
@@ -0,0 +1,257 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/kamaln7/klein/storage"
+)
+
+// Provider implements a MySQL/MariaDB-based storage system
+type Provider struct {
+	Config *Config
+	db     *sqlx.DB
+}
+
+// Config contains the configuration for the MySQL server and database
+type Config struct {
+	Host, User, Password, Database, Table string
+	Port                                  int32
+	// TLSMode is one of disable, preferred, skip-verify or verify-full
+	TLSMode string
+	// TLSCA is an optional path to a PEM CA bundle used to verify the server
+	TLSCA string
+}
+
+// ensure that the storage.Walker, storage.Deleter, storage.Counter and storage.CreatorRecorder interfaces are implemented
+var (
+	_ storage.Walker          = new(Provider)
+	_ storage.Deleter         = new(Provider)
+	_ storage.Counter         = new(Provider)
+	_ storage.CreatorRecorder = new(Provider)
+)
+
+// MySQL error numbers
+const (
+	// errDuplicateColumn is returned when adding a column that exists
+	errDuplicateColumn = 1060
+	// errDuplicateEntry is returned for unique key violations
+	errDuplicateEntry = 1062
+)
+
+// New returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	provider := &Provider{
+		Config: c,
+	}
+	err := provider.Init()
+	if err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// Init sets up the MySQL database connection and creates the table if needed
+func (p *Provider) Init() error {
+	mc := mysql.NewConfig()
+	mc.Net = "tcp"
+	mc.Addr = net.JoinHostPort(p.Config.Host, strconv.Itoa(int(p.Config.Port)))
+	mc.User = p.Config.User
+	mc.Passwd = p.Config.Password
+	mc.DBName = p.Config.Database
+
+	tc, err := p.tlsConfig()
+	if err != nil {
+		return err
+	}
+	mc.TLS = tc
+	mc.AllowFallbackToPlaintext = p.Config.TLSMode == "preferred"
+
+	// a connector keeps the TLS config, which a DSN can only refer to by name
+	connector, err := mysql.NewConnector(mc)
+	if err != nil {
+		return err
+	}
+	db := sqlx.NewDb(sql.OpenDB(connector), "mysql")
+	p.db = db
+
+	// create table if it doesn't already exist
+	if err := p.createTable(); err != nil {
+		db.Close()
+		return err
+	}
+
+	return nil
+}
+
+// tlsConfig returns the TLS settings for Config.TLSMode, or nil to connect without TLS
+func (p *Provider) tlsConfig() (*tls.Config, error) {
+	switch p.Config.TLSMode {
+	case "disable", "preferred", "skip-verify":
+		if p.Config.TLSCA != "" {
+			return nil, fmt.Errorf("the TLS CA bundle is only used to verify the server, which the %s tls mode doesn't do", p.Config.TLSMode)
+		}
+	}
+
+	switch p.Config.TLSMode {
+	case "disable":
+		return nil, nil
+	case "preferred", "skip-verify":
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	case "verify-full":
+		tc := &tls.Config{ServerName: p.Config.Host}
+		if p.Config.TLSCA != "" {
+			pem, err := ioutil.ReadFile(p.Config.TLSCA)
+			if err != nil {
+				return nil, err
+			}
+
+			tc.RootCAs = x509.NewCertPool()
+			if !tc.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("could not parse the TLS CA bundle")
+			}
+		}
+
+		return tc, nil
+	default:
+		return nil, errors.New("tls mode is invalid")
+	}
+}
+
+// Close closes the database connection pool
+func (p *Provider) Close() error {
+	return p.db.Close()
+}
+
+func (p *Provider) fillInTableName(query string) string {
+	return fmt.Sprintf(query, "`"+strings.Replace(p.Config.Table, "`", "``", -1)+"`")
+}
+
+func (p *Provider) createTable() error {
+	q := p.fillInTableName(`
+	create table if not exists %s (
+		id bigint unsigned not null auto_increment,
+		alias varchar(255) not null,
+		url text not null,
+		created_by varchar(255) null,
+		primary key (id),
+		unique key alias (alias)
+	) character set utf8mb4 collate utf8mb4_bin`)
+
+	if _, err := p.db.Exec(q); err != nil {
+		return err
+	}
+
+	// tables created before creators were recorded lack the column
+	var n int
+	err := p.db.Get(&n, "select count(*) from information_schema.columns where table_schema = database() and table_name = ? and column_name = 'created_by'", p.Config.Table)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	_, err = p.db.Exec(p.fillInTableName("alter table %s add column created_by varchar(255) null"))
+	// another instance added it first
+	if err, ok := err.(*mysql.MySQLError); ok && err.Number == errDuplicateColumn {
+		return nil
+	}
+	return err
+}
+
+// Get attempts to find a URL by its alias and returns its original URL
+func (p *Provider) Get(alias string) (string, error) {
+	var url string
+	err := p.db.Get(&url, p.fillInTableName("select url from %s where alias = ?"), alias)
+	if err == sql.ErrNoRows {
+		return "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return url, nil
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	_, err := p.Get(alias)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+
+	return true, err
+}
+
+// Store creates a new short URL
+func (p *Provider) Store(url, alias string) error {
+	return p.StoreCreatedBy(url, alias, "")
+}
+
+// StoreCreatedBy creates a new short URL and records who created it
+func (p *Provider) StoreCreatedBy(url, alias, creator string) error {
+	url = strings.TrimSpace(url)
+
+	_, err := p.db.Exec(p.fillInTableName("insert into %s (url, alias, created_by) values (?, ?, ?)"), url, alias, sql.NullString{String: creator, Valid: creator != ""})
+	if err, ok := err.(*mysql.MySQLError); ok && err.Number == errDuplicateEntry {
+		return storage.ErrAlreadyExists
+	}
+
+	return err
+}
+
+// Walk calls fn for every stored URL, in insertion order
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	rows, err := p.db.Queryx(p.fillInTableName("select alias, url from %s order by id"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias, url string
+		if err := rows.Scan(&alias, &url); err != nil {
+			return err
+		}
+
+		if err := fn(alias, url); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	res, err := p.db.Exec(p.fillInTableName("delete from %s where alias = ?"), alias)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	var n int
+	err := p.db.Get(&n, p.fillInTableName("select count(*) from %s"))
+
+	return n, err
+}
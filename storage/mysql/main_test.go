@@ -0,0 +1,226 @@
+package mysql
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	gosql "database/sql"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	"github.com/dolthub/go-mysql-server/sql"
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+// startStandIn runs an in-process MySQL-compatible server backed by memory.
+// With a TLS config, it only accepts TLS connections.
+func startStandIn(t testing.TB, tc *tls.Config) (*server.Server, string, int32) {
+	pro := memory.NewDBProvider(memory.NewDatabase("klein"))
+	s, err := server.NewServer(server.Config{
+		Protocol:               "tcp",
+		Address:                "127.0.0.1:0",
+		TLSConfig:              tc,
+		RequireSecureTransport: tc != nil,
+	}, sqle.NewDefault(pro), sql.NewContext, memory.NewSessionBuilder(pro), nil)
+	if err != nil {
+		t.Fatalf("couldn't start mysql stand-in: %v\n", err)
+	}
+	go s.Start()
+
+	addr := s.Listener.Addr().(*net.TCPAddr)
+	return s, addr.IP.String(), int32(addr.Port)
+}
+
+func TestProvider(t *testing.T) {
+	s, host, port := startStandIn(t, nil)
+	defer s.Close()
+
+	p, err := New(&Config{
+		Host:     host,
+		Port:     port,
+		User:     "root",
+		Database: "klein",
+		Table:    "klein",
+		TLSMode:  "disable",
+	})
+	if err != nil {
+		t.Fatalf("couldn't connect to mysql stand-in: %v\n", err)
+	}
+	defer p.Close()
+
+	// the stand-in's in-memory tables lose writes made concurrently over
+	// separate connections, which a real server wouldn't
+	p.db.SetMaxOpenConns(1)
+
+	storagetest.RunTests(p, t)
+}
+
+func TestTLS(t *testing.T) {
+	cert, ca := newCertificate(t)
+	_, otherCA := newCertificate(t)
+
+	s, host, port := startStandIn(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer s.Close()
+
+	for name, tc := range map[string]struct {
+		mode, ca string
+		ok       bool
+	}{
+		"verify-full":                 {"verify-full", ca, true},
+		"verify-full with another ca": {"verify-full", otherCA, false},
+		"skip-verify":                 {"skip-verify", "", true},
+		"preferred":                   {"preferred", "", true},
+		"disable":                     {"disable", "", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, err := New(&Config{
+				Host:     host,
+				Port:     port,
+				User:     "root",
+				Database: "klein",
+				Table:    "klein",
+				TLSMode:  tc.mode,
+				TLSCA:    tc.ca,
+			})
+			if err == nil {
+				p.Close()
+			}
+
+			if tc.ok && err != nil {
+				t.Errorf("expected to connect over tls, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected the connection to be refused")
+			}
+		})
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	_, ca := newCertificate(t)
+
+	for _, mode := range []string{"disable", "preferred", "skip-verify"} {
+		if _, err := New(&Config{TLSMode: mode, TLSCA: ca}); err == nil {
+			t.Errorf("expected a CA bundle to be rejected in the %s tls mode", mode)
+		}
+	}
+}
+
+func newCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "klein test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create certificate: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("couldn't write certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestCreatedBy(t *testing.T) {
+	s, host, port := startStandIn(t, nil)
+	defer s.Close()
+
+	c := &Config{
+		Host:     host,
+		Port:     port,
+		User:     "root",
+		Database: "klein",
+		Table:    "klein",
+		TLSMode:  "disable",
+	}
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't connect to mysql stand-in: %v\n", err)
+	}
+	defer p.Close()
+
+	// a table created before creators were recorded
+	if _, err := p.db.Exec("create table old (id bigint unsigned not null auto_increment, alias varchar(255) not null, url text not null, primary key (id), unique key alias (alias))"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.db.Exec("insert into old (url, alias) values ('http://example.com', 'example')"); err != nil {
+		t.Fatal(err)
+	}
+	oc := *c
+	oc.Table = "old"
+	old, err := New(&oc)
+	if err != nil {
+		t.Fatalf("couldn't upgrade the table: %v", err)
+	}
+	defer old.Close()
+
+	for _, p := range []*Provider{p, old} {
+		if err := p.StoreCreatedBy("http://example.com/alice", "alice", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Store("http://example.com/anonymous", "anonymous"); err != nil {
+			t.Fatal(err)
+		}
+
+		var creators []gosql.NullString
+		if err := p.db.Select(&creators, p.fillInTableName("select created_by from %s where alias in ('alice', 'anonymous') order by id")); err != nil {
+			t.Fatal(err)
+		}
+		if len(creators) != 2 || creators[0].String != "alice" || creators[1].Valid {
+			t.Errorf("%s: expected alice and no creator, got %v", p.Config.Table, creators)
+		}
+	}
+	if url, err := old.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected existing links to be kept, got %q, %v", url, err)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		s, host, port := startStandIn(b, nil)
+		b.Cleanup(func() { s.Close() })
+
+		p, err := New(&Config{
+			Host:     host,
+			Port:     port,
+			User:     "root",
+			Database: "klein",
+			Table:    "klein",
+			TLSMode:  "disable",
+		})
+		if err != nil {
+			b.Fatalf("couldn't connect to mysql stand-in: %v\n", err)
+		}
+		b.Cleanup(func() { p.Close() })
+		p.db.SetMaxOpenConns(1)
+
+		return p
+	}, b, 100, 1000)
+}
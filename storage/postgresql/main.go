@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx"
 	pgxstdlib "github.com/jackc/pgx/stdlib"
@@ -23,98 +26,164 @@ type Provider struct {
 type Config struct {
 	Host, User, Password, Database, Table, SSLMode string
 	Port                                           int32
-}
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+	// DSN is a connection URL or key=value string. When set, it is used
+	// instead of the connection settings above.
+	DSN string
+	// Schema to keep the table in. Defaults to the connection's search_path.
+	Schema string
+
+	// MaxOpenConns and MaxIdleConns size the connection pool, 0 means the database/sql defaults
+	MaxOpenConns int
+	MaxIdleConns int
+	// StatementTimeout aborts queries that take longer, 0 disables it
+	StatementTimeout time.Duration
 
-// database url type
-type url struct {
-	ID         int
-	URL, Alias string
+	// Migrate applies pending schema migrations on startup. Otherwise,
+	// startup fails until they are applied with Migrate.
+	Migrate bool
 }
 
-// New returns a new Provider instance
+// ensure that the storage.Walker, storage.Deleter, storage.Replacer, storage.Counter and storage.CreatorRecorder interfaces are implemented
+var (
+	_ storage.Walker          = new(Provider)
+	_ storage.Deleter         = new(Provider)
+	_ storage.Replacer        = new(Provider)
+	_ storage.Counter         = new(Provider)
+	_ storage.CreatorRecorder = new(Provider)
+)
+
+// ErrOutdatedSchema is returned by New when migrations are pending and Config.Migrate is off
+var ErrOutdatedSchema = errors.New("database schema is outdated, apply the pending migrations")
+
+// New returns a new Provider instance with an up to date schema
 func New(c *Config) (*Provider, error) {
-	provider := &Provider{
-		Config: c,
+	provider, err := Connect(c)
+	if err != nil {
+		return nil, err
 	}
 
-	err := provider.Init()
+	err = provider.Init()
 	if err != nil {
+		provider.Close()
 		return nil, err
 	}
 
 	return provider, nil
 }
 
-// Init sets up the PostgreSQL database connection and creates the table if needed
-func (p *Provider) Init() error {
-	cc := pgx.ConnConfig{
-		Host:     p.Config.Host,
-		Port:     uint16(p.Config.Port),
-		User:     p.Config.User,
-		Password: p.Config.Password,
-		Database: p.Config.Database,
-	}
-
-	// Copied from https://github.com/jackc/pgx/blob/f25025a5801f9c925f4a7ffea5636bf53755c67e/conn.go#L976-L997
-	switch p.Config.SSLMode {
-	case "disable":
-		cc.UseFallbackTLS = false
-		cc.TLSConfig = nil
-		cc.FallbackTLSConfig = nil
-	case "allow":
-		cc.UseFallbackTLS = true
-		cc.FallbackTLSConfig = &tls.Config{InsecureSkipVerify: true}
-	case "prefer":
-		cc.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-		cc.UseFallbackTLS = true
-		cc.FallbackTLSConfig = nil
-	case "require":
-		cc.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	case "verify-ca", "verify-full":
-		cc.TLSConfig = &tls.Config{
-			ServerName: cc.Host,
-		}
-	default:
-		return errors.New("sslmode is invalid")
+// Connect returns a new Provider instance without checking the schema,
+// for managing migrations
+func Connect(c *Config) (*Provider, error) {
+	provider := &Provider{
+		Config: c,
+	}
+
+	cc, err := provider.connConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	db := pgxstdlib.OpenDB(cc)
-	p.db = sqlx.NewDb(db, "pgx")
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	provider.db = sqlx.NewDb(db, "pgx")
+
+	return provider, nil
+}
 
-	// create table if it doesn't already exist
-	if err := p.createTable(); err != nil {
+// Init brings the schema up to date, or checks that it is if Config.Migrate is off
+func (p *Provider) Init() error {
+	pending, err := p.Pending()
+	if err != nil {
 		return err
 	}
+	if len(pending) == 0 {
+		return nil
+	}
 
-	return nil
+	if !p.Config.Migrate {
+		return ErrOutdatedSchema
+	}
+	_, err = p.Migrate()
+	return err
 }
 
-func (p *Provider) fillInTableName(query string) string {
-	return fmt.Sprintf(query, p.Config.Table)
+// connConfig builds the pgx connection settings
+func (p *Provider) connConfig() (pgx.ConnConfig, error) {
+	var cc pgx.ConnConfig
+	if p.Config.DSN != "" {
+		var err error
+		cc, err = pgx.ParseConnectionString(p.Config.DSN)
+		if err != nil {
+			return cc, fmt.Errorf("could not parse the postgresql dsn: %s", err.Error())
+		}
+	} else {
+		cc = pgx.ConnConfig{
+			Host:     p.Config.Host,
+			Port:     uint16(p.Config.Port),
+			User:     p.Config.User,
+			Password: p.Config.Password,
+			Database: p.Config.Database,
+		}
+
+		// Copied from https://github.com/jackc/pgx/blob/f25025a5801f9c925f4a7ffea5636bf53755c67e/conn.go#L976-L997
+		switch p.Config.SSLMode {
+		case "disable":
+			cc.UseFallbackTLS = false
+			cc.TLSConfig = nil
+			cc.FallbackTLSConfig = nil
+		case "allow":
+			cc.UseFallbackTLS = true
+			cc.FallbackTLSConfig = &tls.Config{InsecureSkipVerify: true}
+		case "prefer":
+			cc.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			cc.UseFallbackTLS = true
+			cc.FallbackTLSConfig = nil
+		case "require":
+			cc.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		case "verify-ca", "verify-full":
+			cc.TLSConfig = &tls.Config{
+				ServerName: cc.Host,
+			}
+		default:
+			return cc, errors.New("sslmode is invalid")
+		}
+	}
+
+	if p.Config.StatementTimeout > 0 {
+		if cc.RuntimeParams == nil {
+			cc.RuntimeParams = make(map[string]string)
+		}
+		cc.RuntimeParams["statement_timeout"] = strconv.FormatInt(int64(p.Config.StatementTimeout/time.Millisecond), 10)
+	}
+
+	return cc, nil
 }
 
-func (p *Provider) createTable() error {
-	q := p.fillInTableName(`
-	create table if not exists %s (
-		id serial,
-		alias text unique not null,
-		url text not null,
-		primary key( id )
-	)`)
+// table returns the quoted, schema-qualified name of a table. The suffix is appended to the configured table's name.
+func (p *Provider) table(suffix string) string {
+	ident := pgx.Identifier{p.Config.Table + suffix}
+	if p.Config.Schema != "" {
+		ident = pgx.Identifier{p.Config.Schema, p.Config.Table + suffix}
+	}
+
+	return ident.Sanitize()
+}
 
-	_, err := p.db.Exec(q)
-	return err
+// query fills the quoted table name into every %[1]s of a query
+func (p *Provider) query(q string) string {
+	return strings.Replace(q, "%[1]s", p.table(""), -1)
 }
 
 // Get attempts to find a URL by its alias and returns its original URL
 func (p *Provider) Get(alias string) (string, error) {
-	u := &url{}
-
-	q := p.fillInTableName("select * from %s where alias = $1")
-	err := p.db.Get(u, q, alias)
+	var url string
+	err := p.db.Get(&url, p.query("select url from %[1]s where alias = $1"), alias)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -124,7 +193,7 @@ func (p *Provider) Get(alias string) (string, error) {
 		return "", err
 	}
 
-	return u.URL, nil
+	return url, nil
 }
 
 // Exists checks if there is a URL with the requested alias
@@ -140,12 +209,91 @@ func (p *Provider) Exists(alias string) (bool, error) {
 
 // Store creates a new short URL
 func (p *Provider) Store(url, alias string) error {
-	q := p.fillInTableName("insert into %s (url, alias) values ($1, $2)")
-	_, err := p.db.Exec(q, url, alias)
+	return p.StoreCreatedBy(url, alias, "")
+}
 
-	if err, ok := err.(*pgx.PgError); ok && err.Code == "23505" {
+// StoreCreatedBy creates a new short URL and records who created it
+func (p *Provider) StoreCreatedBy(url, alias, creator string) error {
+	url = strings.TrimSpace(url)
+
+	_, err := p.db.Exec(p.query("insert into %[1]s (url, alias, created_by) values ($1, $2, $3)"), url, alias, sql.NullString{String: creator, Valid: creator != ""})
+
+	// pgx returns PgError values, not pointers
+	var pgErr pgx.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
 		return storage.ErrAlreadyExists
 	}
 
 	return err
 }
+
+// Walk calls fn for every stored URL, in insertion order
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	rows, err := p.db.Queryx(p.query("select alias, url from %[1]s order by id"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias, url string
+		if err := rows.Scan(&alias, &url); err != nil {
+			return err
+		}
+
+		if err := fn(alias, url); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	res, err := p.db.Exec(p.query("delete from %[1]s where alias = $1"), alias)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Replace points an existing alias at a new URL
+func (p *Provider) Replace(url, alias string) error {
+	res, err := p.db.Exec(p.query("update %[1]s set url = $1 where alias = $2"), strings.TrimSpace(url), alias)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	var n int
+	err := p.db.Get(&n, p.query("select count(*) from %[1]s"))
+
+	return n, err
+}
+
+// Close closes the database connections
+func (p *Provider) Close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,128 @@
+package postgresql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgx"
+)
+
+// migrations holds the schema changes, in order. A migration's version is
+// its index plus one. Migrations are only ever appended, and must be safe
+// to run against tables created before migrations were tracked. %[1]s is
+// replaced with the quoted table name.
+var migrations = []string{
+	// 1: the original table
+	`create table if not exists %[1]s (
+		id serial,
+		alias text unique not null,
+		url text not null,
+		primary key( id )
+	)`,
+	// 2: creation time, unknown for links created before
+	`alter table %[1]s add column if not exists created_at timestamptz default now()`,
+	// 3: who created links, null if nobody logged in or for links created before
+	`alter table %[1]s add column if not exists created_by text`,
+}
+
+// Version returns the version of the schema, 0 if no migrations were applied yet
+func (p *Provider) Version() (int, error) {
+	var exists bool
+	if err := p.db.Get(&exists, "select to_regclass($1) is not null", p.table("_migrations")); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	err := p.db.Get(&version, fmt.Sprintf("select max(version) from %s", p.table("_migrations")))
+
+	return int(version.Int64), err
+}
+
+// Pending returns the versions of the migrations that haven't been applied yet
+func (p *Provider) Pending() ([]int, error) {
+	version, err := p.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []int
+	for v := version + 1; v <= len(migrations); v++ {
+		pending = append(pending, v)
+	}
+
+	return pending, nil
+}
+
+// Migrate applies every pending migration, each in its own transaction,
+// and returns the versions it applied. Instances migrating at the same time
+// wait for each other.
+func (p *Provider) Migrate() ([]int, error) {
+	var applied []int
+	for {
+		v, err := p.migrateNext()
+		if err != nil {
+			return applied, fmt.Errorf("could not apply migration %d: %s", v, err.Error())
+		}
+		if v == 0 {
+			return applied, nil
+		}
+
+		applied = append(applied, v)
+	}
+}
+
+// migrateNext applies the next pending migration and returns its version, or 0 if there is none
+func (p *Provider) migrateNext() (int, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("select pg_advisory_xact_lock(hashtext($1))", p.table("")); err != nil {
+		return 0, err
+	}
+	if err := p.createMigrationsTable(tx); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := tx.Get(&version, fmt.Sprintf("select max(version) from %s", p.table("_migrations"))); err != nil {
+		return 0, err
+	}
+	next := int(version.Int64) + 1
+	if next > len(migrations) {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec(p.query(migrations[next-1])); err != nil {
+		return next, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("insert into %s (version) values ($1)", p.table("_migrations")), next); err != nil {
+		return next, err
+	}
+
+	return next, tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (p *Provider) createMigrationsTable(db execer) error {
+	if p.Config.Schema != "" {
+		if _, err := db.Exec(fmt.Sprintf("create schema if not exists %s", pgx.Identifier{p.Config.Schema}.Sanitize())); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`
+	create table if not exists %s (
+		version integer primary key,
+		applied_at timestamptz not null default now()
+	)`, p.table("_migrations")))
+	return err
+}
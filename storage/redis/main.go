@@ -1,26 +1,86 @@
 package redis
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/kamaln7/klein/storage"
+	"github.com/mediocregopher/radix.v2/cluster"
 	"github.com/mediocregopher/radix.v2/pool"
 	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/sentinel"
 )
 
 // Provider implements a redis-based storage system
 type Provider struct {
 	Config *Config
-	pool   *pool.Pool
+
+	tls *tls.Config
+
+	// exactly one of these is set, depending on the mode
+	pool     *pool.Pool
+	sentinel *sentinelClient
+	cluster  *cluster.Cluster
 }
 
 // Config contains the configuration for the redis storage
 type Config struct {
+	// Address is the redis server, or any node of the cluster in cluster mode
 	Address string
 	Auth    string
 	DB      int
+
+	// Prefix is prepended to every alias to build its key. Links can only be
+	// listed and counted with a prefix, since other keys in the database,
+	// such as the storage cache's, can't be told apart from them otherwise.
+	Prefix string
+
+	// PoolSize is the number of connections kept open per server. Defaults to 10.
+	PoolSize int
+	// DialTimeout, ReadTimeout and WriteTimeout default to no timeout
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// TLS connects to redis over TLS
+	TLS bool
+	// TLSCA is an optional path to a PEM CA bundle used to verify the server
+	TLSCA string
+	// TLSSkipVerify disables verification of the server's certificate
+	TLSSkipVerify bool
+
+	// SentinelAddresses enables Sentinel mode. They are tried in order to
+	// find the current master of SentinelMaster, Address is ignored. The
+	// sentinels themselves are always reached without auth or TLS.
+	SentinelAddresses []string
+	SentinelMaster    string
+
+	// Cluster enables Redis Cluster mode, using Address to discover the other nodes
+	Cluster bool
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+// cmder is implemented by everything that can run a redis command
+type cmder interface {
+	Cmd(cmd string, args ...interface{}) *redis.Resp
+}
+
+// ensure that the storage.Walker, storage.Deleter and storage.Counter interfaces are implemented
+var (
+	_ storage.Walker  = new(Provider)
+	_ storage.Deleter = new(Provider)
+	_ storage.Counter = new(Provider)
+)
+
+// ErrNoPrefix is returned when listing links without a key prefix. It wraps
+// storage.ErrNotSupported.
+var ErrNoPrefix = fmt.Errorf("%w without a key prefix, since other keys can't be told apart from links", storage.ErrNotSupported)
 
 // New returns a new Provider instance
 func New(c *Config) (*Provider, error) {
@@ -35,41 +95,164 @@ func New(c *Config) (*Provider, error) {
 	return provider, nil
 }
 
-// Init sets up the Redis pool
+// Init sets up the connection pools
 func (p *Provider) Init() error {
-	df := func(network, addr string) (*redis.Client, error) {
-		client, err := redis.Dial(network, addr)
+	if p.Config.PoolSize == 0 {
+		p.Config.PoolSize = 10
+	}
+
+	if p.Config.TLS {
+		p.tls = &tls.Config{InsecureSkipVerify: p.Config.TLSSkipVerify}
+		if p.Config.TLSCA != "" {
+			pem, err := ioutil.ReadFile(p.Config.TLSCA)
+			if err != nil {
+				return fmt.Errorf("could not read the TLS CA bundle: %s", err.Error())
+			}
+			p.tls.RootCAs = x509.NewCertPool()
+			if !p.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return errors.New("could not parse the TLS CA bundle")
+			}
+		}
+	}
+
+	switch {
+	case p.Config.Cluster && len(p.Config.SentinelAddresses) > 0:
+		return errors.New("redis can't use both sentinel and cluster mode")
+	case p.Config.Cluster:
+		if p.Config.DB != 0 {
+			return errors.New("redis cluster only supports db 0")
+		}
+
+		c, err := cluster.NewWithOpts(cluster.Opts{
+			Addr:     p.Config.Address,
+			PoolSize: p.Config.PoolSize,
+			Dialer:   p.dial,
+		})
 		if err != nil {
+			return err
+		}
+		p.cluster = c
+	case len(p.Config.SentinelAddresses) > 0:
+		if p.Config.SentinelMaster == "" {
+			return errors.New("redis sentinel mode needs the name of the master")
+		}
+
+		s := &sentinelClient{
+			addresses: p.Config.SentinelAddresses,
+			master:    p.Config.SentinelMaster,
+			poolSize:  p.Config.PoolSize,
+			dial:      p.dial,
+		}
+		if err := s.connect(); err != nil {
+			return err
+		}
+		p.sentinel = s
+	default:
+		pool, err := pool.NewCustom("tcp", p.Config.Address, p.Config.PoolSize, p.dial)
+		if err != nil {
+			return err
+		}
+		p.pool = pool
+	}
+
+	return nil
+}
+
+// dial opens a connection to a single redis server
+func (p *Provider) dial(network, addr string) (*redis.Client, error) {
+	conn, err := net.DialTimeout(network, addr, p.Config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tls != nil {
+		c := p.tls.Clone()
+		if c.ServerName == "" {
+			c.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+
+		tc := tls.Client(conn, c)
+		if p.Config.DialTimeout != 0 {
+			tc.SetDeadline(time.Now().Add(p.Config.DialTimeout))
+		}
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
 			return nil, err
 		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
 
-		if p.Config.Auth != "" {
-			if err = client.Cmd("AUTH", p.Config.Auth).Err; err != nil {
-				client.Close()
-				return nil, err
-			}
+	client, err := redis.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.ReadTimeout = p.Config.ReadTimeout
+	client.WriteTimeout = p.Config.WriteTimeout
+
+	if p.Config.Auth != "" {
+		if err = client.Cmd("AUTH", p.Config.Auth).Err; err != nil {
+			client.Close()
+			return nil, err
 		}
+	}
 
+	if !p.Config.Cluster {
 		if err = client.Cmd("SELECT", p.Config.DB).Err; err != nil {
 			client.Close()
 			return nil, err
 		}
+	}
 
-		return client, nil
+	return client, nil
+}
+
+// client returns whatever runs commands in the configured mode
+func (p *Provider) client() cmder {
+	switch {
+	case p.cluster != nil:
+		return p.cluster
+	case p.sentinel != nil:
+		return p.sentinel
+	default:
+		return p.pool
+	}
+}
+
+// masters calls fn with a client for every master server, which is only
+// more than one in cluster mode
+func (p *Provider) masters(fn func(c cmder) error) error {
+	if p.cluster == nil {
+		return fn(p.client())
 	}
 
-	pool, err := pool.NewCustom("tcp", p.Config.Address, 10, df)
+	clients, err := p.cluster.GetEvery()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		for _, client := range clients {
+			p.cluster.Put(client)
+		}
+	}()
+
+	for _, client := range clients {
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
 
-	p.pool = pool
 	return nil
 }
 
+func (p *Provider) key(alias string) string {
+	return p.Config.Prefix + alias
+}
+
 // Get attempts to find a URL by its alias and returns its original URL
 func (p *Provider) Get(alias string) (string, error) {
-	r := p.pool.Cmd("GET", alias)
+	r := p.client().Cmd("GET", p.key(alias))
 	if r.Err != nil {
 		return "", r.Err
 	}
@@ -84,7 +267,7 @@ func (p *Provider) Get(alias string) (string, error) {
 
 // Exists checks if there is a URL with the requested alias
 func (p *Provider) Exists(alias string) (bool, error) {
-	r, err := p.pool.Cmd("EXISTS", alias).Int()
+	r, err := p.client().Cmd("EXISTS", p.key(alias)).Int()
 	if err != nil {
 		return false, err
 	} else if r == 1 {
@@ -96,14 +279,204 @@ func (p *Provider) Exists(alias string) (bool, error) {
 
 // Store creates a new short URL
 func (p *Provider) Store(url, alias string) error {
-	exists, err := p.Exists(alias)
+	url = strings.TrimSpace(url)
+
+	r := p.client().Cmd("SET", p.key(alias), url, "NX")
+	if r.Err != nil {
+		return r.Err
+	}
+	if r.IsType(redis.Nil) {
+		return storage.ErrAlreadyExists
+	}
+
+	return nil
+}
+
+// Walk calls fn for every stored URL. Keys are listed using SCAN, so URLs
+// that are stored while walking may or may not be included. Walk returns
+// ErrNoPrefix if there is no prefix.
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	if p.Config.Prefix == "" {
+		return ErrNoPrefix
+	}
+
+	return p.masters(func(c cmder) error {
+		return p.scan(c, func(key string) error {
+			url, err := c.Cmd("GET", key).Str()
+			if err == redis.ErrRespNil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			return fn(strings.TrimPrefix(key, p.Config.Prefix), url)
+		})
+	})
+}
+
+// scan calls fn for every key under the prefix on a single server
+func (p *Provider) scan(c cmder, fn func(key string) error) error {
+	args := []interface{}{"COUNT", 100, "MATCH", escapeGlob(p.Config.Prefix) + "*"}
+
+	cursor := "0"
+	for {
+		parts, err := c.Cmd("SCAN", append([]interface{}{cursor}, args...)...).Array()
+		if err != nil {
+			return err
+		}
+		if len(parts) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+
+		cursor, err = parts[0].Str()
+		if err != nil {
+			return err
+		}
+		keys, err := parts[1].List()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	n, err := p.client().Cmd("DEL", p.key(alias)).Int()
 	if err != nil {
 		return err
 	}
-	if exists {
-		return storage.ErrAlreadyExists
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Count returns the number of stored URLs. Without a prefix it returns
+// storage.ErrNotSupported.
+func (p *Provider) Count() (int, error) {
+	if p.Config.Prefix == "" {
+		return 0, storage.ErrNotSupported
 	}
 
-	r := p.pool.Cmd("SET", alias, url)
-	return r.Err
+	var total int
+	err := p.masters(func(c cmder) error {
+		return p.scan(c, func(key string) error {
+			total++
+			return nil
+		})
+	})
+
+	return total, err
+}
+
+// Close closes every connection to redis
+func (p *Provider) Close() error {
+	switch {
+	case p.cluster != nil:
+		p.cluster.Close()
+	case p.sentinel != nil:
+		p.sentinel.Close()
+	default:
+		p.pool.Empty()
+	}
+
+	return nil
+}
+
+// escapeGlob escapes the characters that SCAN's MATCH treats specially
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// sentinelClient runs commands on the master that sentinel currently
+// points to, reconnecting to the next sentinel if it loses its connection
+type sentinelClient struct {
+	addresses []string
+	master    string
+	poolSize  int
+	dial      pool.DialFunc
+
+	// held for reading while a command runs, so that the client is never
+	// closed with connections still out
+	mutex  sync.RWMutex
+	client *sentinel.Client
+}
+
+// connect replaces the sentinel client with one connected to the first
+// reachable sentinel. The write lock must be held.
+func (s *sentinelClient) connect() error {
+	var err error
+	for _, addr := range s.addresses {
+		var client *sentinel.Client
+		client, err = sentinel.NewClientCustom("tcp", addr, s.poolSize, sentinel.DialFunc(s.dial), s.master)
+		if err == nil {
+			if s.client != nil {
+				s.client.Close()
+			}
+			s.client = client
+			return nil
+		}
+	}
+
+	return fmt.Errorf("could not reach any redis sentinel: %v", err)
+}
+
+// Cmd runs a command on the current master
+func (s *sentinelClient) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	for attempt := 0; ; attempt++ {
+		s.mutex.RLock()
+		client := s.client
+		conn, err := client.GetMaster(s.master)
+		if err == nil {
+			r := conn.Cmd(cmd, args...)
+			client.PutMaster(s.master, conn)
+			s.mutex.RUnlock()
+			return r
+		}
+		s.mutex.RUnlock()
+
+		ce, ok := err.(*sentinel.ClientError)
+		if !ok || !ce.SentinelErr || attempt > 0 {
+			return redis.NewRespIOErr(err)
+		}
+
+		s.mutex.Lock()
+		// another command may have reconnected in the meantime
+		if s.client == client {
+			err = s.connect()
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			return redis.NewRespIOErr(err)
+		}
+	}
+}
+
+// Close closes the connections to sentinel and the master
+func (s *sentinelClient) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.client.Close()
 }
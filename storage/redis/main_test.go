@@ -1,30 +1,385 @@
 package redis
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/server"
+	"github.com/kamaln7/klein/storage"
 	"github.com/kamaln7/klein/storage/storagetest"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
 )
 
-func TestProvider(t *testing.T) {
-	redisPassword := "secret-password"
-
+func newRedis(t testing.TB) *miniredis.Miniredis {
 	redisServer, err := miniredis.Run()
 	if err != nil {
-		t.Errorf("couldn't start redis client: %v\n", err)
+		t.Fatalf("couldn't start redis server: %v\n", err)
+	}
+	t.Cleanup(redisServer.Close)
+
+	return redisServer
+}
+
+// newProvider connects to redis with a single connection per server. Larger
+// pools keep connecting in the background, which deadlocks miniredis if it
+// is being closed at the same time.
+func newProvider(t testing.TB, c *Config) *Provider {
+	c.PoolSize = 1
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't connect to redis server: %v\n", err)
 	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	redisPassword := "secret-password"
+
+	redisServer := newRedis(t)
 	redisServer.RequireAuth(redisPassword)
-	defer redisServer.Close()
 
-	p, err := New(&Config{
+	p := newProvider(t, &Config{
 		Address: redisServer.Addr(),
 		DB:      5,
 		Auth:    redisPassword,
+		Prefix:  "klein:",
+	})
+
+	storagetest.RunTests(p, t)
+}
+
+func TestNoPrefix(t *testing.T) {
+	redisServer := newRedis(t)
+
+	p := newProvider(t, &Config{
+		Address: redisServer.Addr(),
+		DB:      5,
+	})
+
+	storagetest.RunBasicTests(p, t)
+
+	// other keys in the database can't be told apart from links
+	redisServer.Select(5)
+	redisServer.Set("klein:cache:example", "http://example.com")
+	if err := p.Walk(func(alias, url string) error { return nil }); err != ErrNoPrefix {
+		t.Errorf("expected ErrNoPrefix, got %v", err)
+	}
+	if _, err := p.Count(); err != storage.ErrNotSupported {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	redisServer := newRedis(t)
+	redisServer.Set("unrelated", "value")
+
+	p := newProvider(t, &Config{
+		Address:      redisServer.Addr(),
+		Prefix:       "klein*",
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+
+	storagetest.RunBasicTests(p, t)
+
+	redisServer.Set("klein*other", "value")
+	p.Store("http://example.com", "prefixed")
+	if url, err := redisServer.Get("klein*prefixed"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the key to be prefixed, got %q, %v", url, err)
+	}
+	if _, err := p.Get("unrelated"); err != storage.ErrNotFound {
+		t.Errorf("expected keys outside the prefix to be invisible, got %v", err)
+	}
+
+	var aliases []string
+	p.Walk(func(alias, url string) error {
+		aliases = append(aliases, alias)
+		return nil
 	})
+	if len(aliases) != 3 {
+		t.Errorf("expected to walk over example, other and prefixed only, got %v", aliases)
+	}
+	if n, err := p.Count(); err != nil || n != 3 {
+		t.Errorf("expected to count 3 prefixed keys, got %d, %v", n, err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	redisServer := newRedis(t)
+
+	cert, caPath := newCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
 	if err != nil {
-		t.Errorf("couldn't connect to redis server: %v\n", err)
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	defer l.Close()
+	go proxy(l, redisServer.Addr())
+
+	p := newProvider(t, &Config{
+		Address: l.Addr().String(),
+		TLS:     true,
+		TLSCA:   caPath,
+	})
+	storagetest.RunBasicTests(p, t)
+
+	if _, err := New(&Config{Address: l.Addr().String(), TLS: true}); err == nil {
+		t.Errorf("expected an untrusted certificate to be rejected")
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	master, replacement := newRedis(t), newRedis(t)
+	s, failover := newSentinel(t, "klein", master.Addr())
+
+	// the first sentinel is down
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+
+	p := newProvider(t, &Config{
+		SentinelAddresses: []string{down.Addr().String(), s.Addr().String()},
+		SentinelMaster:    "klein",
+	})
+	storagetest.RunBasicTests(p, t)
+
+	replacement.Set("example", "http://example.com/replacement")
+	failover <- replacement.Addr()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		url, err := p.Get("example")
+		if err == nil && url == "http://example.com/replacement" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected to switch to the new master, got %q, %v", url, err)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+}
+
+func TestCluster(t *testing.T) {
+	a, b := newRedis(t), newRedis(t)
+	nodeA, nodeB := newClusterNode(t, a.Addr()), newClusterNode(t, b.Addr())
+	slots := func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(2)
+		for i, node := range []*server.Server{nodeA, nodeB} {
+			c.WriteLen(3)
+			c.WriteInt(i * 8192)
+			c.WriteInt(i*8192 + 8191)
+			c.WriteLen(2)
+			c.WriteBulk("127.0.0.1")
+			c.WriteInt(node.Addr().Port)
+		}
+	}
+	nodeA.Register("CLUSTER", slots)
+	nodeB.Register("CLUSTER", slots)
 
+	if _, err := New(&Config{Address: nodeA.Addr().String(), Cluster: true, DB: 1}); err == nil {
+		t.Errorf("expected cluster mode to reject a db other than 0")
+	}
+
+	p := newProvider(t, &Config{
+		Address: nodeA.Addr().String(),
+		Cluster: true,
+		Prefix:  "klein:",
+	})
 	storagetest.RunBasicTests(p, t)
+
+	for i := 0; i < 20; i++ {
+		if err := p.Store("http://example.com", "alias"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("couldn't store alias: %v", err)
+		}
+	}
+	if len(a.Keys()) == 0 || len(b.Keys()) == 0 {
+		t.Errorf("expected keys to be spread over both nodes, got %d and %d", len(a.Keys()), len(b.Keys()))
+	}
+
+	// as well as example, which the basic tests stored
+	if n, err := p.Count(); err != nil || n != 21 {
+		t.Errorf("expected to count keys on every node, got %d, %v", n, err)
+	}
+	walked := 0
+	p.Walk(func(alias, url string) error {
+		walked++
+		return nil
+	})
+	if walked != 21 {
+		t.Errorf("expected to walk over keys on every node, got %d", walked)
+	}
+}
+
+// newSentinel starts a fake sentinel that points at master and switches
+// to whatever address is sent on the returned channel
+func newSentinel(t *testing.T, name, master string) (*server.Server, chan<- string) {
+	s, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start sentinel: %v", err)
+	}
+	failover, done := make(chan string), make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		s.Close()
+	})
+
+	host, port, _ := net.SplitHostPort(master)
+	s.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(6)
+		for _, v := range []string{"name", name, "ip", host, "port", port} {
+			c.WriteBulk(v)
+		}
+	})
+	s.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(3)
+		c.WriteBulk("subscribe")
+		c.WriteBulk(args[0])
+		c.WriteInt(1)
+	})
+	// the subscribed client pings before waiting for each message, so
+	// messages are sent right after the reply
+	s.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		select {
+		case addr := <-failover:
+			c.WriteLen(2)
+			c.WriteBulk("pong")
+			c.WriteBulk("")
+
+			newHost, newPort, _ := net.SplitHostPort(addr)
+			c.WriteLen(3)
+			c.WriteBulk("message")
+			c.WriteBulk("+switch-master")
+			c.WriteBulk(name + " " + host + " " + port + " " + newHost + " " + newPort)
+		case <-done:
+		}
+	})
+
+	return s, failover
+}
+
+// newClusterNode starts a fake cluster node that passes commands through to a redis server
+func newClusterNode(t *testing.T, backend string) *server.Server {
+	node, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start cluster node: %v", err)
+	}
+	t.Cleanup(node.Close)
+
+	client, err := pool.New("tcp", backend, 4)
+	if err != nil {
+		t.Fatalf("couldn't connect to redis: %v", err)
+	}
+	t.Cleanup(client.Empty)
+
+	forward := func(c *server.Peer, cmd string, args []string) {
+		cmdArgs := make([]interface{}, len(args))
+		for i, arg := range args {
+			cmdArgs[i] = arg
+		}
+		writeResp(c, client.Cmd(cmd, cmdArgs...))
+	}
+	for _, cmd := range []string{"PING", "GET", "SET", "EXISTS", "DEL", "SCAN", "DBSIZE"} {
+		node.Register(cmd, forward)
+	}
+
+	return node
+}
+
+func writeResp(c *server.Peer, r *redis.Resp) {
+	switch {
+	case r.IsType(redis.Nil):
+		c.WriteNull()
+	case r.IsType(redis.Err):
+		c.WriteError(r.Err.Error())
+	case r.IsType(redis.Int):
+		n, _ := r.Int()
+		c.WriteInt(n)
+	case r.IsType(redis.SimpleStr):
+		s, _ := r.Str()
+		c.WriteInline(s)
+	case r.IsType(redis.BulkStr):
+		s, _ := r.Str()
+		c.WriteBulk(s)
+	case r.IsType(redis.Array):
+		elems, _ := r.Array()
+		c.WriteLen(len(elems))
+		for _, elem := range elems {
+			writeResp(c, elem)
+		}
+	}
+}
+
+// proxy passes TLS connections through to a plain redis server
+func proxy(l net.Listener, backend string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", backend)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// newCertificate returns a self-signed certificate for 127.0.0.1 and the path of its PEM
+func newCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "klein test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create certificate: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("couldn't write certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		return newProvider(b, &Config{Address: newRedis(b).Addr(), Prefix: "klein:"})
+	}, b)
 }
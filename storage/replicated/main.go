@@ -0,0 +1,421 @@
+package replicated
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kamaln7/klein/storage"
+)
+
+// Consistency controls when a write to the replicas is considered done
+type Consistency string
+
+// Consistency modes
+const (
+	// All waits for every replica. If any of them fails, the write is rolled
+	// back and fails, unless it can't be rolled back on the primary.
+	All Consistency = "all"
+	// Primary waits for every replica, but only fails if the primary fails
+	Primary Consistency = "primary"
+	// Async returns as soon as the primary is written and replicates in the background
+	Async Consistency = "async"
+)
+
+// queueSize is the number of pending writes buffered per replica in async mode
+const queueSize = 1024
+
+// Provider mirrors writes to several storage providers and falls back
+// between them for reads
+type Provider struct {
+	// dropped counts the async writes dropped because a replica's queue was
+	// full. First for 64-bit alignment.
+	dropped uint64
+
+	Config *Config
+
+	readOrder []storage.Provider
+
+	mutex  sync.RWMutex
+	queues []chan func() error
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Config contains the configuration for the replicated storage
+type Config struct {
+	// Providers lists the providers to write to. The first one is the primary.
+	Providers []storage.Provider
+	// Consistency defaults to All
+	Consistency Consistency
+	// ReadOrder lists indices into Providers in the order reads should try
+	// them. Providers not listed are never read from. Empty means Providers' order.
+	ReadOrder []int
+	// Log receives replication failures that aren't returned to the caller
+	Log *log.Logger
+}
+
+// ensure that the storage.Walker, storage.Deleter, storage.Counter, storage.Invalidator, storage.StatsReporter, storage.Backuper and storage.CreatorRecorder interfaces are implemented
+var (
+	_ storage.Walker          = new(Provider)
+	_ storage.Deleter         = new(Provider)
+	_ storage.Counter         = new(Provider)
+	_ storage.Invalidator     = new(Provider)
+	_ storage.StatsReporter   = new(Provider)
+	_ storage.Backuper        = new(Provider)
+	_ storage.CreatorRecorder = new(Provider)
+)
+
+// New returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	if len(c.Providers) == 0 {
+		return nil, errors.New("replicated storage needs at least one provider")
+	}
+
+	switch c.Consistency {
+	case "":
+		c.Consistency = All
+	case All, Primary, Async:
+	default:
+		return nil, fmt.Errorf("unknown consistency mode %q", c.Consistency)
+	}
+
+	p := &Provider{
+		Config: c,
+	}
+
+	if len(c.ReadOrder) == 0 {
+		p.readOrder = c.Providers
+	}
+	for _, i := range c.ReadOrder {
+		if i < 0 || i >= len(c.Providers) {
+			return nil, fmt.Errorf("read order index %d is out of range", i)
+		}
+		p.readOrder = append(p.readOrder, c.Providers[i])
+	}
+
+	if c.Consistency == Async {
+		for range c.Providers[1:] {
+			queue := make(chan func() error, queueSize)
+			p.queues = append(p.queues, queue)
+
+			p.wg.Add(1)
+			go p.replicate(queue)
+		}
+	}
+
+	return p, nil
+}
+
+// Get attempts to find a URL by its alias and returns its original URL. The
+// next provider in the read order is asked whenever one fails or is missing
+// the alias, which covers replicas that lag behind.
+func (p *Provider) Get(alias string) (string, error) {
+	var err error
+	missing := false
+	for _, r := range p.readOrder {
+		var url string
+		url, err = r.Get(alias)
+		switch err {
+		case nil:
+			return url, nil
+		case storage.ErrNotFound:
+			missing = true
+		}
+	}
+
+	if missing {
+		return "", storage.ErrNotFound
+	}
+	return "", err
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	var err error
+	missing := false
+	for _, r := range p.readOrder {
+		var exists bool
+		exists, err = r.Exists(alias)
+		switch {
+		case err != nil:
+		case exists:
+			return true, nil
+		default:
+			missing = true
+		}
+	}
+
+	if missing {
+		return false, nil
+	}
+	return false, err
+}
+
+// Store creates a new short URL on the primary, then on the replicas. With
+// the All consistency mode a failed replica makes the URL be deleted again.
+func (p *Provider) Store(url, alias string) error {
+	return p.StoreCreatedBy(url, alias, "")
+}
+
+// StoreCreatedBy stores a URL like Store, recording its creator on every
+// provider that supports it
+func (p *Provider) StoreCreatedBy(url, alias, creator string) error {
+	url = strings.TrimSpace(url)
+
+	err := storeCreatedBy(p.primary(), url, alias, creator)
+	if err != nil {
+		return err
+	}
+
+	write := func(r storage.Provider) error {
+		err := storeCreatedBy(r, url, alias, creator)
+		if err == storage.ErrAlreadyExists {
+			// left over from an earlier partial write, fine if it matches
+			if existing, _ := r.Get(alias); existing == url {
+				return nil
+			}
+		}
+		return err
+	}
+	undo := func(r storage.Provider) error {
+		deleter, ok := r.(storage.Deleter)
+		if !ok {
+			return storage.ErrNotSupported
+		}
+
+		err := deleter.Delete(alias)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	return p.fanOut(write, undo)
+}
+
+// Walk calls fn for every URL stored in the first readable provider that supports walking
+func (p *Provider) Walk(fn func(alias, url string) error) (err error) {
+	err = storage.ErrNotSupported
+	for _, r := range p.readOrder {
+		walker, ok := r.(storage.Walker)
+		if !ok {
+			continue
+		}
+
+		called := false
+		err = walker.Walk(func(alias, url string) error {
+			called = true
+			return fn(alias, url)
+		})
+		// once fn has seen links, walking another replica would repeat them
+		if err == nil || called {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Delete removes a short URL from the primary, then from the replicas. With
+// the All consistency mode a failed replica makes the URL be stored again.
+func (p *Provider) Delete(alias string) error {
+	deleter, ok := p.primary().(storage.Deleter)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+	url, err := p.primary().Get(alias)
+	if err != nil {
+		return err
+	}
+	if err := deleter.Delete(alias); err != nil {
+		return err
+	}
+
+	write := func(r storage.Provider) error {
+		deleter, ok := r.(storage.Deleter)
+		if !ok {
+			return storage.ErrNotSupported
+		}
+
+		err := deleter.Delete(alias)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	undo := func(r storage.Provider) error {
+		err := r.Store(url, alias)
+		if err == storage.ErrAlreadyExists {
+			return nil
+		}
+		return err
+	}
+
+	return p.fanOut(write, undo)
+}
+
+// Count returns the number of URLs stored in the first readable provider that supports counting
+func (p *Provider) Count() (n int, err error) {
+	err = storage.ErrNotSupported
+	for _, r := range p.readOrder {
+		counter, ok := r.(storage.Counter)
+		if !ok {
+			continue
+		}
+
+		n, err = counter.Count()
+		if err == nil {
+			return n, nil
+		}
+	}
+
+	return 0, err
+}
+
+// Backup writes a copy of the primary's data to w
+func (p *Provider) Backup(w io.Writer) (int64, error) {
+	backuper, ok := p.primary().(storage.Backuper)
+	if !ok {
+		return 0, storage.ErrNotSupported
+	}
+
+	return backuper.Backup(w)
+}
+
+// Invalidate passes the invalidation on to every provider that caches
+func (p *Provider) Invalidate(alias string) {
+	for _, r := range p.Config.Providers {
+		if invalidator, ok := r.(storage.Invalidator); ok {
+			invalidator.Invalidate(alias)
+		}
+	}
+}
+
+// Stats returns the number of asynchronous writes dropped since the provider
+// was created
+func (p *Provider) Stats() map[string]uint64 {
+	return map[string]uint64{
+		"replication_dropped": atomic.LoadUint64(&p.dropped),
+	}
+}
+
+// Close waits for pending asynchronous writes to finish, then closes every
+// provider that can be closed
+func (p *Provider) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.queues = nil
+	p.closed = true
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+
+	var errs []error
+	for _, r := range p.Config.Providers {
+		if closer, ok := r.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Provider) primary() storage.Provider {
+	return p.Config.Providers[0]
+}
+
+// storeCreatedBy stores a URL in r, along with its creator if r can record it
+func storeCreatedBy(r storage.Provider, url, alias, creator string) error {
+	if recorder, ok := r.(storage.CreatorRecorder); ok && creator != "" {
+		return recorder.StoreCreatedBy(url, alias, creator)
+	}
+
+	return r.Store(url, alias)
+}
+
+// fanOut applies a write that already succeeded on the primary to every
+// replica. With the All consistency mode, a failed replica makes undo be
+// applied to the primary and to the replicas that were written to. The write
+// is only reported as failed if it could be undone on the primary, otherwise
+// the primary keeps serving it.
+func (p *Provider) fanOut(write, undo func(r storage.Provider) error) error {
+	replicas := p.Config.Providers[1:]
+
+	if p.Config.Consistency == Async {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+
+		if p.closed {
+			return errors.New("replicated storage is closed")
+		}
+		for i, r := range replicas {
+			r := r
+			select {
+			case p.queues[i] <- func() error { return write(r) }:
+			default:
+				atomic.AddUint64(&p.dropped, 1)
+				p.logf("replica %d is too far behind, dropping a write\n", i+1)
+			}
+		}
+		return nil
+	}
+
+	var (
+		errs    []error
+		written []int
+	)
+	for i, r := range replicas {
+		if err := write(r); err != nil {
+			p.logf("could not write to replica %d: %v\n", i+1, err)
+			errs = append(errs, fmt.Errorf("replica %d: %w", i+1, err))
+			continue
+		}
+		written = append(written, i+1)
+	}
+
+	if len(errs) == 0 || p.Config.Consistency != All {
+		return nil
+	}
+
+	if err := undo(p.primary()); err != nil {
+		p.logf("could not roll back a partial write on the primary, keeping it: %v\n", err)
+		return nil
+	}
+	for _, i := range written {
+		if err := undo(p.Config.Providers[i]); err != nil {
+			p.logf("could not roll back a partial write on replica %d: %v\n", i, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// replicate applies queued writes to a replica in order
+func (p *Provider) replicate(queue chan func() error) {
+	defer p.wg.Done()
+
+	for write := range queue {
+		if err := write(); err != nil {
+			p.logf("could not replicate a write: %v\n", err)
+		}
+	}
+}
+
+func (p *Provider) logf(format string, v ...interface{}) {
+	if p.Config.Log != nil {
+		p.Config.Log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,330 @@
+package replicated
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/memory"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+// broken is a provider whose every operation fails
+type broken struct{}
+
+var errBroken = errors.New("backend unavailable")
+
+func (broken) Get(alias string) (string, error)  { return "", errBroken }
+func (broken) Exists(alias string) (bool, error) { return false, errBroken }
+func (broken) Store(url, alias string) error     { return errBroken }
+
+// recorder is a memory provider that remembers who created each link
+type recorder struct {
+	*memory.Provider
+	creators map[string]string
+}
+
+func newRecorder() *recorder {
+	return &recorder{memory.New(&memory.Config{}), make(map[string]string)}
+}
+
+func (r *recorder) StoreCreatedBy(url, alias, creator string) error {
+	if err := r.Store(url, alias); err != nil {
+		return err
+	}
+
+	r.creators[alias] = creator
+	return nil
+}
+
+func newProvider(t testing.TB, c *Config) *Provider {
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't init replicated storage: %v\n", err)
+	}
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	for _, consistency := range []Consistency{All, Primary, Async} {
+		t.Run(string(consistency), func(t *testing.T) {
+			c := &Config{
+				Providers:   []storage.Provider{memory.New(&memory.Config{}), memory.New(&memory.Config{})},
+				Consistency: consistency,
+			}
+			if consistency == Async {
+				// the memory provider can't be read while it's being replicated to
+				c.ReadOrder = []int{0}
+			}
+			p := newProvider(t, c)
+			defer p.Close()
+
+			storagetest.RunTests(p, t)
+		})
+	}
+}
+
+func TestReplication(t *testing.T) {
+	for _, consistency := range []Consistency{All, Primary, Async} {
+		t.Run(string(consistency), func(t *testing.T) {
+			replica := memory.New(&memory.Config{})
+			p := newProvider(t, &Config{
+				Providers:   []storage.Provider{memory.New(&memory.Config{}), replica},
+				Consistency: consistency,
+			})
+
+			if err := p.Store("http://example.com", "example"); err != nil {
+				t.Fatalf("couldn't store alias: %v", err)
+			}
+			if err := p.Store("http://example.com", "deleted"); err != nil {
+				t.Fatalf("couldn't store alias: %v", err)
+			}
+			if err := p.Delete("deleted"); err != nil {
+				t.Fatalf("couldn't delete alias: %v", err)
+			}
+			p.Close()
+
+			if url, err := replica.Get("example"); err != nil || url != "http://example.com" {
+				t.Errorf("expected the alias to be replicated, got %q, %v", url, err)
+			}
+			if _, err := replica.Get("deleted"); err != storage.ErrNotFound {
+				t.Errorf("expected the deletion to be replicated, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCreatedBy(t *testing.T) {
+	primary, replica := newRecorder(), newRecorder()
+	plain := memory.New(&memory.Config{})
+	p := newProvider(t, &Config{Providers: []storage.Provider{primary, plain, replica}})
+
+	if err := p.StoreCreatedBy("http://example.com", "example", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range []*recorder{primary, replica} {
+		if r.creators["example"] != "alice" {
+			t.Errorf("expected provider %d to record the creator, got %q", i, r.creators["example"])
+		}
+	}
+	if url, err := plain.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected providers that can't record creators to store the url, got %q, %v", url, err)
+	}
+
+	// without a creator, recorders are stored to like any provider
+	if err := p.Store("http://example.com", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := replica.creators["anonymous"]; ok {
+		t.Error("expected no creator to be recorded")
+	}
+}
+
+func TestReplicaFailure(t *testing.T) {
+	for consistency, fails := range map[Consistency]bool{All: true, Primary: false, Async: false} {
+		t.Run(string(consistency), func(t *testing.T) {
+			primary, replica := memory.New(&memory.Config{}), memory.New(&memory.Config{})
+			p := newProvider(t, &Config{
+				Providers:   []storage.Provider{primary, replica, broken{}},
+				Consistency: consistency,
+			})
+			defer p.Close()
+
+			err := p.Store("http://example.com", "example")
+			if fails != (err != nil) {
+				t.Errorf("unexpected error %v", err)
+			}
+
+			// failed writes are rolled back everywhere, so a failure never
+			// leaves a link behind
+			_, err = primary.Get("example")
+			if fails && err != storage.ErrNotFound {
+				t.Errorf("expected the primary's write to be rolled back, got %v", err)
+			}
+			if !fails && err != nil {
+				t.Errorf("expected the primary to have the alias, got %v", err)
+			}
+			if _, err := replica.Get("example"); fails && err != storage.ErrNotFound {
+				t.Errorf("expected the replica's write to be rolled back, got %v", err)
+			}
+		})
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		primary := memory.New(&memory.Config{})
+		primary.Store("http://example.com", "example")
+		p := newProvider(t, &Config{Providers: []storage.Provider{primary, broken{}}})
+
+		if err := p.Delete("example"); err == nil {
+			t.Error("expected the failed replica to be reported")
+		}
+		if url, err := primary.Get("example"); err != nil || url != "http://example.com" {
+			t.Errorf("expected the deletion to be rolled back, got %q, %v", url, err)
+		}
+	})
+
+	// a write that can't be undone on the primary stands, and isn't reported
+	// as failed
+	t.Run("no rollback", func(t *testing.T) {
+		primary := memory.New(&memory.Config{})
+		p := newProvider(t, &Config{Providers: []storage.Provider{struct{ storage.Provider }{primary}, broken{}}})
+
+		if err := p.Store("http://example.com", "example"); err != nil {
+			t.Errorf("expected the write to succeed, got %v", err)
+		}
+		if _, err := primary.Get("example"); err != nil {
+			t.Errorf("expected the primary to keep the alias, got %v", err)
+		}
+	})
+}
+
+// blocked is a provider whose writes wait until it is unblocked
+type blocked struct {
+	*memory.Provider
+	unblock chan struct{}
+}
+
+func (b *blocked) Store(url, alias string) error {
+	<-b.unblock
+	return b.Provider.Store(url, alias)
+}
+
+func TestDroppedWrites(t *testing.T) {
+	replica := &blocked{Provider: memory.New(&memory.Config{}), unblock: make(chan struct{})}
+	p := newProvider(t, &Config{
+		Providers:   []storage.Provider{memory.New(&memory.Config{}), replica},
+		Consistency: Async,
+	})
+
+	// one write is being applied and queueSize are waiting, the rest are dropped
+	for i := 0; i < queueSize+11; i++ {
+		if err := p.Store("http://example.com", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(replica.unblock)
+	p.Close()
+
+	if dropped := p.Stats()["replication_dropped"]; dropped < 10 || dropped > 11 {
+		t.Errorf("expected 10 or 11 dropped writes, got %d", dropped)
+	}
+}
+
+// closer records being closed
+type closer struct {
+	storage.Provider
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	primary, replica := &closer{Provider: memory.New(&memory.Config{})}, &closer{Provider: memory.New(&memory.Config{})}
+	p := newProvider(t, &Config{Providers: []storage.Provider{primary, replica}, Consistency: Async})
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !primary.closed || !replica.closed {
+		t.Errorf("expected every provider to be closed, got %v and %v", primary.closed, replica.closed)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("expected closing twice to be fine, got %v", err)
+	}
+}
+
+func TestPartialWriteRetry(t *testing.T) {
+	primary, replica := memory.New(&memory.Config{}), memory.New(&memory.Config{})
+	replica.Store("http://example.com", "example")
+
+	p := newProvider(t, &Config{Providers: []storage.Provider{primary, replica}})
+	if err := p.Store("http://example.com", "example"); err != nil {
+		t.Errorf("expected a matching replica to be accepted, got %v", err)
+	}
+	if err := p.Store("http://example.com", "example"); err != storage.ErrAlreadyExists {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+
+	replica.Store("http://example.org", "conflict")
+	if err := p.Store("http://example.com", "conflict"); err == nil {
+		t.Errorf("expected a diverging replica to be reported")
+	}
+	if _, err := primary.Get("conflict"); err != storage.ErrNotFound {
+		t.Errorf("expected the primary's write to be rolled back, got %v", err)
+	}
+	if url, _ := replica.Get("conflict"); url != "http://example.org" {
+		t.Errorf("expected the diverging replica to be left alone, got %q", url)
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	replica := memory.New(&memory.Config{})
+	replica.Store("http://example.com", "example")
+
+	p := newProvider(t, &Config{Providers: []storage.Provider{broken{}, replica}})
+
+	if url, err := p.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected to read from the replica, got %q, %v", url, err)
+	}
+	if exists, err := p.Exists("example"); err != nil || !exists {
+		t.Errorf("expected to read from the replica, got %v, %v", exists, err)
+	}
+	if _, err := p.Get("missing"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if n, err := p.Count(); err != nil || n != 1 {
+		t.Errorf("expected to count the replica, got %d, %v", n, err)
+	}
+	if err := p.Store("http://example.org", "other"); err != errBroken {
+		t.Errorf("expected writes to fail with the primary, got %v", err)
+	}
+}
+
+func TestReadOrder(t *testing.T) {
+	primary, replica := memory.New(&memory.Config{}), memory.New(&memory.Config{})
+	primary.Store("http://example.com/primary", "example")
+	replica.Store("http://example.com/replica", "example")
+
+	p := newProvider(t, &Config{
+		Providers: []storage.Provider{primary, replica},
+		ReadOrder: []int{1, 0},
+	})
+
+	if url, _ := p.Get("example"); url != "http://example.com/replica" {
+		t.Errorf("expected to read from the replica first, got %q", url)
+	}
+
+	// a lagging replica falls back to the primary
+	primary.Store("http://example.com/new", "new")
+	if url, err := p.Get("new"); err != nil || url != "http://example.com/new" {
+		t.Errorf("expected to fall back to the primary, got %q, %v", url, err)
+	}
+	if exists, err := p.Exists("new"); err != nil || !exists {
+		t.Errorf("expected to fall back to the primary, got %v, %v", exists, err)
+	}
+
+	if _, err := New(&Config{Providers: []storage.Provider{primary}, ReadOrder: []int{1}}); err == nil {
+		t.Errorf("expected an out of range read order to be rejected")
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	for _, consistency := range []Consistency{All, Primary, Async} {
+		b.Run(string(consistency), func(b *testing.B) {
+			storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+				p := newProvider(b, &Config{
+					Providers:   []storage.Provider{memory.New(&memory.Config{}), memory.New(&memory.Config{})},
+					Consistency: consistency,
+				})
+				b.Cleanup(func() { p.Close() })
+
+				return p
+			}, b)
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kamaln7/klein/storage"
+)
+
+// Provider implements a storage system that stores each URL as an object in
+// an S3-compatible object store, such as AWS S3, MinIO, Ceph or DigitalOcean Spaces
+type Provider struct {
+	Config *Config
+	s3     *s3.S3
+}
+
+// Config contains the configuration for the S3 storage
+type Config struct {
+	// Endpoint is the URL of the S3 API, leave empty to use AWS
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Path is the prefix to store objects under
+	Path string
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint,
+	// which most self-hosted S3-compatible servers need
+	PathStyle bool
+
+	// AccessKey and SecretKey are optional. If they are not set, credentials
+	// are looked up using the standard AWS chain: environment variables,
+	// shared config and credentials files, then instance and container roles.
+	AccessKey, SecretKey string
+
+	// SSE is the server-side encryption to request: empty, AES256 or aws:kms
+	SSE string
+	// SSEKMSKeyID is the KMS key to encrypt with when SSE is aws:kms
+	SSEKMSKeyID string
+}
+
+// ensure that the storage.Walker, storage.Deleter and storage.Counter interfaces are implemented
+var (
+	_ storage.Walker  = new(Provider)
+	_ storage.Deleter = new(Provider)
+	_ storage.Counter = new(Provider)
+)
+
+// New returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("a bucket is required")
+	}
+
+	switch c.SSE {
+	case "", s3.ServerSideEncryptionAes256:
+		if c.SSEKMSKeyID != "" {
+			return nil, errors.New("a KMS key can only be used with aws:kms server-side encryption")
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return nil, fmt.Errorf("invalid server-side encryption %q", c.SSE)
+	}
+
+	sess, err := NewSession(c.Endpoint, c.Region, c.AccessKey, c.SecretKey, c.PathStyle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Provider{
+		Config: c,
+		s3:     s3.New(sess),
+	}, nil
+}
+
+// NewSession returns an AWS session for an S3-compatible endpoint. If
+// accessKey and secretKey are empty, the standard AWS credential chain is used.
+func NewSession(endpoint, region, accessKey, secretKey string, pathStyle bool) (*session.Session, error) {
+	cfg := &aws.Config{
+		S3ForcePathStyle: aws.Bool(pathStyle),
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+	if region != "" {
+		cfg.Region = aws.String(region)
+	}
+	if accessKey != "" || secretKey != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
+	}
+
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
+// WithHeader returns a request option that sets an HTTP header, for
+// features the SDK has no field for such as conditional writes
+func WithHeader(key, value string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set(key, value)
+	}
+}
+
+// IsPreconditionFailed reports whether a conditional request was rejected
+func IsPreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed
+	}
+
+	return false
+}
+
+// IsNotFound reports whether an object does not exist
+func IsNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Provider) key(alias string) string {
+	prefix := strings.Trim(p.Config.Path, "/")
+	if prefix == "" {
+		return alias
+	}
+
+	return prefix + "/" + alias
+}
+
+// Get attempts to find a URL by its alias and returns its original URL
+func (p *Provider) Get(alias string) (string, error) {
+	output, err := p.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(p.key(alias)),
+	})
+	if IsNotFound(err) {
+		return "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	_, err := p.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(p.key(alias)),
+	})
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Store creates a new short URL. The object is written with If-None-Match
+// so that concurrent writers cannot overwrite each other on servers that
+// support conditional writes.
+func (p *Provider) Store(url, alias string) error {
+	url = strings.TrimSpace(url)
+
+	exists, err := p.Exists(alias)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return storage.ErrAlreadyExists
+	}
+
+	return p.put(url, alias)
+}
+
+// put writes a new object, failing if it already exists
+func (p *Provider) put(url, alias string) error {
+	input := &s3.PutObjectInput{
+		Body:        strings.NewReader(url),
+		Bucket:      aws.String(p.Config.Bucket),
+		Key:         aws.String(p.key(alias)),
+		ContentType: aws.String("text/plain"),
+	}
+	if p.Config.SSE != "" {
+		input.ServerSideEncryption = aws.String(p.Config.SSE)
+	}
+	if p.Config.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(p.Config.SSEKMSKeyID)
+	}
+
+	_, err := p.s3.PutObjectWithContext(aws.BackgroundContext(), input, WithHeader("If-None-Match", "*"))
+	if IsPreconditionFailed(err) {
+		return storage.ErrAlreadyExists
+	}
+
+	return err
+}
+
+// list calls fn with the alias of every stored object
+func (p *Provider) list(fn func(alias string) error) error {
+	prefix := p.key("")
+
+	var fnErr error
+	err := p.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(p.Config.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			alias := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if alias == "" {
+				continue
+			}
+
+			if fnErr = fn(alias); fnErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+// Walk calls fn for every stored URL
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	return p.list(func(alias string) error {
+		url, err := p.Get(alias)
+		if err == storage.ErrNotFound {
+			// deleted since it was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fn(alias, url)
+	})
+}
+
+// Count returns the number of stored URLs by listing them, without fetching each one
+func (p *Provider) Count() (int, error) {
+	n := 0
+	err := p.list(func(alias string) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	exists, err := p.Exists(alias)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return storage.ErrNotFound
+	}
+
+	_, err = p.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(p.key(alias)),
+	})
+
+	return err
+}
@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/s3/s3test"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+func TestProvider(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	p, err := New(&Config{
+		Endpoint:    server.URL,
+		Region:      "us-east-1",
+		Bucket:      "klein",
+		Path:        "/urls/",
+		PathStyle:   true,
+		AccessKey:   "access",
+		SecretKey:   "secret",
+		SSE:         "aws:kms",
+		SSEKMSKeyID: "klein-key",
+	})
+	if err != nil {
+		t.Fatalf("couldn't init s3 driver: %v\n", err)
+	}
+
+	storagetest.RunTests(p, t)
+
+	t.Run("server-side encryption", func(t *testing.T) {
+		if err := p.Store("http://example.com", "encrypted"); err != nil {
+			t.Fatal(err)
+		}
+
+		o, ok := server.Object("klein", "urls/encrypted")
+		if !ok {
+			t.Fatal("expected the url to be stored under the configured path")
+		}
+		if o.Header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" || o.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "klein-key" {
+			t.Errorf("expected the object to be encrypted with the kms key, got headers %v", o.Header)
+		}
+	})
+
+	t.Run("conditional write", func(t *testing.T) {
+		// another writer creates the alias between the existence check and the write
+		server.PutObject("klein", "urls/raced", []byte("http://other.example.com"))
+
+		if err := p.put("http://example.com", "raced"); err != storage.ErrAlreadyExists {
+			t.Errorf("expected ErrAlreadyExists, got %v", err)
+		}
+		if url, _ := p.Get("raced"); url != "http://other.example.com" {
+			t.Errorf("expected the other writer's url to be kept, got %q", url)
+		}
+	})
+}
+
+func TestListPagination(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	p, err := New(&Config{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		Bucket:    "klein",
+		PathStyle: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("couldn't init s3 driver: %v\n", err)
+	}
+
+	for i := 0; i < 1500; i++ {
+		server.PutObject("klein", fmt.Sprintf("alias%d", i), []byte("http://example.com"))
+	}
+
+	n, err := p.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1500 {
+		t.Errorf("expected 1500 urls across pages, got %d", n)
+	}
+
+	if _, err := p.Get("alias1499"); err != nil {
+		t.Error(err)
+	}
+	if _, err := p.Get("missing"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		server := s3test.New()
+		b.Cleanup(server.Close)
+
+		p, err := New(&Config{
+			Endpoint:  server.URL,
+			Region:    "us-east-1",
+			Bucket:    "klein",
+			PathStyle: true,
+			AccessKey: "access",
+			SecretKey: "secret",
+		})
+		if err != nil {
+			b.Fatalf("couldn't init s3 driver: %v\n", err)
+		}
+
+		return p
+	}, b, 100, 1000)
+}
@@ -0,0 +1,264 @@
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-process fake of the parts of the S3 API that klein uses:
+// getting, putting, deleting and listing objects with path-style addressing,
+// including conditional requests using If-Match and If-None-Match
+type Server struct {
+	URL string
+
+	server  *httptest.Server
+	mutex   sync.Mutex
+	buckets map[string]map[string]*Object
+}
+
+// Object is a stored object
+type Object struct {
+	Body         []byte
+	ETag         string
+	Header       http.Header
+	LastModified time.Time
+}
+
+// New starts a new fake S3 server. Buckets are created on first use.
+func New() *Server {
+	s := &Server{
+		buckets: make(map[string]map[string]*Object),
+	}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+
+	return s
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Object returns a copy of a stored object
+func (s *Server) Object(bucket, key string) (*Object, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	o, ok := s.bucket(bucket)[key]
+	if !ok {
+		return nil, false
+	}
+
+	c := *o
+	return &c, true
+}
+
+// PutObject stores an object directly, as if it was written by another client
+func (s *Server) PutObject(bucket, key string, body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.bucket(bucket)[key] = newObject(body, http.Header{})
+}
+
+func newObject(body []byte, header http.Header) *Object {
+	sum := md5.Sum(body)
+
+	return &Object{
+		Body:         body,
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		Header:       header,
+		LastModified: time.Now().UTC(),
+	}
+}
+
+// bucket returns the objects in a bucket. The caller must hold the lock.
+func (s *Server) bucket(name string) map[string]*Object {
+	b, ok := s.buckets[name]
+	if !ok {
+		b = make(map[string]*Object)
+		s.buckets[name] = b
+	}
+
+	return b
+}
+
+// ServeHTTP handles S3 API requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	if bucket == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "only path-style requests are supported")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method != "GET" {
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported bucket operation")
+			return
+		}
+
+		s.list(w, r, bucket)
+		return
+	}
+
+	key := parts[1]
+	objects := s.bucket(bucket)
+	o, exists := objects[key]
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if inm := r.Header.Get("If-None-Match"); inm != "" && inm == o.ETag {
+			w.Header().Set("ETag", o.ETag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		for k, v := range o.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", o.ETag)
+		w.Header().Set("Last-Modified", o.LastModified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.Body)))
+		if r.Method == "GET" {
+			w.Write(o.Body)
+		}
+	case "PUT":
+		if im := r.Header.Get("If-Match"); im != "" && (!exists || im != o.ETag) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		if inm := r.Header.Get("If-None-Match"); inm == "*" && exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+
+		header := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Server-Side-Encryption") || strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" {
+				header[k] = v
+			}
+		}
+
+		o = newObject(body, header)
+		objects[key] = o
+		w.Header().Set("ETag", o.ETag)
+		w.WriteHeader(http.StatusOK)
+	case "DELETE":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported object operation")
+	}
+}
+
+type listContents struct {
+	Key          string
+	ETag         string
+	Size         int
+	LastModified string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []listContents
+}
+
+// list implements both ListObjects and ListObjectsV2. The caller must hold the lock.
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix := q.Get("prefix")
+
+	maxKeys := 1000
+	if mk, err := strconv.Atoi(q.Get("max-keys")); err == nil && mk > 0 && mk < maxKeys {
+		maxKeys = mk
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("continuation-token")
+		if after == "" {
+			after = q.Get("start-after")
+		}
+	}
+
+	var keys []string
+	for key := range s.bucket(bucket) {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	res := &listResult{
+		Name:    bucket,
+		Prefix:  prefix,
+		MaxKeys: maxKeys,
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		res.IsTruncated = true
+		if v2 {
+			res.ContinuationToken = q.Get("continuation-token")
+			res.NextContinuationToken = keys[len(keys)-1]
+		} else {
+			res.Marker = q.Get("marker")
+			res.NextMarker = keys[len(keys)-1]
+		}
+	}
+
+	for _, key := range keys {
+		o := s.buckets[bucket][key]
+		res.Contents = append(res.Contents, listContents{
+			Key:          key,
+			ETag:         o.ETag,
+			Size:         len(o.Body),
+			LastModified: o.LastModified.Format(time.RFC3339),
+		})
+	}
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message)
+}
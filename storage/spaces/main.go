@@ -3,23 +3,33 @@ package spaces
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/kamaln7/klein/storage"
+	kleins3 "github.com/kamaln7/klein/storage/s3"
 )
 
-// Provider implements an in memory storage that persists on DigitalOcean Spaces
+// Provider implements an in memory storage that persists on DigitalOcean Spaces.
+// Writes are conditional on the ETag of the last version that was read, so
+// several instances can safely share the same file: if another instance
+// changed it in the meantime, the file is reloaded and the write retried.
 type Provider struct {
 	Config *Config
 	Spaces *s3.S3
 	URLs   map[string]string
+	etag   string
 	mutex  sync.RWMutex
+	stop   chan struct{}
+	closed sync.Once
 }
 
 // Config contains the configuration for the file storage
@@ -29,58 +39,186 @@ type Config struct {
 	Region    string
 	Space     string
 	Path      string
+	// Endpoint overrides the Spaces endpoint derived from Region
+	Endpoint string
+	// PathStyle addresses the space as endpoint/space instead of
+	// space.endpoint, which S3-compatible stand-ins for Spaces may need
+	PathStyle bool
+	// RefreshInterval is how often to reload the file to pick up links
+	// stored by other instances. 0 disables periodic refreshes.
+	RefreshInterval time.Duration
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+// ensure that the storage.Walker, storage.Deleter and storage.Counter interfaces are implemented
+var (
+	_ storage.Walker  = new(Provider)
+	_ storage.Deleter = new(Provider)
+	_ storage.Counter = new(Provider)
+)
+
+// maxAttempts is how many times a conflicting write is retried
+const maxAttempts = 5
+
+// ErrTooManyConflicts is returned when a write keeps conflicting with other instances
+var ErrTooManyConflicts = errors.New("spaces: too many concurrent writes, giving up")
 
 // New returns a new Provider instance
 func New(c *Config) (*Provider, error) {
-	spacesSession := session.New(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
-		Endpoint:    aws.String(fmt.Sprintf("https://%s.digitaloceanspaces.com", c.Region)),
-		Region:      aws.String("us-east-1"), // Needs to be us-east-1, or it'll fail.
-	})
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.digitaloceanspaces.com", c.Region)
+	}
 
-	spaces := s3.New(spacesSession)
+	// Needs to be us-east-1, or it'll fail.
+	spacesSession, err := kleins3.NewSession(endpoint, "us-east-1", c.AccessKey, c.SecretKey, c.PathStyle)
+	if err != nil {
+		return nil, err
+	}
 
-	object := s3.GetObjectInput{
-		Bucket: aws.String(c.Space),
-		Key:    aws.String(c.Path),
+	p := &Provider{
+		Spaces: s3.New(spacesSession),
+		Config: c,
+		URLs:   make(map[string]string),
+		stop:   make(chan struct{}),
 	}
 
-	urls := make(map[string]string)
+	if _, err := p.refresh(); err != nil {
+		return nil, err
+	}
+
+	if c.RefreshInterval > 0 {
+		go p.refreshPeriodically()
+	}
+
+	return p, nil
+}
+
+// Close stops the periodic refreshes
+func (p *Provider) Close() error {
+	p.closed.Do(func() { close(p.stop) })
+	return nil
+}
+
+func (p *Provider) refreshPeriodically() {
+	ticker := time.NewTicker(p.Config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := p.refresh(); err != nil {
+				log.Printf("storage/spaces: could not refresh urls: %s\n", err.Error())
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// refresh reloads the file if it changed since it was last read and
+// reports whether it did
+func (p *Provider) refresh() (bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	output, err := spaces.GetObject(&object)
+	return p.load()
+}
+
+// load reads the file into memory unless it still has the last seen ETag.
+// The caller must hold the write lock.
+func (p *Provider) load() (bool, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(p.Config.Space),
+		Key:    aws.String(p.Config.Path),
+	}
+	if p.etag != "" {
+		input.IfNoneMatch = aws.String(p.etag)
+	}
+
+	output, err := p.Spaces.GetObject(input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-			return &Provider{
-				Spaces: spaces,
-				Config: c,
-				URLs:   urls,
-			}, nil
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified {
+			return false, nil
+		}
+		if kleins3.IsNotFound(err) {
+			changed := p.etag != "" || len(p.URLs) > 0
+			p.URLs = make(map[string]string)
+			p.etag = ""
+			return changed, nil
 		}
 
-		return nil, err
+		return false, err
 	}
+	defer output.Body.Close()
 
 	buf := new(bytes.Buffer)
-	buf.ReadFrom(output.Body)
+	if _, err := buf.ReadFrom(output.Body); err != nil {
+		return false, err
+	}
 
-	err = json.Unmarshal(buf.Bytes(), &urls)
-	if err != nil {
-		return nil, err
+	urls := make(map[string]string)
+	if err := json.Unmarshal(buf.Bytes(), &urls); err != nil {
+		return false, err
 	}
 
-	return &Provider{
-		Spaces: spaces,
-		Config: c,
-		URLs:   urls,
-	}, nil
+	p.URLs = urls
+	p.etag = aws.StringValue(output.ETag)
+	return true, nil
+}
+
+// update applies fn to a copy of the URLs and writes the result, as long as
+// nobody else changed the file since it was read. On conflicts, the file is
+// reloaded and fn applied again. The caller must hold the write lock.
+func (p *Provider) update(fn func(urls map[string]string) error) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		urls := make(map[string]string, len(p.URLs)+1)
+		for alias, url := range p.URLs {
+			urls[alias] = url
+		}
+
+		if err := fn(urls); err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(urls)
+		if err != nil {
+			return err
+		}
+
+		condition := kleins3.WithHeader("If-Match", p.etag)
+		if p.etag == "" {
+			condition = kleins3.WithHeader("If-None-Match", "*")
+		}
+
+		output, err := p.Spaces.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+			Body:   bytes.NewReader(body),
+			Bucket: aws.String(p.Config.Space),
+			Key:    aws.String(p.Config.Path),
+		}, condition)
+		if kleins3.IsPreconditionFailed(err) {
+			// somebody else wrote in the meantime, reload and try again
+			if _, err := p.load(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		p.URLs = urls
+		p.etag = aws.StringValue(output.ETag)
+		return nil
+	}
+
+	return ErrTooManyConflicts
 }
 
 // Get attempts to find a URL by its alias and returns its original URL
 func (p *Provider) Get(alias string) (string, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
 	if url, exists := p.URLs[alias]; exists {
 		return url, nil
 	}
@@ -99,31 +237,57 @@ func (p *Provider) Exists(alias string) (bool, error) {
 
 // Store creates a new short URL
 func (p *Provider) Store(url, alias string) error {
-	exists, _ := p.Exists(alias)
-	if exists {
-		return storage.ErrAlreadyExists
-	}
+	url = strings.TrimSpace(url)
 
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	p.URLs[alias] = url
+	return p.update(func(urls map[string]string) error {
+		if _, exists := urls[alias]; exists {
+			return storage.ErrAlreadyExists
+		}
 
-	body, err := json.Marshal(p.URLs)
-	if err != nil {
-		return err
-	}
+		urls[alias] = url
+		return nil
+	})
+}
 
-	object := s3.PutObjectInput{
-		Body:   bytes.NewReader(body),
-		Bucket: aws.String(p.Config.Space),
-		Key:    aws.String(p.Config.Path),
-	}
-	_, err = p.Spaces.PutObject(&object)
+// Walk calls fn for every stored URL
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	p.mutex.RLock()
+	urls := p.URLs
+	p.mutex.RUnlock()
 
-	if err != nil {
-		return err
+	// the map is replaced rather than modified on writes, so it is safe to
+	// iterate over without holding the lock
+	for alias, url := range urls {
+		if err := fn(alias, url); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.update(func(urls map[string]string) error {
+		if _, exists := urls[alias]; !exists {
+			return storage.ErrNotFound
+		}
+
+		delete(urls, alias)
+		return nil
+	})
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return len(p.URLs), nil
+}
@@ -0,0 +1,116 @@
+package spaces
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/s3/s3test"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+func newProvider(t testing.TB, server *s3test.Server, refresh time.Duration) *Provider {
+	p, err := New(&Config{
+		AccessKey:       "access",
+		SecretKey:       "secret",
+		Space:           "klein",
+		Path:            "klein.json",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		RefreshInterval: refresh,
+	})
+	if err != nil {
+		t.Fatalf("couldn't init spaces driver: %v\n", err)
+	}
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	p := newProvider(t, server, 0)
+	defer p.Close()
+
+	storagetest.RunTests(p, t)
+}
+
+func TestConcurrentInstances(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	a := newProvider(t, server, 0)
+	defer a.Close()
+	b := newProvider(t, server, 0)
+	defer b.Close()
+
+	if err := a.Store("http://a.example.com", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// b hasn't seen a's write, so its first attempt conflicts and it has to reload
+	if err := b.Store("http://b.example.com", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := b.Get("a"); url != "http://a.example.com" {
+		t.Error("expected b to pick up a's url after a conflicting write")
+	}
+
+	// a is now stale, storing b's alias has to fail after reloading
+	if err := a.Store("http://other.example.com", "b"); err != storage.ErrAlreadyExists {
+		t.Errorf("expected ErrAlreadyExists storing an alias created by another instance, got %v", err)
+	}
+
+	// a fresh instance sees both urls
+	c := newProvider(t, server, 0)
+	defer c.Close()
+	for alias, want := range map[string]string{"a": "http://a.example.com", "b": "http://b.example.com"} {
+		if url, _ := c.Get(alias); url != want {
+			t.Errorf("expected %q to point to %q, got %q", alias, want, url)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	a := newProvider(t, server, 0)
+	defer a.Close()
+	b := newProvider(t, server, 10*time.Millisecond)
+	defer b.Close()
+
+	changed, err := b.refresh()
+	if err != nil || changed {
+		t.Errorf("expected an unchanged file not to be reloaded, got %v (%v)", changed, err)
+	}
+
+	if err := a.Store("http://a.example.com", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := b.Get("a"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected b to pick up a's url after refreshing")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// BenchmarkProvider uses small datasets, as every store uploads the whole file
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		server := s3test.New()
+		b.Cleanup(server.Close)
+
+		p := newProvider(b, server, 0)
+		b.Cleanup(func() { p.Close() })
+
+		return p
+	}, b, 100, 1000)
+}
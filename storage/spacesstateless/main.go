@@ -5,15 +5,15 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/kamaln7/klein/storage"
-	cache "github.com/patrickmn/go-cache"
+	"github.com/kamaln7/klein/storage/internal/lru"
+	kleins3 "github.com/kamaln7/klein/storage/s3"
 )
 
 // Provider implements an in memory storage that persists on DigitalOcean Spaces
@@ -21,7 +21,9 @@ type Provider struct {
 	Config *Config
 
 	spaces *s3.S3
-	cache  *cache.Cache
+	cache  *lru.Cache
+	stop   chan struct{}
+	closed sync.Once
 }
 
 // Config contains the configuration for the file storage
@@ -32,34 +34,84 @@ type Config struct {
 	Space     string
 	Path      string
 
+	// Endpoint overrides the Spaces endpoint derived from Region
+	Endpoint string
+	// PathStyle addresses the space as endpoint/space instead of
+	// space.endpoint, which S3-compatible stand-ins for Spaces may need
+	PathStyle bool
+
+	// CacheDuration is how long to cache URLs for. 0 disables caching.
 	CacheDuration time.Duration
+	// NegativeCacheDuration is how long to remember that an alias does not
+	// exist. It is capped at CacheDuration, 0 disables negative caching.
+	NegativeCacheDuration time.Duration
+	// CacheSize caps the number of cached aliases, evicting the least
+	// recently used ones. 0 means unlimited.
+	CacheSize int
 }
 
-// ensure that the storage.Provider interface is implemented
-var _ storage.Provider = new(Provider)
+// ensure that the storage.Walker, storage.Deleter, storage.Counter and storage.Invalidator interfaces are implemented
+var (
+	_ storage.Walker      = new(Provider)
+	_ storage.Deleter     = new(Provider)
+	_ storage.Counter     = new(Provider)
+	_ storage.Invalidator = new(Provider)
+)
 
 // New returns a new Provider instance
 func New(c *Config) (*Provider, error) {
-	spacesSession := session.New(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
-		Endpoint:    aws.String(fmt.Sprintf("https://%s.digitaloceanspaces.com", c.Region)),
-		Region:      aws.String("us-east-1"), // Needs to be us-east-1, or it'll fail.
-	})
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.digitaloceanspaces.com", c.Region)
+	}
+
+	// Needs to be us-east-1, or it'll fail.
+	spacesSession, err := kleins3.NewSession(endpoint, "us-east-1", c.AccessKey, c.SecretKey, c.PathStyle)
+	if err != nil {
+		return nil, err
+	}
 	spaces := s3.New(spacesSession)
 
 	p := &Provider{
 		Config: c,
 
 		spaces: spaces,
+		stop:   make(chan struct{}),
 	}
 
 	if c.CacheDuration != 0 {
-		p.cache = cache.New(c.CacheDuration, c.CacheDuration/2)
+		p.cache = lru.New(c.CacheSize)
+		go p.deleteExpiredPeriodically()
+	}
+	if c.NegativeCacheDuration > c.CacheDuration {
+		c.NegativeCacheDuration = c.CacheDuration
 	}
 
 	return p, nil
 }
 
+// Close stops dropping expired cache entries in the background
+func (p *Provider) Close() error {
+	p.closed.Do(func() { close(p.stop) })
+	return nil
+}
+
+// deleteExpiredPeriodically drops expired cache entries, which would
+// otherwise stay in memory until they are evicted
+func (p *Provider) deleteExpiredPeriodically() {
+	ticker := time.NewTicker(p.Config.CacheDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.cache.DeleteExpired()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
 func (p *Provider) aliasFullPath(alias string) string {
 	prefix := ""
 	if p.Config.Path != "" {
@@ -103,17 +155,23 @@ func (p *Provider) Get(alias string) (string, error) {
 		return p.getFromSpaces(alias)
 	}
 
-	cachedURL, isCached := p.cache.Get(alias)
-	if isCached {
-		return cachedURL.(string), nil
+	if cached, isCached := p.cache.Get(alias); isCached {
+		if cached == nil {
+			return "", storage.ErrNotFound
+		}
+
+		return *cached, nil
 	}
 
 	url, err := p.getFromSpaces(alias)
+	if err == storage.ErrNotFound && p.Config.NegativeCacheDuration > 0 {
+		p.cache.Add(alias, nil, p.Config.NegativeCacheDuration)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	p.cache.Set(alias, url, cache.DefaultExpiration)
+	p.cache.Add(alias, &url, p.Config.CacheDuration)
 	return url, nil
 }
 
@@ -128,15 +186,18 @@ func (p *Provider) Exists(alias string) (bool, error) {
 	return true, err
 }
 
-// Store creates a new short URL
+// Store creates a new short URL. The existence check skips the cache, so a
+// cached miss can't lead to overwriting a URL another instance just stored.
 func (p *Provider) Store(url, alias string) error {
-	exists, err := p.Exists(alias)
-	if err != nil {
-		return err
-	}
+	url = strings.TrimSpace(url)
 
-	if exists {
+	_, err := p.getFromSpaces(alias)
+	switch err {
+	case nil:
 		return storage.ErrAlreadyExists
+	case storage.ErrNotFound:
+	default:
+		return err
 	}
 
 	object := s3.PutObjectInput{
@@ -145,13 +206,112 @@ func (p *Provider) Store(url, alias string) error {
 		Key:    aws.String(p.aliasFullPath(alias)),
 	}
 
-	_, err = p.spaces.PutObject(&object)
+	_, err = p.spaces.PutObjectWithContext(aws.BackgroundContext(), &object, kleins3.WithHeader("If-None-Match", "*"))
+	if kleins3.IsPreconditionFailed(err) {
+		p.Invalidate(alias)
+		return storage.ErrAlreadyExists
+	}
 	if err != nil {
 		return err
 	}
 
 	if p.cache != nil {
-		p.cache.Set(alias, url, cache.DefaultExpiration)
+		p.cache.Set(alias, &url, p.Config.CacheDuration)
 	}
 	return nil
 }
+
+// Invalidate drops the cached URL or cached miss for an alias, so that
+// changes made by other instances are picked up on the next lookup. Store and
+// Delete invalidate their own aliases, and the server exposes it as
+// /_admin/invalidate. Otherwise, other instances see new links once
+// NegativeCacheDuration has passed, and changed or deleted ones once
+// CacheDuration has.
+func (p *Provider) Invalidate(alias string) {
+	if p.cache != nil {
+		p.cache.Delete(alias)
+	}
+}
+
+// Walk calls fn for every stored URL
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	prefix := p.aliasFullPath("")
+
+	var walkErr error
+	err := p.spaces.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(p.Config.Space),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			alias := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if alias == "" || strings.Contains(alias, "/") {
+				continue
+			}
+
+			url, err := p.getFromSpaces(alias)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				walkErr = err
+				return false
+			}
+
+			if err := fn(alias, url); err != nil {
+				walkErr = err
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return walkErr
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	_, err := p.getFromSpaces(alias)
+	if err == storage.ErrNotFound {
+		p.Invalidate(alias)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = p.spaces.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(p.Config.Space),
+		Key:    aws.String(p.aliasFullPath(alias)),
+	})
+	if err != nil {
+		return err
+	}
+
+	p.Invalidate(alias)
+	return nil
+}
+
+// Count returns the number of stored URLs by listing them, without fetching each one
+func (p *Provider) Count() (int, error) {
+	prefix := p.aliasFullPath("")
+
+	n := 0
+	err := p.spaces.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(p.Config.Space),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			alias := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if alias != "" && !strings.Contains(alias, "/") {
+				n++
+			}
+		}
+
+		return true
+	})
+
+	return n, err
+}
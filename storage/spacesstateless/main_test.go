@@ -0,0 +1,142 @@
+package spacesstateless
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/s3/s3test"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+func newProvider(t testing.TB, server *s3test.Server, c *Config) *Provider {
+	c.AccessKey = "access"
+	c.SecretKey = "secret"
+	c.Space = "klein"
+	c.Path = "klein"
+	c.Endpoint = server.URL
+	c.PathStyle = true
+
+	p, err := New(c)
+	if err != nil {
+		t.Fatalf("couldn't init spaces stateless driver: %v\n", err)
+	}
+
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	for name, c := range map[string]*Config{
+		"uncached": {},
+		"cached":   {CacheDuration: time.Minute, NegativeCacheDuration: time.Minute, CacheSize: 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := s3test.New()
+			defer server.Close()
+
+			p := newProvider(t, server, c)
+			defer p.Close()
+
+			storagetest.RunTests(p, t)
+		})
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	p := newProvider(t, server, &Config{
+		CacheDuration:         time.Minute,
+		NegativeCacheDuration: time.Minute,
+	})
+	defer p.Close()
+
+	if _, err := p.Get("example"); err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// another instance stores the alias, the cached miss hides it
+	server.PutObject("klein", "klein/example", []byte("http://example.com"))
+	if _, err := p.Get("example"); err != storage.ErrNotFound {
+		t.Errorf("expected the miss to be cached, got %v", err)
+	}
+
+	// but it doesn't stop this instance from refusing to overwrite it
+	if err := p.Store("http://other.example.com", "example"); err != storage.ErrAlreadyExists {
+		t.Errorf("expected ErrAlreadyExists despite the cached miss, got %v", err)
+	}
+
+	p.Invalidate("example")
+	if url, err := p.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected the url after invalidating, got %q (%v)", url, err)
+	}
+}
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	p := newProvider(t, server, &Config{
+		CacheDuration:         time.Minute,
+		NegativeCacheDuration: 10 * time.Millisecond,
+	})
+	defer p.Close()
+
+	p.Get("example")
+	server.PutObject("klein", "klein/example", []byte("http://example.com"))
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := p.Get("example"); err != nil {
+		t.Errorf("expected the cached miss to expire, got %v", err)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	server := s3test.New()
+	defer server.Close()
+
+	p := newProvider(t, server, &Config{
+		CacheDuration: time.Minute,
+		CacheSize:     2,
+	})
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := p.Store(fmt.Sprintf("http://example.com/%d", i), fmt.Sprintf("alias%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := p.cache.Len(); n != 2 {
+		t.Errorf("expected the cache to be capped at 2 entries, got %d", n)
+	}
+
+	// alias0 was evicted, so changes made elsewhere are visible
+	server.PutObject("klein", "klein/alias0", []byte("http://changed.example.com"))
+	server.PutObject("klein", "klein/alias2", []byte("http://changed.example.com"))
+
+	if url, _ := p.Get("alias0"); url != "http://changed.example.com" {
+		t.Errorf("expected the least recently used entry to be evicted, got %q", url)
+	}
+	if url, _ := p.Get("alias2"); url != "http://example.com/2" {
+		t.Errorf("expected the most recently used entry to stay cached, got %q", url)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	for name, c := range map[string]Config{
+		"uncached": {},
+		"cached":   {CacheDuration: time.Minute, NegativeCacheDuration: time.Minute, CacheSize: 10000},
+	} {
+		b.Run(name, func(b *testing.B) {
+			storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+				server := s3test.New()
+				b.Cleanup(server.Close)
+
+				c := c
+				return newProvider(b, server, &c)
+			}, b, 100, 1000)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/kamaln7/klein/storage"
+	sqlite "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Provider implements a SQLite-based storage system
+type Provider struct {
+	Config *Config
+	db     *sqlx.DB
+}
+
+// Config contains the configuration for the SQLite database
+type Config struct {
+	Path, Table string
+}
+
+// ensure that the storage.Walker, storage.Deleter, storage.Replacer, storage.Counter and storage.CreatorRecorder interfaces are implemented
+var (
+	_ storage.Walker          = new(Provider)
+	_ storage.Deleter         = new(Provider)
+	_ storage.Replacer        = new(Provider)
+	_ storage.Counter         = new(Provider)
+	_ storage.CreatorRecorder = new(Provider)
+)
+
+// New returns a new Provider instance
+func New(c *Config) (*Provider, error) {
+	provider := &Provider{
+		Config: c,
+	}
+	err := provider.Init()
+	if err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// Init opens the SQLite database in WAL mode and creates the table if needed
+func (p *Provider) Init() error {
+	params := url.Values{}
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+
+	// an opaque file: URI keeps relative paths relative, and escaping the
+	// path keeps a ? or # in it from being mistaken for the parameters
+	dsn := &url.URL{
+		Scheme:   "file",
+		Opaque:   (&url.URL{Path: p.Config.Path}).EscapedPath(),
+		RawQuery: params.Encode(),
+	}
+
+	db, err := sqlx.Open("sqlite", dsn.String())
+	if err != nil {
+		return err
+	}
+	p.db = db
+
+	// create table if it doesn't already exist
+	if err := p.createTable(); err != nil {
+		db.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Close closes the database
+func (p *Provider) Close() error {
+	return p.db.Close()
+}
+
+func (p *Provider) fillInTableName(query string) string {
+	return fmt.Sprintf(query, `"`+strings.Replace(p.Config.Table, `"`, `""`, -1)+`"`)
+}
+
+func (p *Provider) createTable() error {
+	q := p.fillInTableName(`
+	create table if not exists %s (
+		id integer primary key autoincrement,
+		alias text unique not null,
+		url text not null,
+		created_by text
+	)`)
+
+	if _, err := p.db.Exec(q); err != nil {
+		return err
+	}
+
+	// tables created before creators were recorded lack the column
+	var n int
+	if err := p.db.Get(&n, "select count(*) from pragma_table_info(?) where name = 'created_by'", p.Config.Table); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	_, err := p.db.Exec(p.fillInTableName("alter table %s add column created_by text"))
+	return err
+}
+
+// Get attempts to find a URL by its alias and returns its original URL
+func (p *Provider) Get(alias string) (string, error) {
+	var url string
+	err := p.db.Get(&url, p.fillInTableName("select url from %s where alias = ?"), alias)
+	if err == sql.ErrNoRows {
+		return "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return url, nil
+}
+
+// Exists checks if there is a URL with the requested alias
+func (p *Provider) Exists(alias string) (bool, error) {
+	_, err := p.Get(alias)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+
+	return true, err
+}
+
+// Store creates a new short URL
+func (p *Provider) Store(url, alias string) error {
+	return p.StoreCreatedBy(url, alias, "")
+}
+
+// StoreCreatedBy creates a new short URL and records who created it
+func (p *Provider) StoreCreatedBy(url, alias, creator string) error {
+	url = strings.TrimSpace(url)
+
+	_, err := p.db.Exec(p.fillInTableName("insert into %s (url, alias, created_by) values (?, ?, ?)"), url, alias, sql.NullString{String: creator, Valid: creator != ""})
+	if err, ok := err.(*sqlite.Error); ok && err.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return storage.ErrAlreadyExists
+	}
+
+	return err
+}
+
+// Walk calls fn for every stored URL, in insertion order
+func (p *Provider) Walk(fn func(alias, url string) error) error {
+	rows, err := p.db.Queryx(p.fillInTableName("select alias, url from %s order by id"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias, url string
+		if err := rows.Scan(&alias, &url); err != nil {
+			return err
+		}
+
+		if err := fn(alias, url); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Delete removes a short URL
+func (p *Provider) Delete(alias string) error {
+	res, err := p.db.Exec(p.fillInTableName("delete from %s where alias = ?"), alias)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Replace points an existing alias at a new URL
+func (p *Provider) Replace(url, alias string) error {
+	res, err := p.db.Exec(p.fillInTableName("update %s set url = ? where alias = ?"), strings.TrimSpace(url), alias)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Count returns the number of stored URLs
+func (p *Provider) Count() (int, error) {
+	var n int
+	err := p.db.Get(&n, p.fillInTableName("select count(*) from %s"))
+
+	return n, err
+}
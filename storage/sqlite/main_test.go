@@ -0,0 +1,116 @@
+package sqlite
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/storagetest"
+)
+
+func TestProvider(t *testing.T) {
+	p, err := New(&Config{
+		Path:  filepath.Join(t.TempDir(), "klein.db"),
+		Table: "klein",
+	})
+	if err != nil {
+		t.Fatalf("couldn't init sqlite driver: %v\n", err)
+	}
+	defer p.Close()
+
+	var mode string
+	if err := p.db.Get(&mode, "pragma journal_mode"); err != nil || mode != "wal" {
+		t.Errorf("expected the database to be in WAL mode, got %q (%v)", mode, err)
+	}
+
+	storagetest.RunTests(p, t)
+}
+
+func TestPath(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"klein?mode=ro.db", "klein#1.db", "klein 100%.db"} {
+		path := filepath.Join(dir, name)
+		p, err := New(&Config{Path: path, Table: "klein"})
+		if err != nil {
+			t.Errorf("%s: couldn't init sqlite driver: %v", name, err)
+			continue
+		}
+		p.Close()
+
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s: expected the database to be created at its path, got %v", name, err)
+		}
+	}
+
+	// relative paths are opened relative to the working directory
+	t.Chdir(dir)
+
+	p, err := New(&Config{Path: "relative.db", Table: "klein"})
+	if err != nil {
+		t.Fatalf("couldn't init sqlite driver: %v", err)
+	}
+	p.Close()
+	if _, err := os.Stat(filepath.Join(dir, "relative.db")); err != nil {
+		t.Errorf("expected the database to be created in the working directory, got %v", err)
+	}
+}
+
+func TestCreatedBy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "klein.db")
+	p, err := New(&Config{Path: path, Table: "klein"})
+	if err != nil {
+		t.Fatalf("couldn't init sqlite driver: %v\n", err)
+	}
+	defer p.Close()
+
+	// a table created before creators were recorded
+	if _, err := p.db.Exec("create table old (id integer primary key autoincrement, alias text unique not null, url text not null)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.db.Exec("insert into old (url, alias) values ('http://example.com', 'example')"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := New(&Config{Path: path, Table: "old"})
+	if err != nil {
+		t.Fatalf("couldn't upgrade the table: %v", err)
+	}
+	defer old.Close()
+
+	for _, p := range []*Provider{p, old} {
+		if err := p.StoreCreatedBy("http://example.com/alice", "alice", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Store("http://example.com/anonymous", "anonymous"); err != nil {
+			t.Fatal(err)
+		}
+
+		var creators []sql.NullString
+		if err := p.db.Select(&creators, p.fillInTableName("select created_by from %s where alias in ('alice', 'anonymous') order by id")); err != nil {
+			t.Fatal(err)
+		}
+		if len(creators) != 2 || creators[0].String != "alice" || creators[1].Valid {
+			t.Errorf("%s: expected alice and no creator, got %v", p.Config.Table, creators)
+		}
+	}
+	if url, err := old.Get("example"); err != nil || url != "http://example.com" {
+		t.Errorf("expected existing links to be kept, got %q, %v", url, err)
+	}
+}
+
+func BenchmarkProvider(b *testing.B) {
+	storagetest.RunBenchmarks(func(b *testing.B) storage.Provider {
+		p, err := New(&Config{
+			Path:  filepath.Join(b.TempDir(), "klein.db"),
+			Table: "klein",
+		})
+		if err != nil {
+			b.Fatalf("couldn't init sqlite driver: %v\n", err)
+		}
+		b.Cleanup(func() { p.Close() })
+
+		return p
+	}, b)
+}
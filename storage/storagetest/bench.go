@@ -0,0 +1,140 @@
+package storagetest
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+)
+
+var (
+	// BenchmarkSizes are the numbers of links RunBenchmarks fills a provider with
+	BenchmarkSizes = []int{100, 10000}
+	// BenchmarkConcurrency are the numbers of goroutines RunBenchmarks calls a provider from
+	BenchmarkConcurrency = []int{1, 16}
+
+	benchID uint64
+)
+
+// RunBenchmarks measures Get, Exists and Store on a provider filled with
+// each of sizes links, or BenchmarkSizes if none are given, and at each level
+// of BenchmarkConcurrency. open is called once per size and has to return an
+// empty provider, closing it with b.Cleanup if necessary.
+//
+// Results are named eg get/links=10000/goroutines=16, so that backends can be
+// compared with benchstat.
+func RunBenchmarks(open func(b *testing.B) storage.Provider, b *testing.B, sizes ...int) {
+	if len(sizes) == 0 {
+		sizes = BenchmarkSizes
+	}
+
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("links=%d", size), func(b *testing.B) {
+			p := open(b)
+			fill(b, p, size)
+
+			// Store runs last, as it adds links
+			benchmark(b, "get", func(i int) error {
+				_, err := p.Get(benchAlias(spread(i, size)))
+				return err
+			})
+			benchmark(b, "exists", func(i int) error {
+				// new aliases are checked for before they are stored, so half of the lookups miss
+				alias := benchAlias(spread(i, size))
+				if i%2 == 1 {
+					alias += "-missing"
+				}
+
+				exists, err := p.Exists(alias)
+				if err == nil && exists == (i%2 == 1) {
+					err = fmt.Errorf("expected %s to exist: %v, got %v", alias, i%2 == 0, exists)
+				}
+				return err
+			})
+			benchmark(b, "store", func(i int) error {
+				return p.Store("http://example.com/new", fmt.Sprintf("bench-new-%d", atomic.AddUint64(&benchID, 1)))
+			})
+		})
+	}
+}
+
+// fill stores size links, from as many goroutines as the most concurrent benchmark uses
+func fill(b *testing.B, p storage.Provider, size int) {
+	b.Helper()
+
+	concurrency := 1
+	for _, c := range BenchmarkConcurrency {
+		if c > concurrency {
+			concurrency = c
+		}
+	}
+
+	if err := parallel(size, concurrency, func(i int) error {
+		return p.Store("http://example.com/"+strconv.Itoa(i), benchAlias(i))
+	}); err != nil {
+		b.Fatalf("couldn't store %d links: %v", size, err)
+	}
+}
+
+func benchmark(b *testing.B, name string, fn func(i int) error) {
+	for _, concurrency := range BenchmarkConcurrency {
+		b.Run(fmt.Sprintf("%s/goroutines=%d", name, concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			err := parallel(b.N, concurrency, fn)
+			b.StopTimer()
+
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// parallel calls fn for 0 through n-1 from concurrency goroutines, stopping
+// at the first error
+func parallel(n, concurrency int, fn func(i int) error) error {
+	var (
+		next  int64 = -1
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+
+				if err := fn(i); err != nil {
+					once.Do(func() { first = err })
+					// make the other goroutines stop too
+					atomic.StoreInt64(&next, int64(n))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return first
+}
+
+func benchAlias(i int) string {
+	return "bench-" + strconv.Itoa(i)
+}
+
+// spread maps consecutive iterations onto links all over the dataset, rather
+// than reading them in the order they were stored
+func spread(i, size int) int {
+	return (i * 7919) % size
+}
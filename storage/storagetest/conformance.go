@@ -0,0 +1,384 @@
+package storagetest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+)
+
+var (
+	// runID keeps aliases from earlier runs against a persistent backend from clashing
+	runID   = newRunID()
+	aliasID uint64
+)
+
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newAlias returns an alias that no other test uses, ending in suffix
+func newAlias(suffix string) string {
+	return fmt.Sprintf("conformance-%s-%d%s", runID, atomic.AddUint64(&aliasID, 1), suffix)
+}
+
+// RunConformanceTests runs a thorough test suite that every storage provider
+// has to pass, including the optional Walker, Deleter, Replacer, Counter and
+// CreatorRecorder interfaces if p implements them. Every subtest uses its own
+// aliases, so p may already hold links, but nothing else may write to it while
+// the suite is running.
+// Run the tests with -race to catch unsynchronized access.
+func RunConformanceTests(p storage.Provider, t *testing.T) {
+	t.Run("store and look up", func(t *testing.T) {
+		alias, url := newAlias(""), "http://example.com/store"
+
+		if exists, err := p.Exists(alias); err != nil || exists {
+			t.Errorf("expected a new alias not to exist, got %v, %v", exists, err)
+		}
+		if _, err := p.Get(alias); err != storage.ErrNotFound {
+			t.Errorf("expected ErrNotFound looking up a new alias, got %v", err)
+		}
+
+		mustStore(t, p, url, alias)
+		expectURL(t, p, alias, url)
+		if exists, err := p.Exists(alias); err != nil || !exists {
+			t.Errorf("expected a stored alias to exist, got %v, %v", exists, err)
+		}
+	})
+
+	t.Run("existing aliases are not overwritten", func(t *testing.T) {
+		alias := newAlias("")
+		mustStore(t, p, "http://example.com/first", alias)
+
+		if err := p.Store("http://example.com/second", alias); err != storage.ErrAlreadyExists {
+			t.Errorf("expected ErrAlreadyExists, got %v", err)
+		}
+		expectURL(t, p, alias, "http://example.com/first")
+	})
+
+	t.Run("aliases", func(t *testing.T) {
+		for name, suffix := range map[string]string{
+			"unicode":     "-ünïcödé",
+			"cjk":         "-日本語",
+			"emoji":       "-🦄🌈",
+			"emoji zwj":   "-👩‍💻",
+			"punctuation": "-a.b_c~d!e",
+			"long":        "-" + strings.Repeat("a", 200),
+		} {
+			t.Run(name, func(t *testing.T) {
+				alias := newAlias(suffix)
+				url := "http://example.com/" + strconv.Itoa(len(alias))
+
+				mustStore(t, p, url, alias)
+				expectURL(t, p, alias, url)
+			})
+		}
+
+		t.Run("case sensitivity", func(t *testing.T) {
+			alias := newAlias("")
+			lower, upper := alias+"-abc", alias+"-ABC"
+
+			mustStore(t, p, "http://example.com/lower", lower)
+			if err := p.Store("http://example.com/upper", upper); err != nil {
+				t.Fatalf("expected aliases differing in case to be distinct, got %v", err)
+			}
+			expectURL(t, p, lower, "http://example.com/lower")
+			expectURL(t, p, upper, "http://example.com/upper")
+		})
+
+		t.Run("prefixes", func(t *testing.T) {
+			alias := newAlias("")
+			mustStore(t, p, "http://example.com/long", alias+"-long")
+
+			if _, err := p.Get(alias); err != storage.ErrNotFound {
+				t.Errorf("expected a prefix of an alias not to be found, got %v", err)
+			}
+		})
+	})
+
+	t.Run("urls", func(t *testing.T) {
+		for name, url := range map[string]string{
+			"long":    "http://example.com/?q=" + strings.Repeat("a", 8192),
+			"unicode": "http://example.com/ünïcödé/🦄?q=日本語",
+			"query":   "http://example.com/a%20b?c=d&e=f#g",
+		} {
+			t.Run(name, func(t *testing.T) {
+				alias := newAlias("")
+
+				mustStore(t, p, url, alias)
+				expectURL(t, p, alias, url)
+			})
+		}
+
+		// files can't tell a trailing newline from the end of a URL, so
+		// every provider trims surrounding whitespace
+		t.Run("whitespace is trimmed", func(t *testing.T) {
+			alias := newAlias("")
+
+			mustStore(t, p, " \t http://example.com/whitespace \r\n", alias)
+			expectURL(t, p, alias, "http://example.com/whitespace")
+
+			if w, ok := p.(storage.Walker); ok {
+				urls := walk(t, w)
+				if url := urls[alias]; url != "http://example.com/whitespace" {
+					t.Errorf("expected walk to return the trimmed url, got %q", url)
+				}
+			}
+		})
+	})
+
+	t.Run("concurrent stores of one alias", func(t *testing.T) {
+		alias := newAlias("")
+
+		var (
+			wg     sync.WaitGroup
+			mutex  sync.Mutex
+			winner []string
+		)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+
+				err := p.Store(url, alias)
+				switch err {
+				case nil:
+					mutex.Lock()
+					winner = append(winner, url)
+					mutex.Unlock()
+				case storage.ErrAlreadyExists:
+				default:
+					t.Errorf("unexpected error: %v", err)
+				}
+			}("http://example.com/" + strconv.Itoa(i))
+		}
+		wg.Wait()
+
+		if len(winner) != 1 {
+			t.Fatalf("expected exactly one store to succeed, got %v", winner)
+		}
+		expectURL(t, p, alias, winner[0])
+	})
+
+	t.Run("concurrent reads and writes", func(t *testing.T) {
+		aliases := make([]string, 40)
+		for i := range aliases {
+			aliases[i] = newAlias("")
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				for i := w; i < len(aliases); i += 4 {
+					if err := p.Store("http://example.com/"+aliases[i], aliases[i]); err != nil {
+						t.Errorf("couldn't store %q: %v", aliases[i], err)
+					}
+
+					// look up what the other goroutines are storing
+					other := aliases[(i+1)%len(aliases)]
+					if url, err := p.Get(other); err != nil && err != storage.ErrNotFound {
+						t.Errorf("couldn't look up %q: %v", other, err)
+					} else if err == nil && url != "http://example.com/"+other {
+						t.Errorf("got the wrong url %q for %q", url, other)
+					}
+					if _, err := p.Exists(other); err != nil {
+						t.Errorf("couldn't check %q: %v", other, err)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for _, alias := range aliases {
+			expectURL(t, p, alias, "http://example.com/"+alias)
+		}
+	})
+
+	if w, ok := p.(storage.Walker); ok {
+		t.Run("walk", func(t *testing.T) {
+			stored := map[string]string{
+				newAlias(""):     "http://example.com/a",
+				newAlias("-🦄"):   "http://example.com/b",
+				newAlias("-日本語"): "http://example.com/c",
+			}
+			for alias, url := range stored {
+				mustStore(t, p, url, alias)
+			}
+
+			urls := walk(t, w)
+			for alias, url := range stored {
+				if urls[alias] != url {
+					t.Errorf("expected walk to return %q for %q, got %q", url, alias, urls[alias])
+				}
+			}
+		})
+
+		t.Run("walk stops at the first error", func(t *testing.T) {
+			mustStore(t, p, "http://example.com/a", newAlias(""))
+			mustStore(t, p, "http://example.com/b", newAlias(""))
+
+			stop := errors.New("stop")
+			calls := 0
+			err := w.Walk(func(alias, url string) error {
+				calls++
+				return stop
+			})
+			if err != stop {
+				t.Errorf("expected walk to return the error, got %v", err)
+			}
+			if calls != 1 {
+				t.Errorf("expected walk to stop after the first error, got %d calls", calls)
+			}
+		})
+	}
+
+	if c, ok := p.(storage.Counter); ok {
+		t.Run("count", func(t *testing.T) {
+			before, err := c.Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 3; i++ {
+				mustStore(t, p, "http://example.com/count", newAlias(""))
+			}
+			if after, err := c.Count(); err != nil || after != before+3 {
+				t.Errorf("expected %d urls after storing 3, got %d, %v", before+3, after, err)
+			}
+
+			if d, ok := p.(storage.Deleter); ok {
+				alias := newAlias("")
+				mustStore(t, p, "http://example.com/count", alias)
+				d.Delete(alias)
+				if after, err := c.Count(); err != nil || after != before+3 {
+					t.Errorf("expected deleted urls not to be counted, got %d, %v", after, err)
+				}
+			}
+		})
+	}
+
+	if d, ok := p.(storage.Deleter); ok {
+		t.Run("delete", func(t *testing.T) {
+			alias := newAlias("")
+			mustStore(t, p, "http://example.com/old", alias)
+
+			if err := d.Delete(alias); err != nil {
+				t.Fatalf("couldn't delete: %v", err)
+			}
+			if _, err := p.Get(alias); err != storage.ErrNotFound {
+				t.Errorf("expected ErrNotFound looking up a deleted alias, got %v", err)
+			}
+			if exists, err := p.Exists(alias); err != nil || exists {
+				t.Errorf("expected a deleted alias not to exist, got %v, %v", exists, err)
+			}
+			if err := d.Delete(alias); err != storage.ErrNotFound {
+				t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+			}
+
+			// the alias can be reused
+			mustStore(t, p, "http://example.com/new", alias)
+			expectURL(t, p, alias, "http://example.com/new")
+
+			if w, ok := p.(storage.Walker); ok {
+				if url := walk(t, w)[alias]; url != "http://example.com/new" {
+					t.Errorf("expected walk to return the new url, got %q", url)
+				}
+			}
+		})
+
+		t.Run("delete leaves other aliases alone", func(t *testing.T) {
+			alias := newAlias("")
+			mustStore(t, p, "http://example.com/a", alias)
+			mustStore(t, p, "http://example.com/b", alias+"-other")
+
+			d.Delete(alias)
+			expectURL(t, p, alias+"-other", "http://example.com/b")
+		})
+	}
+
+	if r, ok := p.(storage.CreatorRecorder); ok {
+		t.Run("store created by", func(t *testing.T) {
+			alias := newAlias("")
+			if err := r.StoreCreatedBy(" http://example.com/created\n", alias, "alice"); err != nil {
+				t.Fatalf("couldn't store %q: %v", alias, err)
+			}
+			expectURL(t, p, alias, "http://example.com/created")
+
+			if err := r.StoreCreatedBy("http://example.com/other", alias, "bob"); err != storage.ErrAlreadyExists {
+				t.Errorf("expected ErrAlreadyExists, got %v", err)
+			}
+			expectURL(t, p, alias, "http://example.com/created")
+		})
+	}
+
+	if r, ok := p.(storage.Replacer); ok {
+		t.Run("replace", func(t *testing.T) {
+			alias := newAlias("")
+			if err := r.Replace("http://example.com/new", alias); err != storage.ErrNotFound {
+				t.Errorf("expected ErrNotFound replacing a new alias, got %v", err)
+			}
+			if exists, err := p.Exists(alias); err != nil || exists {
+				t.Errorf("expected replace not to create the alias, got %v, %v", exists, err)
+			}
+
+			mustStore(t, p, "http://example.com/old", alias)
+			mustStore(t, p, "http://example.com/other", alias+"-other")
+			if err := r.Replace(" http://example.com/new\n", alias); err != nil {
+				t.Fatalf("couldn't replace: %v", err)
+			}
+			expectURL(t, p, alias, "http://example.com/new")
+			expectURL(t, p, alias+"-other", "http://example.com/other")
+		})
+	}
+}
+
+func mustStore(t *testing.T, p storage.Provider, url, alias string) {
+	t.Helper()
+
+	if err := p.Store(url, alias); err != nil {
+		t.Fatalf("couldn't store %q: %v", alias, err)
+	}
+}
+
+func expectURL(t *testing.T, p storage.Provider, alias, url string) {
+	t.Helper()
+
+	got, err := p.Get(alias)
+	if err != nil {
+		t.Errorf("couldn't look up %q: %v", alias, err)
+		return
+	}
+	if got != url {
+		t.Errorf("expected %q to be %.100q, got %.100q", alias, url, got)
+	}
+}
+
+func walk(t *testing.T, w storage.Walker) map[string]string {
+	t.Helper()
+
+	urls := make(map[string]string)
+	err := w.Walk(func(alias, url string) error {
+		if _, ok := urls[alias]; ok {
+			t.Errorf("walk returned %q twice", alias)
+		}
+		urls[alias] = url
+		return nil
+	})
+	if err != nil {
+		t.Errorf("couldn't walk: %v", err)
+	}
+
+	return urls
+}
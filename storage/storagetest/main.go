@@ -6,6 +6,12 @@ import (
 	"github.com/kamaln7/klein/storage"
 )
 
+// RunTests runs the basic and the conformance test suites against p
+func RunTests(p storage.Provider, t *testing.T) {
+	t.Run("basic", func(t *testing.T) { RunBasicTests(p, t) })
+	t.Run("conformance", func(t *testing.T) { RunConformanceTests(p, t) })
+}
+
 // RunBasicTests run a basic test suite that should work on all storage providers
 func RunBasicTests(p storage.Provider, t *testing.T) {
 	var err error
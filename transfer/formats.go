@@ -0,0 +1,232 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JSON Lines: one {"alias": ..., "url": ...} object per line
+
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	return &jsonlReader{scanner: scanner}
+}
+
+func (r *jsonlReader) Read() (*Link, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		l := &Link{}
+		if err := json.Unmarshal(line, l); err != nil {
+			return nil, &LineError{Line: r.line, Err: err}
+		}
+
+		return validate(l, r.line)
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	return &jsonlWriter{encoder: encoder}
+}
+
+func (w *jsonlWriter) Write(l *Link) error {
+	return w.encoder.Encode(l)
+}
+
+func (w *jsonlWriter) Flush() error {
+	return nil
+}
+
+// CSV based formats share a reader and writer and only differ in their columns
+
+type columns struct {
+	// header is written on export, the first two columns hold the alias and URL
+	header []string
+	// alias and url list the header names accepted on import
+	alias, url []string
+	// toAlias turns the alias column into a klein alias on import
+	toAlias func(string) string
+}
+
+var csvColumns = &columns{
+	header: []string{"alias", "url"},
+	alias:  []string{"alias"},
+	url:    []string{"url"},
+}
+
+// YOURLS exports, as written by its export plugins
+var yourlsColumns = &columns{
+	header: []string{"keyword", "url", "title", "timestamp", "ip", "clicks"},
+	alias:  []string{"keyword"},
+	url:    []string{"url"},
+}
+
+// Bitly link exports, where the bitlink includes the short domain
+var bitlyColumns = &columns{
+	header: []string{"bitlink", "long_url", "title"},
+	alias:  []string{"bitlink", "link", "id"},
+	url:    []string{"long_url", "long url"},
+	toAlias: func(bitlink string) string {
+		bitlink = strings.TrimRight(bitlink, "/")
+		return bitlink[strings.LastIndex(bitlink, "/")+1:]
+	},
+}
+
+type csvReader struct {
+	reader           *csv.Reader
+	columns          *columns
+	aliasCol, urlCol int
+	record           int
+}
+
+func newCSVReader(r io.Reader, c *columns) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing csv header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &csvReader{
+		reader:   reader,
+		columns:  c,
+		aliasCol: findColumn(header, c.alias),
+		urlCol:   findColumn(header, c.url),
+	}
+	if cr.aliasCol == -1 || cr.urlCol == -1 {
+		return nil, fmt.Errorf("csv header needs a %q and a %q column", c.alias[0], c.url[0])
+	}
+
+	return cr, nil
+}
+
+func findColumn(header, names []string) int {
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		for _, name := range names {
+			if h == name {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func (r *csvReader) Read() (*Link, error) {
+	for {
+		record, err := r.reader.Read()
+		if perr, ok := err.(*csv.ParseError); ok {
+			// the reader carries on with the next record
+			r.record++
+			return nil, &LineError{Line: perr.StartLine, Err: perr.Err}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r.record++
+		line := r.record + 1
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if r.aliasCol >= len(record) || r.urlCol >= len(record) {
+			return nil, &LineError{Line: line, Err: errors.New("not enough columns")}
+		}
+
+		alias := strings.TrimSpace(record[r.aliasCol])
+		if r.columns.toAlias != nil {
+			alias = r.columns.toAlias(alias)
+		}
+
+		return validate(&Link{
+			Alias: alias,
+			URL:   strings.TrimSpace(record[r.urlCol]),
+		}, line)
+	}
+}
+
+type csvWriter struct {
+	writer  *csv.Writer
+	columns *columns
+	started bool
+}
+
+func newCSVWriter(w io.Writer, c *columns) *csvWriter {
+	return &csvWriter{
+		writer:  csv.NewWriter(w),
+		columns: c,
+	}
+}
+
+func (w *csvWriter) Write(l *Link) error {
+	if !w.started {
+		w.started = true
+		if err := w.writer.Write(w.columns.header); err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(w.columns.header))
+	record[0], record[1] = l.Alias, l.URL
+
+	return w.writer.Write(record)
+}
+
+func (w *csvWriter) Flush() error {
+	if !w.started {
+		w.started = true
+		if err := w.writer.Write(w.columns.header); err != nil {
+			return err
+		}
+	}
+
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func validate(l *Link, line int) (*Link, error) {
+	if l.Alias == "" {
+		return nil, &LineError{Line: line, Err: errors.New("missing alias")}
+	}
+	if l.URL == "" {
+		return nil, &LineError{Line: line, Err: errors.New("missing url")}
+	}
+
+	return l, nil
+}
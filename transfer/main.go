@@ -0,0 +1,218 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kamaln7/klein/storage"
+)
+
+// Link is a single short URL as it appears in an export
+type Link struct {
+	Alias string `json:"alias"`
+	URL   string `json:"url"`
+}
+
+// A Reader reads links from an export one at a time.
+// Read returns io.EOF once there are no more links.
+type Reader interface {
+	Read() (*Link, error)
+}
+
+// A Writer writes links to an export one at a time.
+// Flush must be called once all links have been written.
+type Writer interface {
+	Write(l *Link) error
+	Flush() error
+}
+
+// Formats lists the supported export and import formats
+var Formats = []string{"jsonl", "csv", "yourls", "bitly"}
+
+// ConflictPolicy decides what happens when an imported alias already exists
+type ConflictPolicy string
+
+// Conflict policies
+const (
+	// Skip keeps the existing URL and ignores the imported one
+	Skip ConflictPolicy = "skip"
+	// Overwrite replaces the existing URL with the imported one
+	Overwrite ConflictPolicy = "overwrite"
+)
+
+// NewReader returns a Reader for the given format
+func NewReader(format string, r io.Reader) (Reader, error) {
+	switch format {
+	case "jsonl":
+		return newJSONLReader(r), nil
+	case "csv":
+		return newCSVReader(r, csvColumns)
+	case "yourls":
+		return newCSVReader(r, yourlsColumns)
+	case "bitly":
+		return newCSVReader(r, bitlyColumns)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// NewWriter returns a Writer for the given format
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case "jsonl":
+		return newJSONLWriter(w), nil
+	case "csv":
+		return newCSVWriter(w, csvColumns), nil
+	case "yourls":
+		return newCSVWriter(w, yourlsColumns), nil
+	case "bitly":
+		return newCSVWriter(w, bitlyColumns), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// ContentType returns the MIME type of a format
+func ContentType(format string) string {
+	if format == "jsonl" {
+		return "application/x-ndjson"
+	}
+
+	return "text/csv"
+}
+
+// Export writes every link in src to w and returns how many were written
+func Export(src storage.Walker, w Writer) (int, error) {
+	n := 0
+	err := src.Walk(func(alias, url string) error {
+		n++
+		return w.Write(&Link{Alias: alias, URL: url})
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.Flush()
+}
+
+// A LineError is returned by a Reader for a line that can't be imported.
+// The Reader carries on with the next line on the following Read.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// MaxErrors is how many failed lines a Result describes
+const MaxErrors = 100
+
+// Result sums up an import
+type Result struct {
+	Imported    int `json:"imported"`
+	Skipped     int `json:"skipped"`
+	Overwritten int `json:"overwritten"`
+	// Failed counts the lines that could not be read or stored, and Errors
+	// describes the first MaxErrors of them
+	Failed int      `json:"failed"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (res *Result) fail(err error) {
+	res.Failed++
+	if len(res.Errors) < MaxErrors {
+		res.Errors = append(res.Errors, err.Error())
+	}
+}
+
+// Import stores every link read from r in dst. Links whose alias already
+// exists with the same URL are skipped, other conflicts are handled
+// according to policy. Overwriting requires dst to be a storage.Replacer or
+// a storage.Deleter.
+//
+// Lines that can't be read or stored are counted in the Result and the import
+// carries on with the next one. An error is only returned if the import could
+// not be finished.
+func Import(dst storage.Provider, r Reader, policy ConflictPolicy) (*Result, error) {
+	res := &Result{}
+
+	switch policy {
+	case Skip:
+	case Overwrite:
+		_, replacer := dst.(storage.Replacer)
+		_, deleter := dst.(storage.Deleter)
+		if !replacer && !deleter {
+			return res, fmt.Errorf("storage driver does not support overwriting links")
+		}
+	default:
+		return res, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+
+	for {
+		l, err := r.Read()
+		if err == io.EOF {
+			return res, nil
+		}
+		if lerr, ok := err.(*LineError); ok {
+			res.fail(lerr)
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+
+		if err := importLink(dst, l, policy, res); err != nil {
+			res.fail(fmt.Errorf("%q: %v", l.Alias, err))
+		}
+	}
+}
+
+// importLink stores a single link and counts it in res
+func importLink(dst storage.Provider, l *Link, policy ConflictPolicy, res *Result) error {
+	existing, err := dst.Get(l.Alias)
+	switch err {
+	case storage.ErrNotFound:
+		if err := dst.Store(l.URL, l.Alias); err != nil {
+			return fmt.Errorf("could not store: %v", err)
+		}
+		res.Imported++
+		return nil
+	case nil:
+	default:
+		return err
+	}
+
+	if existing == l.URL || policy == Skip {
+		res.Skipped++
+		return nil
+	}
+
+	if err := replace(dst, l.URL, l.Alias, existing); err != nil {
+		return fmt.Errorf("could not overwrite: %v", err)
+	}
+	res.Overwritten++
+	return nil
+}
+
+// replace points alias at url in one step if dst supports it. Otherwise, the
+// alias is deleted and stored again, and the old URL is put back if the new
+// one can't be stored.
+func replace(dst storage.Provider, url, alias, old string) error {
+	if replacer, ok := dst.(storage.Replacer); ok {
+		return replacer.Replace(url, alias)
+	}
+
+	if err := dst.(storage.Deleter).Delete(alias); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if err := dst.Store(url, alias); err != nil {
+		if rerr := dst.Store(old, alias); rerr != nil && rerr != storage.ErrAlreadyExists {
+			return fmt.Errorf("%v, and could not restore the old url: %v", err, rerr)
+		}
+		return err
+	}
+
+	return nil
+}
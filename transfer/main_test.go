@@ -0,0 +1,183 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kamaln7/klein/storage"
+	"github.com/kamaln7/klein/storage/memory"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range Formats {
+		t.Run(format, func(t *testing.T) {
+			src := memory.New(&memory.Config{})
+			src.Store("http://example.com/?a=1,b=2", "example")
+			src.Store(`http://example.com/"quoted"`, "quoted")
+
+			buf := new(bytes.Buffer)
+			w, err := NewWriter(format, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := Export(src, w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("expected 2 exported links, got %d", n)
+			}
+
+			dst := memory.New(&memory.Config{})
+			r, err := NewReader(format, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := Import(dst, r, Skip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Imported != 2 {
+				t.Errorf("expected 2 imported links, got %d", res.Imported)
+			}
+
+			for _, alias := range []string{"example", "quoted"} {
+				want, _ := src.Get(alias)
+				got, err := dst.Get(alias)
+				if err != nil || got != want {
+					t.Errorf("expected %q to point to %q, got %q (%v)", alias, want, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestImportBitly(t *testing.T) {
+	export := "Bitlink,Long URL,Title\nbit.ly/abc123,https://example.com/a,A\nhttps://bit.ly/xyz/,https://example.com/b,B\n"
+
+	r, err := NewReader("bitly", strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := memory.New(&memory.Config{})
+	if _, err := Import(dst, r, Skip); err != nil {
+		t.Fatal(err)
+	}
+
+	for alias, want := range map[string]string{"abc123": "https://example.com/a", "xyz": "https://example.com/b"} {
+		if got, _ := dst.Get(alias); got != want {
+			t.Errorf("expected %q to point to %q, got %q", alias, want, got)
+		}
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	export := `{"alias":"same","url":"http://same"}
+{"alias":"other","url":"http://new"}
+`
+
+	for policy, want := range map[ConflictPolicy]Result{
+		Skip:      {Skipped: 2},
+		Overwrite: {Skipped: 1, Overwritten: 1},
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			dst := memory.New(&memory.Config{})
+			dst.Store("http://same", "same")
+			dst.Store("http://old", "other")
+
+			r, _ := NewReader("jsonl", strings.NewReader(export))
+			res, err := Import(dst, r, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*res, want) {
+				t.Errorf("expected %+v, got %+v", want, *res)
+			}
+
+			wantURL := "http://old"
+			if policy == Overwrite {
+				wantURL = "http://new"
+			}
+			if got, _ := dst.Get("other"); got != wantURL {
+				t.Errorf("expected other to point to %q, got %q", wantURL, got)
+			}
+		})
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	for format, export := range map[string]string{
+		"jsonl": "{\"alias\":\"a\",\"url\":\"http://a\"}\n{\"alias\":\"b\"}\nnot json\n{\"alias\":\"c\",\"url\":\"http://c\"}\n",
+		"csv":   "alias,url\nb\na,http://a\nc\"x,http://c\nd,http://d\n",
+	} {
+		t.Run(format, func(t *testing.T) {
+			dst := memory.New(&memory.Config{})
+			r, _ := NewReader(format, strings.NewReader(export))
+			res, err := Import(dst, r, Skip)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Imported != 2 || res.Failed != 2 || len(res.Errors) != 2 {
+				t.Errorf("expected 2 imported and 2 failed lines, got %+v", *res)
+			}
+			if len(res.Errors) > 0 && !strings.HasPrefix(res.Errors[0], "line 2: ") {
+				t.Errorf("expected the error to name the line, got %q", res.Errors[0])
+			}
+		})
+	}
+
+	if _, err := NewReader("csv", strings.NewReader("foo,bar\n")); err == nil {
+		t.Error("expected an error reading a csv without alias and url columns")
+	}
+}
+
+// deleteOnly is a storage.Deleter that can't replace links and fails to
+// store some URLs
+type deleteOnly struct {
+	p    *memory.Provider
+	fail string
+}
+
+func (d *deleteOnly) Get(alias string) (string, error)  { return d.p.Get(alias) }
+func (d *deleteOnly) Exists(alias string) (bool, error) { return d.p.Exists(alias) }
+func (d *deleteOnly) Delete(alias string) error         { return d.p.Delete(alias) }
+func (d *deleteOnly) Store(url, alias string) error {
+	if url == d.fail {
+		return errors.New("storage is down")
+	}
+	return d.p.Store(url, alias)
+}
+
+func TestImportOverwrite(t *testing.T) {
+	dst := &deleteOnly{p: memory.New(&memory.Config{}), fail: "http://broken"}
+	dst.p.Store("http://old", "a")
+	dst.p.Store("http://old", "b")
+
+	r, _ := NewReader("jsonl", strings.NewReader(`{"alias":"a","url":"http://broken"}
+{"alias":"b","url":"http://new"}
+`))
+	res, err := Import(dst, r, Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Overwritten != 1 || res.Failed != 1 {
+		t.Errorf("expected 1 overwritten and 1 failed link, got %+v", *res)
+	}
+
+	// the old url is restored if the new one can't be stored
+	if url, _ := dst.Get("a"); url != "http://old" {
+		t.Errorf("expected a to still point to the old url, got %q", url)
+	}
+	if url, _ := dst.Get("b"); url != "http://new" {
+		t.Errorf("expected b to be overwritten, got %q", url)
+	}
+
+	if _, err := Import(struct{ storage.Provider }{dst}, r, Overwrite); err == nil {
+		t.Error("expected an error overwriting links in a driver that can't delete")
+	}
+}